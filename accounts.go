@@ -0,0 +1,417 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/commands"
+)
+
+// accountSep separates the name of the account from the peer IDs, message
+// IDs and peer names of the accounts defined in [[Account]]. Qualifying
+// them keeps the chats of every account apart, including the data stored
+// by the commands.
+const accountSep = "/"
+
+// Configuration of a Telegram account. Empty fields are taken from the
+// top-level configuration, except Admins, which are added to the
+// top-level ones.
+type accountConfig struct {
+	Name      string
+	TgBin     string
+	TgPubKey  string
+	MinOutput string
+	Chats     []string
+	Admins    []string
+
+	// BotName and MentionOnly configure the mentions of the bot in the
+	// groups of the account (see stripMention and needsMention).
+	BotName     string
+	MentionOnly []string
+
+	// Disable lists the commands, by the name of their config section
+	// (e.g. "Tweet"), that are not available in this account.
+	Disable []string
+
+	// IRC serves the account on IRC instead of Telegram.
+	IRC *ircConfig
+	// Bot serves the account through the Bot API instead of a tg client.
+	Bot *botAPIConfig
+}
+
+// An account is a Telegram account served by the bot through its own tg
+// client or the Bot API, or an IRC connection.
+type account struct {
+	accountConfig
+
+	out *outQueue
+
+	irc    *ircBridge
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+
+	// Restarts of the client
+	startTime time.Time
+	backoff   time.Duration
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	started bool
+}
+
+// Backoff between the restarts of a client that exits. It is reset when
+// the client runs for longer than restartMaxBackoff. They are variables
+// so the tests can shorten them.
+var (
+	restartMinBackoff = time.Second
+	restartMaxBackoff = 5 * time.Minute
+)
+
+// Accounts served by the bot. The first one is the default account.
+var accounts []*account
+
+// initAccounts creates the accounts defined in the config. If there are
+// none, the top-level configuration defines the only account, which has
+// no name.
+func initAccounts() error {
+	cfgs := globalConfig.Account
+	if len(cfgs) == 0 {
+		cfgs = []accountConfig{{}}
+	}
+
+	names := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if len(globalConfig.Account) > 0 {
+			if cfg.Name == "" || strings.ContainsAny(cfg.Name, accountSep+" ") {
+				return fmt.Errorf("invalid account name %q", cfg.Name)
+			}
+			if names[cfg.Name] {
+				return fmt.Errorf("duplicated account %q", cfg.Name)
+			}
+			names[cfg.Name] = true
+		}
+		if cfg.IRC != nil && cfg.Bot != nil {
+			return fmt.Errorf("account %q: IRC and Bot cannot be used together", cfg.Name)
+		}
+
+		if cfg.TgBin == "" {
+			cfg.TgBin = globalConfig.TgBin
+		}
+		if cfg.TgPubKey == "" {
+			cfg.TgPubKey = globalConfig.TgPubKey
+		}
+		if cfg.MinOutput == "" {
+			cfg.MinOutput = globalConfig.MinOutput
+		}
+		if len(cfg.Chats) == 0 {
+			cfg.Chats = globalConfig.Chats
+		}
+		if cfg.BotName == "" {
+			cfg.BotName = globalConfig.BotName
+		}
+		if len(cfg.MentionOnly) == 0 {
+			cfg.MentionOnly = globalConfig.MentionOnly
+		}
+		// The top-level admins are Telegram users
+		if cfg.IRC == nil {
+			cfg.Admins = append(cfg.Admins, globalConfig.Admins...)
+		}
+		for i := range cfg.Chats {
+			cfg.Chats[i] = strings.Replace(cfg.Chats[i], " ", "_", -1)
+		}
+		for _, ad := range cfg.Admins {
+			if cfg.IRC != nil && !validIRCAdmin(ad) {
+				return fmt.Errorf("invalid IRC admin %q: admins must be accounts ($a:name) or masks (nick!user@host)", ad)
+			}
+			if cfg.IRC == nil && !strings.HasPrefix(ad, "user#id") {
+				return fmt.Errorf("invalid admin %q: admins must be user IDs (e.g. user#id1234)", ad)
+			}
+		}
+		accounts = append(accounts, &account{accountConfig: cfg})
+	}
+	return nil
+}
+
+// accountOf returns the account of a qualified ID or name and the ID or
+// name without qualifier. Unqualified IDs belong to the default account.
+func accountOf(id string) (*account, string) {
+	if i := strings.Index(id, accountSep); i > 0 {
+		for _, a := range accounts {
+			if a.Name == id[:i] {
+				return a, id[i+len(accountSep):]
+			}
+		}
+	}
+	return accounts[0], id
+}
+
+// qualify qualifies an ID or a name with the name of the account.
+func (a *account) qualify(s string) string {
+	if a.Name == "" || s == "" {
+		return s
+	}
+	return a.Name + accountSep + s
+}
+
+// qualifyPeer qualifies the ID of p, and its name when it is used to
+// resolve names.
+func (a *account) qualifyPeer(p peer) peer {
+	return peer{ID: a.qualify(p.ID), Name: a.qualify(p.Name)}
+}
+
+// isMonitored returns true if "chat" is monitored. chat must be
+// qualified.
+func (a *account) isMonitored(chat peer) bool {
+	if len(a.Chats) == 0 {
+		return true
+	}
+	for _, c := range a.Chats {
+		if peers.matches(a.qualify(c), chat) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin returns true if the sender of m is a bot admin. The IDs of m
+// must be qualified. Admins are configured by ID, since anyone can take a
+// name.
+func (a *account) isAdmin(m commands.Message) bool {
+	if a.IRC != nil {
+		return a.isIRCAdmin(m)
+	}
+	for _, ad := range a.Admins {
+		if a.qualify(ad) == m.FromID {
+			return true
+		}
+	}
+	return false
+}
+
+// disables returns true if cmd is not available in the account.
+func (a *account) disables(cmd commands.Command) bool {
+	name := commandNames[cmd]
+	for _, d := range a.Disable {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setStarted marks the tg client of the account as started. The bot is
+// started once all the accounts are.
+func (a *account) setStarted() {
+	a.mu.Lock()
+	a.started = true
+	a.mu.Unlock()
+
+	for _, acc := range accounts {
+		acc.mu.Lock()
+		started := acc.started
+		acc.mu.Unlock()
+		if !started {
+			return
+		}
+	}
+	status.setStarted()
+}
+
+// start starts the client of the account and the queue of the commands
+// sent to it. The queue is kept when the client is restarted.
+func (a *account) start() error {
+	a.mu.Lock()
+	err := a.startClient()
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = accountInput{a}
+	if recorder != nil {
+		w = io.MultiWriter(w, recorder.Output)
+	}
+	a.out = newOutQueue(mediaReleaser{w})
+	return nil
+}
+
+// startClient starts the client of the account. a.mu must be held.
+func (a *account) startClient() error {
+	start := a.startTg
+	switch {
+	case a.IRC != nil:
+		start = a.startIRC
+	case a.Bot != nil:
+		start = a.startBotAPI
+	}
+	a.startTime = time.Now()
+	return start()
+}
+
+// restart stops the client of the account, which has exited, and starts
+// it again.
+func (a *account) restart() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.started = false
+	a.stopClient()
+	return a.startClient()
+}
+
+// nextBackoff returns the time to wait before restarting the client of
+// the account, which has exited.
+func (a *account) nextBackoff() time.Duration {
+	if a.backoff == 0 || time.Since(a.startTime) > restartMaxBackoff {
+		a.backoff = restartMinBackoff
+	} else if a.backoff *= 2; a.backoff > restartMaxBackoff {
+		a.backoff = restartMaxBackoff
+	}
+	return a.backoff
+}
+
+// accountInput is the io.Writer that writes to the running client of the
+// account.
+type accountInput struct {
+	a *account
+}
+
+func (in accountInput) Write(p []byte) (n int, err error) {
+	in.a.mu.Lock()
+	w := in.a.stdin
+	in.a.mu.Unlock()
+	if w == nil {
+		return 0, errors.New("client not running")
+	}
+	return w.Write(p)
+}
+
+// startTg starts the tg client of the account.
+func (a *account) startTg() error {
+	script, err := minOutputPath(a.MinOutput, globalConfig.DataDir)
+	if err != nil {
+		return err
+	}
+
+	// -R: disable readline, -C: disable color, -D: disable output,
+	// -W: send dialog_list on start, -s: lua script
+	a.cmd = exec.Command(a.TgBin, "-R", "-C", "-D", "-W",
+		"-s", script,
+		"-k", a.TgPubKey)
+
+	if a.stdout, err = a.cmd.StdoutPipe(); err != nil {
+		return err
+	}
+	if a.stdin, err = a.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	return a.cmd.Start()
+}
+
+// stop sends the pending commands and stops the client of the account.
+func (a *account) stop() {
+	if a.out != nil {
+		if err := a.out.Close(); err != nil {
+			log.Printf("account %q: %v\n", a.Name, err)
+		}
+	}
+	a.mu.Lock()
+	a.stopClient()
+	a.mu.Unlock()
+}
+
+// stopClient stops the client of the account. a.mu must be held.
+func (a *account) stopClient() {
+	if (a.IRC != nil || a.Bot != nil) && a.stdin != nil {
+		if err := a.stdin.Close(); err != nil {
+			log.Printf("account %q: %v\n", a.Name, err)
+		}
+	}
+	if a.cmd != nil && a.cmd.Process != nil {
+		a.stdin.Close()
+		a.cmd.Process.Signal(os.Interrupt)
+		if err := a.cmd.Wait(); err != nil {
+			log.Printf("account %q: tg client: %v\n", a.Name, err)
+		}
+	}
+	a.cmd, a.stdin = nil, nil
+}
+
+// An accountLine is a line printed by the tg client of an account.
+type accountLine struct {
+	a    *account
+	line string
+}
+
+// An accountExit reports that the client of an account has exited, with
+// the read error, if any.
+type accountExit struct {
+	a   *account
+	err error
+}
+
+// scan sends the lines printed by the client to lines until it exits or
+// stop is closed. When the client exits, it is reported to exits.
+func (a *account) scan(lines chan<- accountLine, exits chan<- accountExit, stop <-chan struct{}) {
+	s := bufio.NewScanner(a.stdout)
+	for s.Scan() {
+		select {
+		case lines <- accountLine{a, s.Text()}:
+		case <-stop:
+			return
+		}
+	}
+	log.Printf("client exited (account %q)\n", a.Name)
+	select {
+	case exits <- accountExit{a, s.Err()}:
+	case <-stop:
+	}
+}
+
+// accountRouter is the io.Writer that sends every command to the tg
+// client of the account of its peer, removing the qualifier. Commands
+// whose peer does not belong to any account are dropped. Every call to
+// Write is expected to contain complete commands.
+type accountRouter struct{}
+
+func (accountRouter) Write(p []byte) (n int, err error) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		size := len(line)
+		a := accounts[0]
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) > 1 {
+			to := fields[1]
+			a, fields[1] = accountOf(to)
+			if a.qualify(fields[1]) != to {
+				log.Printf("dropping command to %v: unknown account\n", to)
+				n += size
+				continue
+			}
+			line = strings.Join(fields, " ")
+		}
+		if a.out == nil {
+			return n, errors.New("account not started")
+		}
+		refMedia([]byte(line))
+		if _, err := a.out.Write([]byte(line)); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
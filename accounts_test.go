@@ -0,0 +1,83 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// newTestAccount returns an account named name whose commands are
+// written to out.
+func newTestAccount(name string, out *lockedBuffer) *account {
+	a := &account{accountConfig: accountConfig{Name: name}}
+	a.out = newOutQueue(out)
+	return a
+}
+
+func TestAccountRouter(t *testing.T) {
+	home, work := &lockedBuffer{}, &lockedBuffer{}
+	setTestAccounts(t, newTestAccount("home", home), newTestAccount("work", work))
+
+	cmds := "msg home/chat#id1 hi home\n" +
+		"msg work/user#id5 hi work\n" +
+		"reply work/5_7 hello\n" +
+		"msg chat#id1 unqualified\n" +
+		"msg other/chat#id1 unknown account\n" +
+		"msg home/chat#id2 bye\n"
+	n, err := accountRouter{}.Write([]byte(cmds))
+	if err != nil || n != len(cmds) {
+		t.Errorf("got %v, %v, want %v", n, err, len(cmds))
+	}
+	for _, a := range accounts {
+		if err := a.out.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		out  *lockedBuffer
+		want string
+	}{
+		{"home", home, "msg chat#id1 hi home\nmsg chat#id2 bye\n"},
+		{"work", work, "msg user#id5 hi work\nreply 5_7 hello\n"},
+	}
+	for _, tt := range tests {
+		if got := tt.out.String(); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccountRouterDefault(t *testing.T) {
+	out := &lockedBuffer{}
+	setTestAccounts(t, newTestAccount("", out))
+
+	// Without [[Account]] tables, peers are not qualified
+	cmds := "msg chat#id1 hi\ndialog_list\n"
+	if _, err := (accountRouter{}).Write([]byte(cmds)); err != nil {
+		t.Fatal(err)
+	}
+	accounts[0].out.Close()
+	if got := out.String(); got != cmds {
+		t.Errorf("got %q, want %q", got, cmds)
+	}
+}
+
+func TestAccountRouterNotStarted(t *testing.T) {
+	out := &lockedBuffer{}
+	setTestAccounts(t, newTestAccount("home", out), &account{accountConfig: accountConfig{Name: "work"}})
+
+	// The bytes of the commands routed before the failing one are written
+	first := "msg home/chat#id1 a\n"
+	n, err := accountRouter{}.Write([]byte(first + "msg work/chat#id1 b\nmsg home/chat#id1 c\n"))
+	if err == nil || n != len(first) {
+		t.Errorf("got %v, %v, want %v and an error", n, err, len(first))
+	}
+	accounts[0].out.Close()
+	if got := out.String(); got != "msg chat#id1 a\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package audit implements an append-only log of command invocations.
+// Entries are written as JSON lines and the log file is rotated when it
+// reaches a given size.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of a command invocation. Invalid invocations are rejected
+// because of the input of the user. Commands that start a conversation
+// are pending until it ends, which is logged as another entry.
+const (
+	OK        = "ok"
+	Error     = "error"
+	Invalid   = "invalid"
+	Denied    = "denied"
+	Pending   = "pending"
+	Cancelled = "cancelled"
+)
+
+// An Entry describes a command invocation.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Chat      string    `json:"chat"`
+	ChatName  string    `json:"chat_name"`
+	Sender    string    `json:"sender"`
+	SenderID  string    `json:"sender_id"`
+	Command   string    `json:"command"`
+	Args      string    `json:"args,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	ErrorRef  string    `json:"error_ref,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+}
+
+// String returns a human readable representation of the entry.
+func (e Entry) String() string {
+	s := fmt.Sprintf("%v %v %v: %v", e.Time.Format("2006-01-02 15:04:05"),
+		e.ChatName, e.Sender, e.Command)
+	if e.Args != "" {
+		s += " " + e.Args
+	}
+	s += fmt.Sprintf(" -> %v (%vms)", e.Outcome, e.LatencyMs)
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	if e.ErrorRef != "" {
+		s += " (ref " + e.ErrorRef + ")"
+	}
+	return strings.Replace(s, "\n", " ", -1)
+}
+
+// A Log is an audit log file.
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens the audit log at path. When the file grows beyond maxSize
+// bytes it is rotated, keeping at most maxFiles old files (path.1 being
+// the most recent one).
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Write appends e to the log, rotating the file if needed.
+func (l *Log) Write(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to path.1, shifting the older files
+// and removing the ones beyond maxFiles.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if l.maxFiles < 1 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+		return l.open()
+	}
+
+	os.Remove(l.rotated(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(l.rotated(i), l.rotated(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%v.%v", l.path, i)
+}
+
+// Last returns the last n entries, oldest first.
+func (l *Log) Last(n int) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := readEntries(l.path)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; len(entries) < n && i <= l.maxFiles; i++ {
+		old, err := readEntries(l.rotated(i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(old, entries...)
+	}
+
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+func readEntries(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			continue // skip truncated lines
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
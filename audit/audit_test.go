@@ -0,0 +1,194 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entrySize is the size of the JSON line of the entries written by
+// writeEntries.
+var entrySize = func() int64 {
+	data, _ := json.Marshal(testEntry(0))
+	return int64(len(data) + 1)
+}()
+
+func testEntry(i int) Entry {
+	return Entry{
+		Time:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Chat:    "chat#id1",
+		Command: "!e",
+		Args:    fmt.Sprintf("%03d", i),
+		Outcome: OK,
+	}
+}
+
+func writeEntries(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := l.Write(testEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// logFiles returns the names of the files in dir and the number of
+// entries in each of them.
+func logFiles(t *testing.T, dir string) map[string]int {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]int)
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[fi.Name()] = strings.Count(string(data), "\n")
+	}
+	return m
+}
+
+func args(entries []Entry) string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, e.Args)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		entries  int
+		want     map[string]int
+	}{
+		{"no rotation", 0, 2, 10, map[string]int{"audit.jsonl": 10}},
+		{"rotated", 3 * entrySize, 2, 5, map[string]int{"audit.jsonl": 2, "audit.jsonl.1": 3}},
+		{"old files removed", 3 * entrySize, 2, 10, map[string]int{"audit.jsonl": 1, "audit.jsonl.1": 3, "audit.jsonl.2": 3}},
+		{"no old files", 3 * entrySize, 0, 10, map[string]int{"audit.jsonl": 1}},
+		{"entry bigger than the limit", 1, 1, 3, map[string]int{"audit.jsonl": 1, "audit.jsonl.1": 1}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		l, err := Open(filepath.Join(dir, "audit.jsonl"), tt.maxSize, tt.maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeEntries(t, l, 0, tt.entries)
+		l.Close()
+		if got := logFiles(t, dir); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v: got files %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	l, err := Open(path, 3*entrySize, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntries(t, l, 0, 2)
+	l.Close()
+
+	// The size of the existing file counts towards the limit
+	l, err = Open(path, 3*entrySize, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeEntries(t, l, 2, 4)
+	want := map[string]int{"audit.jsonl": 1, "audit.jsonl.1": 3}
+	if got := logFiles(t, dir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+}
+
+func TestLast(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(filepath.Join(dir, "audit.jsonl"), 3*entrySize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if entries, err := l.Last(5); err != nil || len(entries) != 0 {
+		t.Errorf("empty log: got %v, %v", entries, err)
+	}
+
+	// The entries of the rotated files are read too, but not the removed
+	// ones
+	writeEntries(t, l, 0, 10)
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "009"},
+		{3, "007 008 009"},
+		{5, "005 006 007 008 009"},
+		{20, "003 004 005 006 007 008 009"},
+	}
+	for _, tt := range tests {
+		entries, err := l.Last(tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := args(entries); got != tt.want {
+			t.Errorf("Last(%v): got %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLastSkipsBadLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	if err := ioutil.WriteFile(path, []byte("not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeEntries(t, l, 0, 1)
+
+	entries, err := l.Last(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := args(entries); got != "000" {
+		t.Errorf("got %v, want 000", got)
+	}
+}
+
+func TestEntryString(t *testing.T) {
+	e := Entry{
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ChatName:  "Chat",
+		Sender:    "alice",
+		Command:   "!q",
+		Args:      "multi\nline",
+		Outcome:   Error,
+		Error:     "boom",
+		ErrorRef:  "3f2a1c",
+		LatencyMs: 12,
+	}
+	want := "2024-01-02 03:04:05 Chat alice: !q multi line -> error (12ms): boom (ref 3f2a1c)"
+	if got := e.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/audit"
+)
+
+// Defaults of the audit log configuration.
+const (
+	defaultAuditFile     = "audit.jsonl"
+	defaultAuditMaxSize  = 10 * 1024 * 1024
+	defaultAuditMaxFiles = 5
+)
+
+// Audit log of command invocations. It is nil if the audit log is
+// disabled.
+var auditLog *audit.Log
+
+// initAudit opens the audit log if it is enabled.
+func initAudit() error {
+	cfg := &globalConfig.Audit
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(globalConfig.DataDir, defaultAuditFile)
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defaultAuditMaxSize
+	}
+	if cfg.MaxFiles == 0 {
+		cfg.MaxFiles = defaultAuditMaxFiles
+	}
+
+	var err error
+	auditLog, err = audit.Open(cfg.Path, cfg.MaxSize, cfg.MaxFiles)
+	return err
+}
+
+// auditInvocation writes an entry to the audit log for the invocation of
+// the command in text, started at start. ref is the reference of the
+// error reported to the user, if any.
+func auditInvocation(chat, from peer, text string, start time.Time, outcome string, err error, ref string) {
+	if auditLog == nil {
+		return
+	}
+
+	e := audit.Entry{
+		Time:      start,
+		Chat:      chat.ID,
+		ChatName:  chat.Name,
+		Sender:    from.Name,
+		SenderID:  from.ID,
+		Outcome:   outcome,
+		ErrorRef:  ref,
+		LatencyMs: int64(time.Since(start) / time.Millisecond),
+	}
+	fields := strings.SplitN(text, " ", 2)
+	e.Command = fields[0]
+	if len(fields) == 2 {
+		e.Args = strings.TrimSpace(fields[1])
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if err := auditLog.Write(e); err != nil {
+		log.Println("cannot write audit log:", err)
+	}
+}
@@ -0,0 +1,602 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/utils"
+)
+
+// Configuration of an account served through the Telegram Bot API
+// instead of a tg client.
+type botAPIConfig struct {
+	Token string
+	// API is the URL of the Bot API server. Defaults to
+	// https://api.telegram.org.
+	API  string
+	HTTP utils.HTTPConfig
+}
+
+const defaultBotAPI = "https://api.telegram.org"
+
+// botPollTimeout is the time the server holds the requests for updates
+// when there are none.
+const botPollTimeout = 50 * time.Second
+
+// Backoff between the failed requests for updates. They are variables so
+// the tests can shorten them.
+var (
+	botMinBackoff = time.Second
+	botMaxBackoff = 5 * time.Minute
+)
+
+// botMaxRetries is the number of times a request rejected for exceeding
+// the rate limits is sent again.
+const botMaxRetries = 3
+
+// botRetryUnit is the unit of the time to wait given by the server when
+// a request exceeds the rate limits. It is a variable so the tests can
+// shorten it.
+var botRetryUnit = time.Second
+
+// botAPIBridge connects the bot to the Telegram Bot API. Like ircBridge,
+// it translates the updates into the lines printed by minoutput.lua and
+// the commands sent to the tg client into requests. Peers are identified
+// as in the tg client (e.g. "user#id1234" or "chat#id-1234"), and
+// messages by the ID of their chat and their own, since Bot API message
+// IDs are only unique in their chat.
+type botAPIBridge struct {
+	url    string // base URL of the methods
+	client *http.Client
+	lines  *io.PipeWriter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	fileIDs map[string]string // hash of the content -> Bot API file_id
+}
+
+// Bot API types. Only the used fields are decoded.
+type (
+	botResponse struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+
+	botUpdate struct {
+		UpdateID int64       `json:"update_id"`
+		Message  *botMessage `json:"message"`
+	}
+
+	botUser struct {
+		ID        int64  `json:"id"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+
+	botChat struct {
+		ID        int64  `json:"id"`
+		Type      string `json:"type"`
+		Title     string `json:"title"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+
+	botMessage struct {
+		MessageID      int64       `json:"message_id"`
+		From           *botUser    `json:"from"`
+		Chat           botChat     `json:"chat"`
+		Text           string      `json:"text"`
+		Caption        string      `json:"caption"`
+		ReplyTo        *botMessage `json:"reply_to_message"`
+		NewChatMembers []botUser   `json:"new_chat_members"`
+		LeftChatMember *botUser    `json:"left_chat_member"`
+		NewChatTitle   string      `json:"new_chat_title"`
+
+		Photo     json.RawMessage `json:"photo"`
+		Document  json.RawMessage `json:"document"`
+		Audio     json.RawMessage `json:"audio"`
+		Video     json.RawMessage `json:"video"`
+		Voice     json.RawMessage `json:"voice"`
+		Sticker   json.RawMessage `json:"sticker"`
+		Animation json.RawMessage `json:"animation"`
+	}
+)
+
+// botUploads maps the tg client commands that send files to the Bot API
+// method and the field of the file.
+var botUploads = map[string][2]string{
+	"send_photo":    {"sendPhoto", "photo"},
+	"send_audio":    {"sendAudio", "audio"},
+	"send_document": {"sendDocument", "document"},
+	"send_file":     {"sendDocument", "document"},
+}
+
+// startBotAPI connects the account to the Bot API.
+func (a *account) startBotAPI() error {
+	cfg := a.Bot
+	if cfg.Token == "" {
+		return fmt.Errorf("account %q: Bot Token is required", a.Name)
+	}
+	client, err := utils.NewClient(cfg.HTTP)
+	if err != nil {
+		return err
+	}
+
+	r, b := newBotAPIBridge(cfg, client)
+	go b.run()
+
+	a.stdout, a.stdin = r, b
+	return nil
+}
+
+// newBotAPIBridge returns a botAPIBridge that sends its lines to r. It
+// does not poll for updates until run is called.
+func newBotAPIBridge(cfg *botAPIConfig, client *http.Client) (r *io.PipeReader, b *botAPIBridge) {
+	api := cfg.API
+	if api == "" {
+		api = defaultBotAPI
+	}
+
+	// The long polling outlasts the timeout of the client
+	c := *client
+	c.Timeout = 0
+
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	b = &botAPIBridge{
+		url:     strings.TrimSuffix(api, "/") + "/bot" + cfg.Token + "/",
+		client:  &c,
+		lines:   w,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		fileIDs: make(map[string]string),
+	}
+	return r, b
+}
+
+// run checks the token and polls for updates until the bridge is closed.
+// Failed requests are retried with exponential backoff.
+func (b *botAPIBridge) run() {
+	defer close(b.done)
+
+	backoff := botMinBackoff
+	wait := func(err error) bool {
+		log.Println("bot api:", err)
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > botMaxBackoff {
+			backoff = botMaxBackoff
+		}
+		return true
+	}
+
+	for {
+		var me botUser
+		err := b.call("getMe", nil, &me, 0)
+		if err == nil {
+			log.Printf("bot api: logged in as %v\n", me.ID)
+			break
+		}
+		if b.ctx.Err() != nil || !wait(err) {
+			return
+		}
+	}
+	b.print(startedLine)
+
+	var offset int64
+	for {
+		params := url.Values{
+			"offset":          {strconv.FormatInt(offset, 10)},
+			"timeout":         {strconv.Itoa(int(botPollTimeout / time.Second))},
+			"allowed_updates": {`["message"]`},
+		}
+		var updates []botUpdate
+		err := b.call("getUpdates", params, &updates, botPollTimeout+30*time.Second)
+		if b.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if !wait(err) {
+				return
+			}
+			continue
+		}
+		backoff = botMinBackoff
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				b.handle(u.Message)
+			}
+		}
+	}
+}
+
+// handle translates a received message into minoutput.lua lines.
+func (b *botAPIBridge) handle(m *botMessage) {
+	if m.From == nil {
+		// Channel posts
+		return
+	}
+	chat := botChatStr(m.Chat)
+	from := botUserStr(*m.From)
+
+	switch {
+	case len(m.NewChatMembers) > 0:
+		for _, u := range m.NewChatMembers {
+			b.print(fmt.Sprintf("[EVT] join %v %v %v", chat, from, botUserStr(u)))
+		}
+	case m.LeftChatMember != nil:
+		b.print(fmt.Sprintf("[EVT] leave %v %v %v", chat, from, botUserStr(*m.LeftChatMember)))
+	case m.NewChatTitle != "":
+		b.print(fmt.Sprintf("[EVT] rename %v %v %v", chat, from, filterChars(m.NewChatTitle)))
+	case m.Text != "":
+		replyTo := "-"
+		if m.ReplyTo != nil {
+			replyTo = botMsgID(m.Chat.ID, m.ReplyTo.MessageID)
+		}
+		b.print(fmt.Sprintf("[MSG] %v %v %v %v %v", botMsgID(m.Chat.ID, m.MessageID),
+			replyTo, chat, from, filterChars(m.Text)))
+	default:
+		if kind := m.mediaType(); kind != "" {
+			b.print(fmt.Sprintf("[EVT] media %v %v %v %v", chat, from, kind, filterChars(m.Caption)))
+		}
+	}
+}
+
+// mediaType returns the type of the media of m, named as in the tg
+// client, or "" if it has none.
+func (m *botMessage) mediaType() string {
+	switch {
+	case m.Photo != nil:
+		return "photo"
+	case m.Sticker != nil, m.Animation != nil, m.Video != nil,
+		m.Audio != nil, m.Voice != nil, m.Document != nil:
+		return "document"
+	}
+	return ""
+}
+
+// fileID returns the file_id of the media of m, or "" if it has none. The
+// file_id of a photo is the one of its largest size.
+func (m *botMessage) fileID() string {
+	var file struct {
+		FileID string `json:"file_id"`
+	}
+	for _, raw := range []json.RawMessage{m.Document, m.Audio, m.Video,
+		m.Voice, m.Animation, m.Sticker} {
+		if raw != nil && json.Unmarshal(raw, &file) == nil && file.FileID != "" {
+			return file.FileID
+		}
+	}
+	var sizes []struct {
+		FileID string `json:"file_id"`
+	}
+	if m.Photo != nil && json.Unmarshal(m.Photo, &sizes) == nil && len(sizes) > 0 {
+		return sizes[len(sizes)-1].FileID
+	}
+	return ""
+}
+
+// botMsgID returns the ID of the message id of the chat with the given
+// Bot API ID.
+func botMsgID(chat, id int64) string {
+	return fmt.Sprintf("%v_%v", chat, id)
+}
+
+// parseBotMsgID returns the Bot API IDs of the chat and the message of a
+// message ID returned by botMsgID.
+func parseBotMsgID(id string) (chat, msg string, ok bool) {
+	i := strings.LastIndex(id, "_")
+	if i <= 0 || i == len(id)-1 {
+		return "", "", false
+	}
+	return id[:i], id[i+1:], true
+}
+
+// botChatStr returns the peer ID and name of a chat, as printed by
+// minoutput.lua. Private chats are the users.
+func botChatStr(c botChat) string {
+	if c.Type == "private" {
+		return botUserStr(botUser{ID: c.ID, FirstName: c.FirstName, LastName: c.LastName})
+	}
+	kind := "chat"
+	if c.Type == "channel" {
+		kind = "channel"
+	}
+	return fmt.Sprintf("%v#id%v %v", kind, c.ID, sanitizeName(c.Title))
+}
+
+// botUserStr returns the peer ID and name of a user, as printed by
+// minoutput.lua.
+func botUserStr(u botUser) string {
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	return fmt.Sprintf("user#id%v %v", u.ID, sanitizeName(name))
+}
+
+// botChatID returns the Bot API ID of a peer ID. Other peers (e.g.
+// "@channel") are returned unchanged.
+func botChatID(peer string) string {
+	if i := strings.Index(peer, "#id"); i >= 0 {
+		return peer[i+len("#id"):]
+	}
+	return peer
+}
+
+// filterChars replaces the control characters of s with spaces, as
+// minoutput.lua does, so s cannot break the lines.
+func filterChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// sanitizeName returns the name s as printed by minoutput.lua, with its
+// spaces replaced by underscores, or "-" if it is empty.
+func sanitizeName(s string) string {
+	s = strings.Join(strings.Fields(filterChars(s)), "_")
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (b *botAPIBridge) print(line string) {
+	if _, err := fmt.Fprintln(b.lines, line); err != nil {
+		log.Println("bot api:", err)
+	}
+}
+
+// Write translates the commands for the tg client into Bot API requests.
+// Other commands are ignored. If a request fails, it returns the number
+// of bytes of the commands already sent.
+func (b *botAPIBridge) Write(p []byte) (n int, err error) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if err := b.writeLine(strings.TrimSuffix(line, "\n")); err != nil {
+			return n, err
+		}
+		n += len(line)
+	}
+	return n, nil
+}
+
+// writeLine sends the command in line.
+func (b *botAPIBridge) writeLine(line string) error {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return nil
+	}
+	action, to, arg := fields[0], fields[1], fields[2]
+
+	params := url.Values{}
+	if strings.HasPrefix(action, "reply") {
+		chat, msg, ok := parseBotMsgID(to)
+		if !ok {
+			log.Printf("bot api: invalid message %v\n", to)
+			return nil
+		}
+		to = chat
+		params.Set("reply_to_message_id", msg)
+		action = strings.Replace(action, "reply", "send", 1)
+	} else {
+		to = botChatID(to)
+	}
+	params.Set("chat_id", to)
+
+	if action == "msg" || action == "send" {
+		params.Set("text", arg)
+		return b.call("sendMessage", params, nil, 0)
+	}
+	if up, ok := botUploads[action]; ok {
+		return b.upload(up[0], up[1], arg, params)
+	}
+	return nil
+}
+
+// call calls the Bot API method with params and decodes its result into
+// result, if not nil. A timeout of 0 means no timeout.
+func (b *botAPIBridge) call(method string, params url.Values, result interface{}, timeout time.Duration) error {
+	ctx := b.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest("POST", b.url+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return redactToken(method, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(method, req, result)
+}
+
+// upload calls the Bot API method with params and the file in path as
+// the field. Files with the same content as one already uploaded are
+// sent by their file_id, and uploaded again if it is rejected.
+func (b *botAPIBridge) upload(method, field, path string, params url.Values) error {
+	var hash string
+	hashed := false
+	if mediaStore != nil {
+		hash, hashed = mediaStore.Hash(path)
+	}
+	if hashed {
+		b.mu.Lock()
+		id, ok := b.fileIDs[hash]
+		b.mu.Unlock()
+		if ok {
+			p := url.Values{field: {id}}
+			for k := range params {
+				p.Set(k, params.Get(k))
+			}
+			err := b.call(method, p, nil, 0)
+			if err == nil {
+				return nil
+			}
+			log.Printf("bot api: %v: uploading it again: %v\n", path, err)
+			b.mu.Lock()
+			delete(b.fileIDs, hash)
+			b.mu.Unlock()
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k := range params {
+		if err := mw.WriteField(k, params.Get(k)); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, f); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", b.url+method, &body)
+	if err != nil {
+		return redactToken(method, err)
+	}
+	req = req.WithContext(b.ctx)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var m botMessage
+	if err := b.do(method, req, &m); err != nil {
+		return err
+	}
+	if id := m.fileID(); hashed && id != "" {
+		b.mu.Lock()
+		b.fileIDs[hash] = id
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// do sends req, a request to the Bot API method, and decodes its result
+// into result, if not nil. Requests rejected for exceeding the rate
+// limits are sent again after the time given by the server, up to
+// botMaxRetries times.
+func (b *botAPIBridge) do(method string, req *http.Request, result interface{}) error {
+	for retries := 0; ; retries++ {
+		r, err := b.roundTrip(method, req)
+		if err != nil {
+			return err
+		}
+		if !r.OK && r.Parameters.RetryAfter > 0 && retries < botMaxRetries {
+			wait := time.Duration(r.Parameters.RetryAfter) * botRetryUnit
+			log.Printf("bot api: %v: %v, retrying in %v\n", method, r.Description, wait)
+			if req, err = rewind(req, wait); err != nil {
+				return redactToken(method, err)
+			}
+			continue
+		}
+		if !r.OK {
+			return fmt.Errorf("%v: %v", method, r.Description)
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return fmt.Errorf("%v: %v", method, err)
+		}
+		return nil
+	}
+}
+
+// roundTrip sends req, a request to the Bot API method, and decodes the
+// response.
+func (b *botAPIBridge) roundTrip(method string, req *http.Request) (*botResponse, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, redactToken(method, err)
+	}
+	defer resp.Body.Close()
+
+	var r botResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%v: %v (HTTP status %v)", method, err, resp.StatusCode)
+	}
+	return &r, nil
+}
+
+// rewind waits for d, or until the context of req is done, and returns a
+// copy of req that can be sent again.
+func rewind(req *http.Request, d time.Duration) (*http.Request, error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	if req.GetBody == nil {
+		return nil, errors.New("cannot resend request")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+// redactToken removes the URL, which contains the token, from the errors
+// of the requests to method.
+func redactToken(method string, err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return fmt.Errorf("%v: %v", method, uerr.Err)
+	}
+	return fmt.Errorf("%v: %v", method, err)
+}
+
+// Close stops polling for updates.
+func (b *botAPIBridge) Close() error {
+	b.cancel()
+	b.lines.Close()
+	<-b.done
+	return nil
+}
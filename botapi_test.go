@@ -0,0 +1,450 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/tgbot/media"
+)
+
+const testBotToken = "123:secret"
+
+// botRequest is a request received by the fake Bot API server.
+type botRequest struct {
+	method string
+	params map[string]string
+	file   string // content of the uploaded file, if any
+}
+
+// fakeBotAPI is a Bot API server that answers getMe, returns the queued
+// updates to getUpdates and records the rest of the requests.
+type fakeBotAPI struct {
+	*httptest.Server
+	updates  chan string // JSON arrays of updates
+	requests chan botRequest
+	offsets  chan string
+	denied   int32 // requests with a wrong token
+	limited  int32 // messages to reject for exceeding the rate limits
+}
+
+func newFakeBotAPI(t *testing.T) *fakeBotAPI {
+	f := &fakeBotAPI{
+		updates:  make(chan string, 10),
+		requests: make(chan botRequest, 10),
+		offsets:  make(chan string, 10),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/bot" + testBotToken + "/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			atomic.AddInt32(&f.denied, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"ok":false,"description":"Unauthorized"}`)
+			return
+		}
+		method := r.URL.Path[len(prefix):]
+
+		req := botRequest{method: method, params: make(map[string]string)}
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			for k, v := range r.MultipartForm.Value {
+				req.params[k] = v[0]
+			}
+			for _, fhs := range r.MultipartForm.File {
+				fr, err := fhs[0].Open()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ := ioutil.ReadAll(fr)
+				fr.Close()
+				req.file = string(data)
+			}
+		} else {
+			r.ParseForm()
+			for k, v := range r.PostForm {
+				req.params[k] = v[0]
+			}
+		}
+
+		switch method {
+		case "getMe":
+			fmt.Fprint(w, `{"ok":true,"result":{"id":42,"first_name":"bot"}}`)
+		case "getUpdates":
+			f.offsets <- req.params["offset"]
+			select {
+			case u := <-f.updates:
+				fmt.Fprintf(w, `{"ok":true,"result":%v}`, u)
+			case <-r.Context().Done():
+			}
+		case "sendMessage", "sendPhoto", "sendAudio", "sendDocument":
+			if atomic.AddInt32(&f.limited, -1) >= 0 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 2",`+
+					`"parameters":{"retry_after":2}}`)
+				return
+			}
+			f.requests <- req
+			if req.params["chat_id"] == "0" {
+				fmt.Fprint(w, `{"ok":false,"description":"Bad Request: chat not found"}`)
+				return
+			}
+			switch {
+			case req.params["photo"] == "stale" || req.params["document"] == "stale":
+				fmt.Fprint(w, `{"ok":false,"description":"Bad Request: wrong file identifier"}`)
+			case req.file != "" && method == "sendPhoto":
+				fmt.Fprint(w, `{"ok":true,"result":{"photo":[{"file_id":"small"},{"file_id":"photo-id"}]}}`)
+			case req.file != "":
+				fmt.Fprint(w, `{"ok":true,"result":{"document":{"file_id":"doc-id"}}}`)
+			default:
+				fmt.Fprint(w, `{"ok":true,"result":{}}`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"ok":false,"description":"Not Found"}`)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// startBotAPITest starts a bridge connected to f and returns a scanner of
+// its lines.
+func startBotAPITest(t *testing.T, f *fakeBotAPI, token string) (*botAPIBridge, *bufio.Scanner) {
+	oldMin, oldMax, oldUnit := botMinBackoff, botMaxBackoff, botRetryUnit
+	botMinBackoff, botMaxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	botRetryUnit = 10 * time.Millisecond
+	t.Cleanup(func() { botMinBackoff, botMaxBackoff, botRetryUnit = oldMin, oldMax, oldUnit })
+
+	r, b := newBotAPIBridge(&botAPIConfig{Token: token, API: f.URL}, f.Client())
+	go b.run()
+	t.Cleanup(func() { b.Close() })
+	return b, bufio.NewScanner(r)
+}
+
+func readLine(t *testing.T, s *bufio.Scanner) string {
+	t.Helper()
+	if !s.Scan() {
+		t.Fatalf("no line: %v", s.Err())
+	}
+	return s.Text()
+}
+
+func TestBotAPIUpdates(t *testing.T) {
+	f := newFakeBotAPI(t)
+	_, s := startBotAPITest(t, f, testBotToken)
+
+	if line := readLine(t, s); line != startedLine {
+		t.Fatalf("got %q, want %q", line, startedLine)
+	}
+
+	f.updates <- `[
+		{"update_id": 10, "message": {"message_id": 1,
+			"from": {"id": 5, "first_name": "Ana", "last_name": "Ruiz"},
+			"chat": {"id": 5, "type": "private", "first_name": "Ana", "last_name": "Ruiz"},
+			"text": "!e hi\nthere"}},
+		{"update_id": 11, "message": {"message_id": 2,
+			"from": {"id": 5, "first_name": "Ana"},
+			"chat": {"id": -100, "type": "supergroup", "title": "The team"},
+			"reply_to_message": {"message_id": 1},
+			"text": "!q"}},
+		{"update_id": 12, "message": {"message_id": 3,
+			"from": {"id": 5, "first_name": "Ana"},
+			"chat": {"id": -100, "type": "supergroup", "title": "The team"},
+			"new_chat_members": [{"id": 6, "first_name": "Bob"}]}},
+		{"update_id": 13, "message": {"message_id": 4,
+			"from": {"id": 6, "first_name": ""},
+			"chat": {"id": -100, "type": "supergroup", "title": "The team"},
+			"photo": [{}], "caption": "cats"}},
+		{"update_id": 14, "message": {"message_id": 5,
+			"chat": {"id": -200, "type": "channel", "title": "News"},
+			"text": "channel post"}}
+	]`
+	want := []string{
+		"[MSG] 5_1 - user#id5 Ana_Ruiz user#id5 Ana_Ruiz !e hi there",
+		"[MSG] -100_2 -100_1 chat#id-100 The_team user#id5 Ana !q",
+		"[EVT] join chat#id-100 The_team user#id5 Ana user#id6 Bob",
+		"[EVT] media chat#id-100 The_team user#id6 - photo cats",
+	}
+	for _, w := range want {
+		line := readLine(t, s)
+		if line != w {
+			t.Errorf("got %q, want %q", line, w)
+		}
+		if w[:5] == "[MSG]" && msgRegexp.FindStringSubmatch(line) == nil {
+			t.Errorf("%q does not match msgRegexp", line)
+		}
+		if w[:5] == "[EVT]" {
+			if _, _, _, ok := parseEvent(line); !ok {
+				t.Errorf("%q is not a valid event", line)
+			}
+		}
+	}
+
+	// The updates are acknowledged by the offset of the next request
+	for _, want := range []string{"0", "15"} {
+		if got := <-f.offsets; got != want {
+			t.Errorf("offset: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBotAPIWrite(t *testing.T) {
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+
+	path := filepath.Join(t.TempDir(), "pic.png")
+	if err := ioutil.WriteFile(path, []byte("PNG"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmds := "msg user#id5 hello world\n" +
+		"reply -100_7 hi\n" +
+		"send_photo chat#id-100 " + path + "\n" +
+		"reply_document -100_8 " + path + "\n" +
+		"dialog_list\n"
+	if _, err := b.Write([]byte(cmds)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []botRequest{
+		{"sendMessage", map[string]string{"chat_id": "5", "text": "hello world"}, ""},
+		{"sendMessage", map[string]string{"chat_id": "-100", "text": "hi", "reply_to_message_id": "7"}, ""},
+		{"sendPhoto", map[string]string{"chat_id": "-100"}, "PNG"},
+		{"sendDocument", map[string]string{"chat_id": "-100", "reply_to_message_id": "8"}, "PNG"},
+	}
+	for _, w := range want {
+		got := <-f.requests
+		if fmt.Sprint(got) != fmt.Sprint(w) {
+			t.Errorf("got %v, want %v", got, w)
+		}
+	}
+	select {
+	case got := <-f.requests:
+		t.Errorf("unexpected request %v", got)
+	default:
+	}
+}
+
+func TestBotAPIFileIDs(t *testing.T) {
+	store, err := media.Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := mediaStore
+	mediaStore = store
+	t.Cleanup(func() {
+		mediaStore = old
+		store.Close()
+	})
+
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+
+	newFile := func(name, data string) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		path, err := store.Add(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	doc, other := newFile("a.txt", "doc"), newFile("b.txt", "other")
+	unstored := filepath.Join(t.TempDir(), "c.txt")
+	if err := ioutil.WriteFile(unstored, []byte("doc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(cmd string) botRequest {
+		t.Helper()
+		if _, err := b.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		return <-f.requests
+	}
+
+	// The first time a content is sent it is uploaded, and then its
+	// file_id is used
+	tests := []struct {
+		cmd          string
+		file, fileID string
+	}{
+		{"send_document user#id5 " + doc, "doc", ""},
+		{"send_document user#id6 " + doc, "", "doc-id"},
+		{"send_file user#id6 " + other, "other", ""},
+		{"send_document user#id6 " + unstored, "doc", ""},
+		{"send_document user#id6 " + unstored, "doc", ""},
+	}
+	for _, tt := range tests {
+		got := send(tt.cmd)
+		if got.file != tt.file || got.params["document"] != tt.fileID {
+			t.Errorf("%q: got %v, want file %q, file_id %q", tt.cmd, got, tt.file, tt.fileID)
+		}
+	}
+
+	// The file_id of a photo is the one of its largest size
+	photo := newFile("d.txt", "photo")
+	send("send_photo user#id5 " + photo)
+	if got := send("send_photo user#id5 " + photo); got.params["photo"] != "photo-id" {
+		t.Errorf("photo: got %v, want file_id photo-id", got)
+	}
+
+	// Rejected file_ids are dropped and the file is uploaded again
+	hash, _ := store.Hash(doc)
+	b.mu.Lock()
+	b.fileIDs[hash] = "stale"
+	b.mu.Unlock()
+	if got := send("send_document user#id5 " + doc); got.params["document"] != "stale" {
+		t.Errorf("got %v, want file_id stale", got)
+	}
+	if got := <-f.requests; got.file != "doc" {
+		t.Errorf("got %v, want the file uploaded again", got)
+	}
+	if got := send("send_document user#id5 " + doc); got.params["document"] != "doc-id" {
+		t.Errorf("got %v, want the new file_id", got)
+	}
+}
+
+func TestBotAPIErrors(t *testing.T) {
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+
+	_, err := b.Write([]byte("msg user#id0 hello\n"))
+	if err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("error: got %v, want chat not found", err)
+	}
+	<-f.requests
+
+	_, err = b.Write([]byte("send_photo user#id5 " + filepath.Join(t.TempDir(), "missing") + "\n"))
+	if !os.IsNotExist(err) {
+		t.Errorf("error: got %v, want not exist", err)
+	}
+
+	// The token is not leaked in the errors
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	_, b = newBotAPIBridge(&botAPIConfig{Token: testBotToken, API: ts.URL}, ts.Client())
+	_, err = b.Write([]byte("msg user#id5 hello\n"))
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("error: got %v, want an error without the token", err)
+	}
+}
+
+func TestBotAPIPartialWrite(t *testing.T) {
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+
+	// The bytes of the commands sent before the failing one are written
+	first := "msg user#id5 a\ndialog_list\n"
+	n, err := b.Write([]byte(first + "msg user#id0 b\nmsg user#id5 c\n"))
+	if err == nil || n != len(first) {
+		t.Errorf("got %v, %v, want %v and an error", n, err, len(first))
+	}
+	for _, want := range []string{"a", "b"} {
+		if got := <-f.requests; got.params["text"] != want {
+			t.Errorf("got %v, want text %v", got, want)
+		}
+	}
+
+	// The last command may not end with a new line
+	if n, err := b.Write([]byte("msg user#id5 d")); err != nil || n != 14 {
+		t.Errorf("got %v, %v, want 14", n, err)
+	}
+	<-f.requests
+}
+
+func TestBotAPIRateLimit(t *testing.T) {
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+
+	// Rejected requests are sent again after retry_after
+	path := filepath.Join(t.TempDir(), "pic.png")
+	if err := ioutil.WriteFile(path, []byte("PNG"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&f.limited, 2)
+	start := time.Now()
+	if _, err := b.Write([]byte("msg user#id5 hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("retried after %v, want 2 retry_after", d)
+	}
+	if got := <-f.requests; got.params["text"] != "hello" {
+		t.Errorf("got %v, want text hello", got)
+	}
+	atomic.StoreInt32(&f.limited, 1)
+	if _, err := b.Write([]byte("send_photo user#id5 " + path + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-f.requests; got.method != "sendPhoto" || got.file != "PNG" {
+		t.Errorf("got %v, want the photo", got)
+	}
+
+	// Up to botMaxRetries times
+	atomic.StoreInt32(&f.limited, botMaxRetries+1)
+	_, err := b.Write([]byte("msg user#id5 hello\n"))
+	if err == nil || !strings.Contains(err.Error(), "Too Many Requests") {
+		t.Errorf("error: got %v, want Too Many Requests", err)
+	}
+}
+
+func TestBotAPIRetry(t *testing.T) {
+	f := newFakeBotAPI(t)
+	_, s := startBotAPITest(t, f, "bad")
+
+	// The bridge does not start with an invalid token, but it keeps
+	// retrying, and it can be closed meanwhile
+	done := make(chan bool, 1)
+	go func() {
+		done <- s.Scan()
+	}()
+	select {
+	case <-done:
+		t.Fatal("started with an invalid token")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&f.denied); n < 2 {
+		t.Errorf("requests: got %v, want retries", n)
+	}
+}
+
+func TestBotAPIClose(t *testing.T) {
+	f := newFakeBotAPI(t)
+	b, s := startBotAPITest(t, f, testBotToken)
+	readLine(t, s)
+	<-f.offsets
+
+	// Close interrupts the long polling
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if s.Scan() {
+		t.Errorf("got line %q after Close", s.Text())
+	}
+}
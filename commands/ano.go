@@ -10,14 +10,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"math/rand"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 
+	"github.com/jroimartin/tgbot/media"
+	"github.com/jroimartin/tgbot/store"
 	"github.com/jroimartin/tgbot/utils"
 )
 
@@ -29,21 +27,25 @@ type cmdAno struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      AnoConfig
+	ns          store.Namespace
 
-	tempDir string
+	media *media.Store
 }
 
 type AnoConfig struct {
 	Enabled bool
+	HTTP    utils.HTTPConfig
 }
 
-func NewCmdAno(w io.Writer, config AnoConfig) Command {
+func NewCmdAno(w io.Writer, config AnoConfig, ns store.Namespace, ms *media.Store) Command {
 	return &cmdAno{
 		syntax:      "!a [tags]",
 		description: "if tags, search ANO by tags (comma-separated). Otherwise return a random pic",
 		re:          regexp.MustCompile(`^!a($| [\w ,]+$)`),
 		w:           w,
 		config:      config,
+		ns:          ns,
+		media:       ms,
 	}
 }
 
@@ -63,15 +65,7 @@ func (cmd *cmdAno) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
-// Shutdown should remove the temp dir on exit.
 func (cmd *cmdAno) Shutdown() error {
-	if cmd.tempDir == "" {
-		return nil
-	}
-	log.Println("Removing ANO pics dir:", cmd.tempDir)
-	if err := os.RemoveAll(cmd.tempDir); err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -81,33 +75,20 @@ func (cmd *cmdAno) Run(title, from, text string) error {
 		err  error
 	)
 
-	if cmd.tempDir == "" {
-		cmd.tempDir, err = ioutil.TempDir("", "tgbot-ano-")
-		if err != nil {
-			fmt.Fprintf(cmd.w, "msg %v error: internal command error\n", title)
-			return err
-		}
-		log.Println("Created ANO pics dir:", cmd.tempDir)
-	}
-
 	tags := strings.TrimSpace(strings.TrimPrefix(text, "!a"))
-	if tags == "" {
-		path, err = cmd.randomPic(title)
-	} else {
-		path, err = cmd.searchTag(title, strings.Split(tags, ","))
-	}
+	path, err = freshMedia(cmd.media, title, func() (string, error) {
+		if tags == "" {
+			return cmd.randomPic(title)
+		}
+		return cmd.searchTag(title, strings.Split(tags, ","))
+	})
 	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get pic\n", title)
-		return err
+		return userError(err, "error: cannot get pic")
 	}
 
-	// Send to tg as photo or document (gif's)
-	fmt.Fprintf(cmd.w, "msg %v What has been seen cannot be unseen...\n", title)
-	tgcmd := "send_photo"
-	if filepath.Ext(path) == ".gif" {
-		tgcmd = "send_document"
-	}
-	fmt.Fprintf(cmd.w, "%v %v %v\n", tgcmd, title, path)
+	// Send to tg as photo or document (animations and other files)
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "What has been seen cannot be unseen..."))
+	fmt.Fprintf(cmd.w, "%v %v %v\n", sendAction(cmd.media, path), title, path)
 	return nil
 }
 
@@ -118,7 +99,10 @@ func (cmd *cmdAno) randomPic(title string) (filePath string, err error) {
 			ID string
 		}
 	}
-	client := &http.Client{}
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
+	}
 
 	// Get random pic ID
 	methodRandom := strings.NewReader(`{ "method" : "random" }`)
@@ -148,7 +132,7 @@ func (cmd *cmdAno) randomPic(title string) (filePath string, err error) {
 	}
 
 	// Download pic
-	filePath, err = utils.Download(cmd.tempDir, "", picsURL+data.Pic.ID)
+	filePath, err = cmd.media.Download(client, "", picsURL+data.Pic.ID)
 	if err != nil {
 		return "", err
 	}
@@ -162,7 +146,10 @@ func (cmd *cmdAno) searchTag(title string, tags []string) (filePath string, err
 			ID string
 		}
 	}
-	client := &http.Client{}
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
+	}
 
 	// Get random pic ID
 	searchStr := fmt.Sprintf("{ \"method\" : \"searchRelated\", \"tags\" : [%v], \"limit\" : 10 }",
@@ -197,11 +184,11 @@ func (cmd *cmdAno) searchTag(title string, tags []string) (filePath string, err
 		return "", errors.New("no pics")
 	}
 
-	rndInt := rand.Intn(len(data.Pics) - 1)
+	rndInt := utils.Intn(len(data.Pics) - 1)
 	rndData := data.Pics[rndInt]
 
 	// Download pic
-	filePath, err = utils.Download(cmd.tempDir, "", picsURL+rndData.ID)
+	filePath, err = cmd.media.Download(client, "", picsURL+rndData.ID)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,108 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/tgbot/audit"
+	"github.com/jroimartin/tgbot/store"
+)
+
+// Number of entries returned by !audit by default and at most.
+const (
+	auditDefaultEntries = 10
+	auditMaxEntries     = 50
+)
+
+type cmdAudit struct {
+	description string
+	syntax      string
+	re          *regexp.Regexp
+	w           io.Writer
+	config      AuditConfig
+	ns          store.Namespace
+
+	alog *audit.Log
+}
+
+type AuditConfig struct {
+	Enabled  bool
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+func NewCmdAudit(w io.Writer, config AuditConfig, ns store.Namespace, alog *audit.Log) Command {
+	return &cmdAudit{
+		syntax:      "!audit [n]",
+		description: fmt.Sprintf("Show the last n (default %v) command invocations", auditDefaultEntries),
+		re:          regexp.MustCompile(`^!audit($| \d+$)`),
+		w:           w,
+		config:      config,
+		ns:          ns,
+		alog:        alog,
+	}
+}
+
+func (cmd *cmdAudit) Enabled() bool {
+	return cmd.config.Enabled && cmd.alog != nil
+}
+
+func (cmd *cmdAudit) Syntax() string {
+	return cmd.syntax
+}
+
+func (cmd *cmdAudit) Description() string {
+	return cmd.description
+}
+
+func (cmd *cmdAudit) Match(text string) bool {
+	return cmd.re.MatchString(text)
+}
+
+func (cmd *cmdAudit) AdminOnly() bool {
+	return true
+}
+
+// Scope keeps the audit log out of the groups.
+func (cmd *cmdAudit) Scope() Scope {
+	return ScopePrivate
+}
+
+func (cmd *cmdAudit) Shutdown() error {
+	return nil
+}
+
+func (cmd *cmdAudit) Run(title, from, text string) error {
+	n := auditDefaultEntries
+	if arg := strings.TrimSpace(strings.TrimPrefix(text, "!audit")); arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return invalidInput("error: invalid number of entries")
+		}
+	}
+	if n > auditMaxEntries {
+		n = auditMaxEntries
+	}
+
+	entries, err := cmd.alog.Last(n)
+	if err != nil {
+		return userError(err, "error: cannot read audit log")
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "The audit log is empty"))
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", title, e)
+	}
+	return nil
+}
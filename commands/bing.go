@@ -8,14 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"math/rand"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 
+	"github.com/jroimartin/tgbot/media"
+	"github.com/jroimartin/tgbot/store"
 	"github.com/jroimartin/tgbot/utils"
 	"github.com/jroimartin/tgbot/utils/bing"
 )
@@ -26,23 +23,27 @@ type cmdBing struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      BingConfig
+	ns          store.Namespace
 
-	tempDir string
+	media *media.Store
 }
 
 type BingConfig struct {
 	Enabled bool
 	Key     string
 	Limit   int
+	HTTP    utils.HTTPConfig
 }
 
-func NewCmdBing(w io.Writer, config BingConfig) Command {
+func NewCmdBing(w io.Writer, config BingConfig, ns store.Namespace, ms *media.Store) Command {
 	return &cmdBing{
 		syntax:      "!sb query",
 		description: "Search Bing images by query",
 		re:          regexp.MustCompile(`^!sb ([\w ]+)$`),
 		w:           w,
 		config:      config,
+		ns:          ns,
+		media:       ms,
 	}
 }
 
@@ -62,50 +63,33 @@ func (cmd *cmdBing) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
-// Shutdown should remove the temp dir on exit.
 func (cmd *cmdBing) Shutdown() error {
-	if cmd.tempDir == "" {
-		return nil
-	}
-	log.Println("Removing Bing pics dir:", cmd.tempDir)
-	if err := os.RemoveAll(cmd.tempDir); err != nil {
-		return err
-	}
 	return nil
 }
 
 func (cmd *cmdBing) Run(title, from, text string) error {
 	var err error
 
-	if cmd.tempDir == "" {
-		cmd.tempDir, err = ioutil.TempDir("", "tgbot-bing-")
-		if err != nil {
-			fmt.Fprintf(cmd.w, "msg %v error: internal command error\n", title)
-			return err
-		}
-		log.Println("Created Bing pics dir:", cmd.tempDir)
-	}
-
 	query := strings.TrimSpace(strings.TrimPrefix(text, "!sb"))
 	query = strings.Replace(query, " ", "+", -1)
-	path, err := cmd.search(query)
+	path, err := cmd.search(title, query)
 	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get pic\n", title)
-		return err
+		return userError(err, "error: cannot get pic")
 	}
 
-	// Send to tg as photo or document (gif's)
-	tgcmd := "send_photo"
-	if filepath.Ext(path) == ".gif" {
-		tgcmd = "send_document"
-	}
-	fmt.Fprintf(cmd.w, "%v %v %v\n", tgcmd, title, path)
+	// Send to tg as photo or document (animations and other files)
+	fmt.Fprintf(cmd.w, "%v %v %v\n", sendAction(cmd.media, path), title, path)
 	return nil
 }
 
-// search returns a pic from Bing after a search using the given query.
-func (cmd *cmdBing) search(query string) (filePath string, err error) {
-	c := bing.NewClient(cmd.config.Key)
+// search returns a pic from Bing after a search using the given query,
+// avoiding the ones sent recently to title.
+func (cmd *cmdBing) search(title, query string) (filePath string, err error) {
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
+	}
+	c := bing.NewClientHTTP(cmd.config.Key, client)
 	if cmd.config.Limit > 0 {
 		c.Limit = cmd.config.Limit
 	}
@@ -117,10 +101,11 @@ func (cmd *cmdBing) search(query string) (filePath string, err error) {
 	if len(results) == 0 {
 		return "", errors.New("no pics")
 	}
-	rndInt := rand.Intn(len(results))
-
 	// Download pic
-	filePath, err = utils.Download(cmd.tempDir, "", results[rndInt].MediaUrl)
+	filePath, err = freshMedia(cmd.media, title, func() (string, error) {
+		rndInt := utils.Intn(len(results))
+		return cmd.media.Download(client, "", results[rndInt].MediaUrl)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -11,6 +11,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/jroimartin/tgbot/store"
 )
 
 type cmdBreakfast struct {
@@ -19,16 +21,17 @@ type cmdBreakfast struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      BreakfastConfig
-
-	// Stored items
-	items map[string][]string
+	ns          store.Namespace
 }
 
+// itemsKey is the key used to store the list of items of each chat.
+const itemsKey = "items"
+
 type BreakfastConfig struct {
 	Enabled bool
 }
 
-func NewCmdBreakfast(w io.Writer, config BreakfastConfig) Command {
+func NewCmdBreakfast(w io.Writer, config BreakfastConfig, ns store.Namespace) Command {
 	return &cmdBreakfast{
 		syntax: "!b[-] [item]",
 		description: "If item, add a item to the list. Otherwise, return the list. " +
@@ -36,7 +39,7 @@ func NewCmdBreakfast(w io.Writer, config BreakfastConfig) Command {
 		re:     regexp.MustCompile(`^!b(($| [^\r\n]+$)|(-$|- \d+$))`),
 		w:      w,
 		config: config,
-		items:  make(map[string][]string),
+		ns:     ns,
 	}
 }
 
@@ -82,24 +85,40 @@ func (cmd *cmdBreakfast) Run(title, from, text string) error {
 			err = cmd.addItem(title, from, bfText)
 		}
 	}
-	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get or add items\n", title)
+	var ue *UserError
+	if errors.As(err, &ue) {
 		return err
 	}
+	if err != nil {
+		return userError(err, "error: cannot get or add items")
+	}
 	return nil
 }
 
 func (cmd *cmdBreakfast) addItem(title, from, text string) error {
 	item := fmt.Sprintf("%v: %v", from, text)
-	cmd.items[title] = append(cmd.items[title], item)
-	fmt.Fprintf(cmd.w, "msg %v New item added: \"%v\"\n", title, item)
+	err := cmd.ns.Chat(title).Update(func(tx *store.Tx) error {
+		var items []string
+		if _, err := tx.Get(itemsKey, &items); err != nil {
+			return err
+		}
+		return tx.Put(itemsKey, append(items, item))
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "New item added: \"%v\"", item))
 	return nil
 }
 
 func (cmd *cmdBreakfast) listItems(title string) error {
-	items, ok := cmd.items[title]
+	var items []string
+	ok, err := cmd.ns.Chat(title).Get(itemsKey, &items)
+	if err != nil {
+		return err
+	}
 	if !ok || len(items) < 1 {
-		return errors.New("no items")
+		return invalidInput("error: the list is empty")
 	}
 
 	for i, item := range items {
@@ -110,27 +129,37 @@ func (cmd *cmdBreakfast) listItems(title string) error {
 }
 
 func (cmd *cmdBreakfast) listReset(title string) error {
-	delete(cmd.items, title)
-	fmt.Fprintf(cmd.w, "msg %v The list has been reset\n", title)
+	if err := cmd.ns.Chat(title).Delete(itemsKey); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "The list has been reset"))
 	return nil
 }
 
 func (cmd *cmdBreakfast) removeItem(title, text string) error {
 	n, err := strconv.Atoi(text)
 	if err != nil {
-		return err
+		return invalidInput("error: no such item %v", text)
 	}
 
-	items, ok := cmd.items[title]
-	if !ok {
-		return errors.New("list not found")
-	}
-	if n < 0 || n > len(items)-1 {
-		return errors.New("n is out of bounds")
+	err = cmd.ns.Chat(title).Update(func(tx *store.Tx) error {
+		var items []string
+		ok, err := tx.Get(itemsKey, &items)
+		if err != nil {
+			return err
+		}
+		if !ok || len(items) < 1 {
+			return invalidInput("error: the list is empty")
+		}
+		if n < 0 || n > len(items)-1 {
+			return invalidInput("error: no such item %v", n)
+		}
+		return tx.Put(itemsKey, append(items[:n], items[n+1:]...))
+	})
+	if err != nil {
+		return err
 	}
-
-	cmd.items[title] = append(items[:n], items[n+1:]...)
-	fmt.Fprintf(cmd.w, "msg %v The item %v has been removed\n", title, n)
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "The item %v has been removed", n))
 
 	return nil
 }
@@ -12,3 +12,75 @@ type Command interface {
 	Run(title, from, text string) error
 	Shutdown() error
 }
+
+// AdminCommand is implemented by the commands that can only be run by
+// the admins listed in the configuration.
+type AdminCommand interface {
+	Command
+	AdminOnly() bool
+}
+
+// Scope is where a command can be run.
+type Scope int
+
+// Supported scopes.
+const (
+	// ScopeAll commands can be run in private chats and in groups.
+	ScopeAll Scope = iota
+	// ScopePrivate commands can only be run in private chats.
+	ScopePrivate
+	// ScopeGroup commands can only be run in groups.
+	ScopeGroup
+)
+
+// Allows returns true if a command with scope s can be run in a private
+// chat, if private is true, or in a group.
+func (s Scope) Allows(private bool) bool {
+	switch s {
+	case ScopePrivate:
+		return private
+	case ScopeGroup:
+		return !private
+	}
+	return true
+}
+
+// ScopedCommand is implemented by the commands that can only be run in
+// private chats or in groups. Commands that do not implement it can be
+// run anywhere.
+type ScopedCommand interface {
+	Command
+	Scope() Scope
+}
+
+// A Message is a text message received by the bot.
+type Message struct {
+	ID string
+
+	// Chat is the chat ID, as the title passed to Command.Run, and
+	// ChatName its name.
+	Chat     string
+	ChatName string
+
+	// From and FromID are the name and ID of the sender.
+	From   string
+	FromID string
+
+	Text string
+
+	// Private is true if the message was sent in a private chat.
+	Private bool
+
+	// ReplyToID is the ID of the message this message replies to, if
+	// any. ReplyTo is that message, if it is known by the bot.
+	ReplyToID string
+	ReplyTo   *Message
+}
+
+// MessageRunner is implemented by the commands that need the whole
+// message, e.g. to read the message it replies to. The dispatcher calls
+// RunMessage instead of Run.
+type MessageRunner interface {
+	Command
+	RunMessage(m Message) error
+}
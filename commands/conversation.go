@@ -0,0 +1,172 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultConversationTimeout is the time a conversation waits for the
+// next message when no timeout is given.
+const DefaultConversationTimeout = 2 * time.Minute
+
+// AbortReason is the reason why a conversation ended before being
+// completed.
+type AbortReason string
+
+// Supported abort reasons.
+const (
+	// AbortCancel is used when the user sends !cancel or when a new
+	// conversation replaces it.
+	AbortCancel AbortReason = "cancel"
+	// AbortTimeout is used when the user does not answer in time.
+	AbortTimeout AbortReason = "timeout"
+)
+
+// A Conversation is a multi-step dialog between a command and a user in a
+// chat. Commands keep their progress in State and Data.
+type Conversation struct {
+	// Chat is the chat ID and User the user ID.
+	Chat string
+	User string
+
+	State string
+	Data  map[string]string
+
+	// Declined is set by the command when the user declines to complete
+	// the conversation (e.g. answering no to a confirmation).
+	Declined bool
+
+	// Timeout is the time to wait for every answer.
+	Timeout time.Duration
+
+	cmd     Conversational
+	expires time.Time
+}
+
+// Conversational is implemented by the commands that ask follow-up
+// questions. Once a conversation is started with Conversations.Start, the
+// messages sent by the user to the chat that do not match any command
+// are passed to Continue, until it returns done or an error.
+type Conversational interface {
+	Command
+	Continue(c *Conversation, m Message) (done bool, err error)
+	Abort(c *Conversation, reason AbortReason)
+}
+
+type convKey struct {
+	chat, user string
+}
+
+// Conversations keeps the active conversations, at most one per chat and
+// user.
+type Conversations struct {
+	mu    sync.Mutex
+	convs map[convKey]*Conversation
+}
+
+// NewConversations returns an empty set of conversations.
+func NewConversations() *Conversations {
+	return &Conversations{convs: make(map[convKey]*Conversation)}
+}
+
+// Start starts a conversation of cmd with user in chat. An active
+// conversation of the same user in the same chat is cancelled. If
+// timeout is zero, DefaultConversationTimeout is used.
+func (cs *Conversations) Start(cmd Conversational, chat, user string, timeout time.Duration) *Conversation {
+	if timeout == 0 {
+		timeout = DefaultConversationTimeout
+	}
+	c := &Conversation{
+		Chat:    chat,
+		User:    user,
+		Data:    make(map[string]string),
+		Timeout: timeout,
+		cmd:     cmd,
+		expires: time.Now().Add(timeout),
+	}
+
+	k := convKey{chat, user}
+	cs.mu.Lock()
+	old := cs.convs[k]
+	cs.convs[k] = c
+	cs.mu.Unlock()
+
+	if old != nil {
+		old.cmd.Abort(old, AbortCancel)
+	}
+	return c
+}
+
+// Get returns the active conversation of user in chat or nil.
+func (cs *Conversations) Get(chat, user string) *Conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.convs[convKey{chat, user}]
+	if !ok || time.Now().After(c.expires) {
+		return nil
+	}
+	return c
+}
+
+// Command returns the command that owns the conversation.
+func (c *Conversation) Command() Conversational {
+	return c.cmd
+}
+
+// Continue passes m to the command that owns c. The conversation ends
+// when the command is done, returns an error or panics. Otherwise, it
+// waits for the next answer.
+func (cs *Conversations) Continue(c *Conversation, m Message) (err error) {
+	done := true
+	defer func() {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		k := convKey{c.Chat, c.User}
+		if cs.convs[k] != c {
+			// Replaced by a new conversation
+			return
+		}
+		if done || err != nil {
+			delete(cs.convs, k)
+		} else {
+			c.expires = time.Now().Add(c.Timeout)
+		}
+	}()
+
+	done, err = c.cmd.Continue(c, m)
+	return err
+}
+
+// Cancel removes the active conversation of user in chat and returns it,
+// or nil if there is none. The caller must abort it.
+func (cs *Conversations) Cancel(chat, user string) *Conversation {
+	k := convKey{chat, user}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.convs[k]
+	delete(cs.convs, k)
+	return c
+}
+
+// Expire removes and returns the conversations that have not been
+// answered in time. The caller must abort them.
+func (cs *Conversations) Expire(now time.Time) []*Conversation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var expired []*Conversation
+	for k, c := range cs.convs {
+		if now.After(c.expires) {
+			expired = append(expired, c)
+			delete(cs.convs, k)
+		}
+	}
+	return expired
+}
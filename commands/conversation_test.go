@@ -0,0 +1,207 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+// testConv is a conversational command that records the answers and the
+// aborts. It is done after the answer "done" and fails after "fail".
+type testConv struct {
+	Command
+	answers []string
+	aborts  []AbortReason
+}
+
+func (cmd *testConv) Continue(c *Conversation, m Message) (done bool, err error) {
+	cmd.answers = append(cmd.answers, m.Text)
+	switch m.Text {
+	case "done":
+		return true, nil
+	case "fail":
+		return false, errors.New("fail")
+	}
+	return false, nil
+}
+
+func (cmd *testConv) Abort(c *Conversation, reason AbortReason) {
+	cmd.aborts = append(cmd.aborts, reason)
+}
+
+func TestConversationRouting(t *testing.T) {
+	cs := NewConversations()
+	cmd := &testConv{}
+	c := cs.Start(cmd, "chat#id1", "user#id11", 0)
+
+	// Only the user that started the conversation in the same chat can
+	// answer
+	tests := []struct {
+		chat, user string
+		want       *Conversation
+	}{
+		{"chat#id1", "user#id11", c},
+		{"chat#id1", "user#id12", nil},
+		{"chat#id2", "user#id11", nil},
+	}
+	for _, tt := range tests {
+		if got := cs.Get(tt.chat, tt.user); got != tt.want {
+			t.Errorf("Get(%v, %v): got %v, want %v", tt.chat, tt.user, got, tt.want)
+		}
+	}
+
+	// The conversation goes on until the command is done
+	for _, text := range []string{"a", "b", "done"} {
+		if cs.Get("chat#id1", "user#id11") != c {
+			t.Fatalf("%q: the conversation has ended", text)
+		}
+		if err := cs.Continue(c, Message{Chat: "chat#id1", FromID: "user#id11", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(cmd.answers, " "); got != "a b done" {
+		t.Errorf("answers: got %q, want %q", got, "a b done")
+	}
+	if cs.Get("chat#id1", "user#id11") != nil {
+		t.Error("the conversation is active after done")
+	}
+
+	// Or until it fails
+	c = cs.Start(cmd, "chat#id1", "user#id11", 0)
+	if err := cs.Continue(c, Message{Text: "fail"}); err == nil {
+		t.Error("got no error")
+	}
+	if cs.Get("chat#id1", "user#id11") != nil {
+		t.Error("the conversation is active after an error")
+	}
+	if len(cmd.aborts) != 0 {
+		t.Errorf("aborts: got %v, want none", cmd.aborts)
+	}
+}
+
+func TestConversationReplaced(t *testing.T) {
+	cs := NewConversations()
+	cmd := &testConv{}
+	old := cs.Start(cmd, "chat#id1", "user#id11", 0)
+	other := cs.Start(cmd, "chat#id1", "user#id12", 0)
+	c := cs.Start(cmd, "chat#id1", "user#id11", 0)
+
+	if len(cmd.aborts) != 1 || cmd.aborts[0] != AbortCancel {
+		t.Errorf("aborts: got %v, want [%v]", cmd.aborts, AbortCancel)
+	}
+	if got := cs.Get("chat#id1", "user#id11"); got != c {
+		t.Errorf("got %v, want the new conversation", got)
+	}
+	if got := cs.Get("chat#id1", "user#id12"); got != other {
+		t.Errorf("the conversation of another user was replaced")
+	}
+
+	// The answers to the old conversation do not end the new one
+	if err := cs.Continue(old, Message{Text: "done"}); err != nil {
+		t.Fatal(err)
+	}
+	if cs.Get("chat#id1", "user#id11") != c {
+		t.Error("the new conversation has ended")
+	}
+}
+
+func TestConversationTimeout(t *testing.T) {
+	cs := NewConversations()
+	cmd := &testConv{}
+	start := time.Now()
+	c := cs.Start(cmd, "chat#id1", "user#id11", 0)
+	short := cs.Start(cmd, "chat#id2", "user#id11", time.Minute)
+
+	if c.Timeout != DefaultConversationTimeout || DefaultConversationTimeout != 2*time.Minute {
+		t.Errorf("timeout: got %v, want 2m", c.Timeout)
+	}
+	if expired := cs.Expire(start.Add(time.Minute + time.Second)); len(expired) != 1 || expired[0] != short {
+		t.Errorf("after 1m: got %v, want the conversation with a 1m timeout", expired)
+	}
+	if expired := cs.Expire(start.Add(time.Minute + time.Second)); len(expired) != 0 {
+		t.Errorf("expired twice: %v", expired)
+	}
+
+	// Every answer restarts the timeout
+	if err := cs.Continue(c, Message{Text: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	answered := time.Now()
+	if expired := cs.Expire(start.Add(DefaultConversationTimeout)); len(expired) != 0 {
+		t.Errorf("expired after an answer: %v", expired)
+	}
+	if expired := cs.Expire(answered.Add(DefaultConversationTimeout + time.Second)); len(expired) != 1 || expired[0] != c {
+		t.Errorf("after 2m: got %v, want the conversation", expired)
+	}
+	if cs.Get("chat#id1", "user#id11") != nil {
+		t.Error("the conversation is active after expiring")
+	}
+	// The caller aborts the expired conversations
+	if len(cmd.aborts) != 0 {
+		t.Errorf("aborts: got %v, want none", cmd.aborts)
+	}
+}
+
+func TestConversationCancel(t *testing.T) {
+	cs := NewConversations()
+	cmd := &testConv{}
+	c := cs.Start(cmd, "chat#id1", "user#id11", 0)
+
+	if got := cs.Cancel("chat#id1", "user#id12"); got != nil {
+		t.Errorf("cancel of another user: got %v", got)
+	}
+	if got := cs.Cancel("chat#id1", "user#id11"); got != c {
+		t.Errorf("got %v, want the conversation", got)
+	}
+	if got := cs.Cancel("chat#id1", "user#id11"); got != nil {
+		t.Errorf("cancelled twice: got %v", got)
+	}
+	if cs.Get("chat#id1", "user#id11") != nil {
+		t.Error("the conversation is active after cancel")
+	}
+}
+
+func TestTweetConfirm(t *testing.T) {
+	var buf bytes.Buffer
+	cs := NewConversations()
+	cmd := NewCmdTweet(&buf, TweetConfig{Enabled: true, Confirm: true}, store.Namespace{}, cs).(*cmdTweet)
+
+	m := Message{Chat: "chat#id1", From: "user1", FromID: "user#id11", Text: "!tw hello"}
+	if err := cmd.RunMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	c := cs.Get("chat#id1", "user#id11")
+	if c == nil || c.Data["text"] != "hello" {
+		t.Fatalf("got conversation %v", c)
+	}
+	for _, text := range []string{"maybe", "no"} {
+		if err := cs.Continue(c, Message{Chat: "chat#id1", FromID: "user#id11", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.Declined {
+		t.Error("the tweet was not declined")
+	}
+	want := "msg chat#id1 user1, confirm tweet? yes/no\n" +
+		"msg chat#id1 Please answer yes or no (or !cancel)\n" +
+		"msg chat#id1 Tweet discarded\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	cmd.Abort(c, AbortTimeout)
+	cmd.Abort(c, AbortCancel)
+	want = "msg chat#id1 Tweet discarded, no answer\nmsg chat#id1 Tweet discarded\n"
+	if got := buf.String(); got != want {
+		t.Errorf("abort: got %q, want %q", got, want)
+	}
+}
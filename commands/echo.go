@@ -9,6 +9,8 @@ import (
 	"io"
 	"regexp"
 	"strings"
+
+	"github.com/jroimartin/tgbot/store"
 )
 
 type cmdEcho struct {
@@ -17,19 +19,21 @@ type cmdEcho struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      EchoConfig
+	ns          store.Namespace
 }
 
 type EchoConfig struct {
 	Enabled bool
 }
 
-func NewCmdEcho(w io.Writer, config EchoConfig) Command {
+func NewCmdEcho(w io.Writer, config EchoConfig, ns store.Namespace) Command {
 	return &cmdEcho{
 		syntax:      "!e message",
 		description: "Echo message",
 		re:          regexp.MustCompile(`^!e .+`),
 		w:           w,
 		config:      config,
+		ns:          ns,
 	}
 }
 
@@ -0,0 +1,65 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import "fmt"
+
+// A UserError is an error returned by a command that can be shown to the
+// user. Msg is the message key, translated and formatted with Args
+// before being sent, and Cause the internal error, which is only logged.
+// If the message depends on a count, Plural is its English plural and N
+// the count. Invalid is set when the error is caused by the input of the
+// user rather than by a failure of the bot.
+//
+// Commands do not report their failures. The dispatcher sends the
+// message of the UserErrors returned by Run, and a generic one for any
+// other error. Only failures get a reference to find them in the log.
+type UserError struct {
+	Msg     string
+	Args    []interface{}
+	Plural  string
+	N       int
+	Cause   error
+	Invalid bool
+}
+
+// userError returns a UserError with the given cause and message.
+func userError(cause error, msg string, args ...interface{}) *UserError {
+	return &UserError{Msg: msg, Args: args, Cause: cause}
+}
+
+// invalidInput returns a UserError that rejects the input of the user
+// with the given message.
+func invalidInput(msg string, args ...interface{}) *UserError {
+	return &UserError{Msg: msg, Args: args, Invalid: true}
+}
+
+// invalidInputN is like invalidInput for a message whose English plural
+// is plural, selected by n.
+func invalidInputN(msg, plural string, n int, args ...interface{}) *UserError {
+	return &UserError{Msg: msg, Args: args, Plural: plural, N: n, Invalid: true}
+}
+
+// Message returns the message of the error translated into the language
+// of chat.
+func (e *UserError) Message(chat string) string {
+	if e.Plural != "" {
+		return trn(chat, e.Msg, e.Plural, e.N, e.Args...)
+	}
+	return tr(chat, e.Msg, e.Args...)
+}
+
+func (e *UserError) Error() string {
+	msg := fmt.Sprintf(e.Msg, e.Args...)
+	if e.Cause == nil {
+		return msg
+	}
+	return msg + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the cause of the error.
+func (e *UserError) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+// EventKind is the type of an Event.
+type EventKind string
+
+// Supported event kinds.
+const (
+	// EventJoin is sent when User joins the chat.
+	EventJoin EventKind = "join"
+	// EventLeave is sent when User leaves the chat.
+	EventLeave EventKind = "leave"
+	// EventRename is sent when the chat is renamed to Text.
+	EventRename EventKind = "rename"
+	// EventUserRename is sent when a user changes its name. Chat and
+	// From are the user itself.
+	EventUserRename EventKind = "user_rename"
+	// EventMedia is sent when a message with media is received. Media is
+	// the type of media (photo, document, sticker, voice, ...) and Text
+	// its caption.
+	EventMedia EventKind = "media"
+)
+
+// An Event is something that happened in a chat, other than a text
+// message.
+type Event struct {
+	Kind EventKind
+
+	// Chat is the chat ID, as the title passed to Command.Run, and
+	// ChatName its name.
+	Chat     string
+	ChatName string
+
+	// From and FromID are the name and ID of the user who triggered
+	// the event.
+	From   string
+	FromID string
+
+	// User and UserID are the name and ID of the user who joined or
+	// left the chat.
+	User   string
+	UserID string
+
+	Media string
+	Text  string
+}
+
+// EventHandler is implemented by the commands that want to be notified
+// of events.
+type EventHandler interface {
+	Command
+	HandleEvent(ev Event) error
+}
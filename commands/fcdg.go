@@ -9,11 +9,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
 	"regexp"
 
+	"github.com/jroimartin/tgbot/media"
+	"github.com/jroimartin/tgbot/store"
 	"github.com/jroimartin/tgbot/utils"
 )
 
@@ -27,21 +27,25 @@ type cmdFcdg struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      FcdgConfig
+	ns          store.Namespace
 
-	tempDir string
+	media *media.Store
 }
 
 type FcdgConfig struct {
 	Enabled bool
+	HTTP    utils.HTTPConfig
 }
 
-func NewCmdFcdg(w io.Writer, config FcdgConfig) Command {
+func NewCmdFcdg(w io.Writer, config FcdgConfig, ns store.Namespace, ms *media.Store) Command {
 	return &cmdFcdg{
 		syntax:      "!4",
 		description: "return a random card from the 4cdg",
 		re:          regexp.MustCompile(`^!4$`),
 		w:           w,
 		config:      config,
+		ns:          ns,
+		media:       ms,
 	}
 }
 
@@ -61,43 +65,29 @@ func (cmd *cmdFcdg) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
-// Shutdown should remove the temp dir on exit.
 func (cmd *cmdFcdg) Shutdown() error {
-	if cmd.tempDir == "" {
-		return nil
-	}
-	log.Println("Removing 4cdg pics dir:", cmd.tempDir)
-	if err := os.RemoveAll(cmd.tempDir); err != nil {
-		return err
-	}
 	return nil
 }
 
 func (cmd *cmdFcdg) Run(title, from, text string) error {
-	if cmd.tempDir == "" {
-		var err error
-		cmd.tempDir, err = ioutil.TempDir("", "tgbot-4cdg-")
-		if err != nil {
-			fmt.Fprintf(cmd.w, "msg %v error: internal command error\n", title)
-			return err
-		}
-		log.Println("Created 4cdg pics dir:", cmd.tempDir)
-	}
-
-	path, err := cmd.randomCard()
+	path, err := freshMedia(cmd.media, title, cmd.randomCard)
 	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get pic\n", title)
-		return err
+		return userError(err, "error: cannot get pic")
 	}
 
-	fmt.Fprintf(cmd.w, "send_photo %v %v\n", title, path)
+	fmt.Fprintf(cmd.w, "%v %v %v\n", sendAction(cmd.media, path), title, path)
 	return nil
 }
 
 // getCard returns a random card from the 4cdg
 func (cmd *cmdFcdg) randomCard() (filePath string, err error) {
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
+	}
+
 	// Get random pic ID
-	resp, err := http.Get(fcdgUrl + "?card")
+	resp, err := client.Get(fcdgUrl + "?card")
 	if err != nil {
 		return "", err
 	}
@@ -118,7 +108,7 @@ func (cmd *cmdFcdg) randomCard() (filePath string, err error) {
 	}
 
 	// Download pic
-	filePath, err = utils.Download(cmd.tempDir, "", fcdgUrl+matches[1])
+	filePath, err = cmd.media.Download(client, "", fcdgUrl+matches[1])
 	if err != nil {
 		return "", err
 	}
@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"regexp"
 	"strings"
+
+	"github.com/jroimartin/tgbot/store"
+	"github.com/jroimartin/tgbot/utils"
 )
 
 type cmdHater struct {
@@ -19,6 +21,7 @@ type cmdHater struct {
 	syntax      string
 	w           io.Writer
 	config      HaterConfig
+	ns          store.Namespace
 }
 
 type HaterConfig struct {
@@ -31,12 +34,13 @@ type haterTopic struct {
 	DB     string
 }
 
-func NewCmdHater(w io.Writer, config HaterConfig) Command {
+func NewCmdHater(w io.Writer, config HaterConfig, ns store.Namespace) Command {
 	return &cmdHater{
 		syntax:      "",
 		description: "Topic hater",
 		w:           w,
 		config:      config,
+		ns:          ns,
 	}
 }
 
@@ -88,7 +92,7 @@ func (cmd *cmdHater) Run(title, from, text string) error {
 	if len(lines) <= 1 {
 		return errors.New("empty file")
 	}
-	rndInt := rand.Intn(len(lines) - 1)
+	rndInt := utils.Intn(len(lines) - 1)
 	rndLine := lines[rndInt]
 	fmt.Fprintf(cmd.w, "msg %v %v\n", title, rndLine)
 	return nil
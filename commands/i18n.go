@@ -0,0 +1,85 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import "github.com/jroimartin/tgbot/i18n"
+
+// Translations of the messages sent by the commands. Until SetI18n is
+// called, messages are sent in English.
+var (
+	catalog = i18n.NewCatalog()
+	locales *i18n.Locales
+)
+
+// Templates overriding the messages and variables of the command being
+// run.
+var (
+	templates  *i18n.Templates
+	invocation i18n.TemplateData
+)
+
+// SetI18n sets the catalog and the per-chat languages used to translate
+// the messages sent by the commands.
+func SetI18n(c *i18n.Catalog, l *i18n.Locales) {
+	catalog, locales = c, l
+}
+
+// SetTemplates sets the templates that override the messages sent by the
+// commands.
+func SetTemplates(t *i18n.Templates) {
+	templates = t
+}
+
+// SetInvocation sets the variables available to the templates while a
+// command runs. The dispatcher calls it before running every command and
+// resets it afterwards.
+func SetInvocation(d i18n.TemplateData) {
+	invocation = d
+}
+
+// chatLang returns the language of chat.
+func chatLang(chat string) string {
+	if locales == nil {
+		return i18n.DefaultLang
+	}
+	return locales.Get(chat)
+}
+
+// chatLangSet returns the language set for chat, if any.
+func chatLangSet(chat string) (string, bool) {
+	if locales == nil {
+		return "", false
+	}
+	return locales.Lookup(chat)
+}
+
+// Translate translates the message key into the language of chat. If
+// there is a template for key, it is used instead.
+func Translate(chat, key string, args ...interface{}) string {
+	return render(key, catalog.T(chatLang(chat), key, args...), args)
+}
+
+// tr is a shorthand for Translate.
+func tr(chat, key string, args ...interface{}) string {
+	return Translate(chat, key, args...)
+}
+
+// trn translates the message key, whose English plural is plural, into
+// the language of chat.
+func trn(chat, key, plural string, n int, args ...interface{}) string {
+	return render(key, catalog.N(chatLang(chat), key, plural, n, args...), args)
+}
+
+// render executes the template of key, if any. text is the translated
+// message and args its values.
+func render(key, text string, args []interface{}) string {
+	d := invocation
+	d.Text = text
+	d.Values = args
+	if s, ok := templates.Execute(key, d); ok {
+		return s
+	}
+	return text
+}
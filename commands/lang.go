@@ -0,0 +1,80 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+type cmdLang struct {
+	description string
+	syntax      string
+	re          *regexp.Regexp
+	w           io.Writer
+	config      LangConfig
+	ns          store.Namespace
+}
+
+type LangConfig struct {
+	Enabled bool
+}
+
+func NewCmdLang(w io.Writer, config LangConfig, ns store.Namespace) Command {
+	return &cmdLang{
+		syntax:      "!lang [code]",
+		description: "If code, set the language of the chat. Otherwise, show the current language and the available ones",
+		re:          regexp.MustCompile(`^!lang($| [a-zA-Z_-]+$)`),
+		w:           w,
+		config:      config,
+		ns:          ns,
+	}
+}
+
+func (cmd *cmdLang) Enabled() bool {
+	return cmd.config.Enabled
+}
+
+func (cmd *cmdLang) Syntax() string {
+	return cmd.syntax
+}
+
+func (cmd *cmdLang) Description() string {
+	return cmd.description
+}
+
+func (cmd *cmdLang) Match(text string) bool {
+	return cmd.re.MatchString(text)
+}
+
+func (cmd *cmdLang) Run(title, from, text string) error {
+	lang := strings.TrimSpace(strings.TrimPrefix(text, "!lang"))
+	if lang == "" {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "Language: %v (available: %v)",
+			chatLang(title), strings.Join(catalog.Langs(), ", ")))
+		return nil
+	}
+
+	if !catalog.HasLang(lang) {
+		return invalidInput("error: unknown language %v", lang)
+	}
+	if locales == nil {
+		return userError(errors.New("locales not set"), "error: cannot set language")
+	}
+	if err := locales.Set(title, lang); err != nil {
+		return userError(err, "error: cannot set language")
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "Language set to %v", lang))
+	return nil
+}
+
+func (cmd *cmdLang) Shutdown() error {
+	return nil
+}
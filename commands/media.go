@@ -0,0 +1,36 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import "github.com/jroimartin/tgbot/media"
+
+// maxMediaTries is the number of times the commands that send random media
+// try to get a file that has not been sent recently to the chat.
+const maxMediaTries = 3
+
+// freshMedia calls get until it returns a file that has not been sent
+// recently to chat, at most maxMediaTries times. If all of them have been
+// sent, the last one is returned.
+func freshMedia(ms *media.Store, chat string, get func() (string, error)) (path string, err error) {
+	for i := 0; i < maxMediaTries; i++ {
+		if path, err = get(); err != nil {
+			return "", err
+		}
+		if !ms.Recent(chat, path) {
+			break
+		}
+	}
+	return path, nil
+}
+
+// sendAction returns the tg client command that sends the file in path
+// stored in ms. Animations are sent as documents, which Telegram shows as
+// animations.
+func sendAction(ms *media.Store, path string) string {
+	if ms.Kind(path) == media.Photo {
+		return "send_photo"
+	}
+	return "send_document"
+}
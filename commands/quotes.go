@@ -5,15 +5,16 @@
 package commands
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"regexp"
 	"strings"
+
+	"github.com/jroimartin/tgbot/store"
+	"github.com/jroimartin/tgbot/utils"
 )
 
 type cmdQuotes struct {
@@ -22,6 +23,7 @@ type cmdQuotes struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      QuotesConfig
+	ns          store.Namespace
 }
 
 type QuotesConfig struct {
@@ -29,15 +31,17 @@ type QuotesConfig struct {
 	Endpoint string
 	User     string
 	Password string
+	HTTP     utils.HTTPConfig
 }
 
-func NewCmdQuotes(w io.Writer, config QuotesConfig) Command {
+func NewCmdQuotes(w io.Writer, config QuotesConfig, ns store.Namespace) Command {
 	return &cmdQuotes{
 		syntax:      "!q(/) [search|addquote]",
-		description: "Return a random quote. If search is defined, a random quote matching with the search pattern will be returned. If addquote is defined, a new quote will be added",
+		description: "Return a random quote. If search is defined, a random quote matching with the search pattern will be returned. If addquote is defined, a new quote will be added. Replying to a message with !q adds that message as a quote",
 		re:          regexp.MustCompile(`^!q/?($| .+$)`),
 		w:           w,
 		config:      config,
+		ns:          ns,
 	}
 }
 
@@ -57,6 +61,25 @@ func (cmd *cmdQuotes) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
+// RunMessage adds the replied message as a quote when "!q" is sent as a
+// reply. Otherwise, it behaves as Run.
+func (cmd *cmdQuotes) RunMessage(m Message) error {
+	if strings.TrimSpace(m.Text) != "!q" || m.ReplyToID == "" {
+		return cmd.Run(m.Chat, m.From, m.Text)
+	}
+	if m.ReplyTo == nil {
+		return invalidInput("error: unknown message, cannot add quote")
+	}
+
+	quote := fmt.Sprintf("%v: %v", m.ReplyTo.From, m.ReplyTo.Text)
+	msg, err := cmd.addQuote(m.Chat, quote)
+	if err != nil {
+		return userError(err, "error: cannot get or send quote")
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", m.Chat, msg)
+	return nil
+}
+
 func (cmd *cmdQuotes) Run(title, from, text string) error {
 	var (
 		msg string
@@ -80,8 +103,7 @@ func (cmd *cmdQuotes) Run(title, from, text string) error {
 	}
 
 	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get or send quote\n", title)
-		return err
+		return userError(err, "error: cannot get or send quote")
 	}
 
 	fmt.Fprintf(cmd.w, "msg %v %v\n", title, msg)
@@ -98,10 +120,10 @@ func (cmd *cmdQuotes) randomQuote(title string) (msg string, err error) {
 		return "", err
 	}
 	req.SetBasicAuth(cmd.config.User, cmd.config.Password)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
 	}
-	client := &http.Client{Transport: tr}
 	res, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -121,10 +143,10 @@ func (cmd *cmdQuotes) randomQuote(title string) (msg string, err error) {
 		return "", errors.New("no quotes")
 	}
 
-	rndInt := rand.Intn(len(lines) - 1)
+	rndInt := utils.Intn(len(lines) - 1)
 	rndQuote := lines[rndInt]
 
-	return fmt.Sprintf("Random quote: %v", rndQuote), nil
+	return tr(title, "Random quote: %v", rndQuote), nil
 }
 
 func (cmd *cmdQuotes) searchQuote(title string, text string) (msg string, err error) {
@@ -133,10 +155,10 @@ func (cmd *cmdQuotes) searchQuote(title string, text string) (msg string, err er
 		return "", err
 	}
 	req.SetBasicAuth(cmd.config.User, cmd.config.Password)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
 	}
-	client := &http.Client{Transport: tr}
 	res, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -167,10 +189,10 @@ func (cmd *cmdQuotes) searchQuote(title string, text string) (msg string, err er
 
 	rndInt := 0
 	if len(linesFiltered) > 1 {
-		rndInt = rand.Intn(len(linesFiltered) - 1)
+		rndInt = utils.Intn(len(linesFiltered) - 1)
 	}
 	rndQuote := linesFiltered[rndInt]
-	return fmt.Sprintf("Searched quote: %v", rndQuote), nil
+	return tr(title, "Searched quote: %v", rndQuote), nil
 }
 
 func (cmd *cmdQuotes) addQuote(title string, text string) (msg string, err error) {
@@ -180,10 +202,10 @@ func (cmd *cmdQuotes) addQuote(title string, text string) (msg string, err error
 		return "", err
 	}
 	req.SetBasicAuth(cmd.config.User, cmd.config.Password)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return "", err
 	}
-	client := &http.Client{Transport: tr}
 	res, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -194,5 +216,5 @@ func (cmd *cmdQuotes) addQuote(title string, text string) (msg string, err error
 		return "", fmt.Errorf("cannot add quote (%v - %v: %v)", res.StatusCode, title, text)
 	}
 
-	return fmt.Sprintf("New quote added: %v", text), nil
+	return tr(title, "New quote added: %v", text), nil
 }
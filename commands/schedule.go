@@ -0,0 +1,192 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/scheduler"
+	"github.com/jroimartin/tgbot/store"
+)
+
+// schedTimeLayout is the layout used by "!sched at".
+const schedTimeLayout = "2006-01-02T15:04"
+
+type cmdSchedule struct {
+	description string
+	syntax      string
+	re          *regexp.Regexp
+	w           io.Writer
+	config      ScheduleConfig
+	ns          store.Namespace
+
+	sched *scheduler.Scheduler
+}
+
+type ScheduleConfig struct {
+	Enabled bool
+	Job     []scheduler.Job
+}
+
+func NewCmdSchedule(w io.Writer, config ScheduleConfig, ns store.Namespace, sched *scheduler.Scheduler) Command {
+	return &cmdSchedule{
+		syntax: "!sched [cron|in|at|rm] ...",
+		description: "If no args, list jobs. " +
+			"!sched cron m h dom mon dow text: run text periodically. " +
+			"!sched in 1h30m text, !sched at " + schedTimeLayout + " text: run text once. " +
+			"!sched rm id: remove job.",
+		re:     regexp.MustCompile(`^!sched($| (cron|in|at|rm) .+$)`),
+		w:      w,
+		config: config,
+		ns:     ns,
+		sched:  sched,
+	}
+}
+
+func (cmd *cmdSchedule) Enabled() bool {
+	return cmd.config.Enabled
+}
+
+func (cmd *cmdSchedule) Syntax() string {
+	return cmd.syntax
+}
+
+func (cmd *cmdSchedule) Description() string {
+	return cmd.description
+}
+
+func (cmd *cmdSchedule) Match(text string) bool {
+	return cmd.re.MatchString(text)
+}
+
+func (cmd *cmdSchedule) AdminOnly() bool {
+	return true
+}
+
+func (cmd *cmdSchedule) Shutdown() error {
+	return nil
+}
+
+func (cmd *cmdSchedule) Run(title, from, text string) error {
+	args := strings.Fields(strings.TrimPrefix(text, "!sched"))
+	if len(args) == 0 {
+		cmd.listJobs(title)
+		return nil
+	}
+
+	if len(args) < 2 {
+		return invalidInput("error: usage: %v", cmd.syntax)
+	}
+
+	var err error
+	switch args[0] {
+	case "cron":
+		err = cmd.addCron(title, args[1:])
+	case "in", "at":
+		err = cmd.addOnce(title, args[0], args[1:])
+	case "rm":
+		err = cmd.removeJob(title, args[1])
+	}
+	var ue *UserError
+	if errors.As(err, &ue) {
+		return err
+	}
+	if err != nil {
+		return userError(err, "error: cannot schedule job")
+	}
+	return nil
+}
+
+func (cmd *cmdSchedule) listJobs(title string) {
+	jobs := cmd.sched.Jobs()
+	if len(jobs) == 0 {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "There are no scheduled jobs"))
+		return
+	}
+	for _, j := range jobs {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "%v (next: %v)", j,
+			j.Next().Format(schedTimeLayout)))
+	}
+}
+
+// addCron adds a recurring job. args are the cron expression (five
+// fields or a macro) followed by the text.
+func (cmd *cmdSchedule) addCron(title string, args []string) error {
+	n := 5
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		n = 1
+	}
+	if len(args) <= n {
+		return invalidInput("error: usage: %v", cmd.syntax)
+	}
+	j := scheduler.Job{
+		Chat: title,
+		Cron: strings.Join(args[:n], " "),
+		Text: strings.Join(args[n:], " "),
+	}
+	c, err := scheduler.ParseCron(j.Cron)
+	if err != nil || c.Next(time.Now()).IsZero() {
+		return invalidInput("error: invalid cron expression %v", j.Cron)
+	}
+	return cmd.addJob(title, j)
+}
+
+// addOnce adds a one-shot job. args are the duration ("in") or the
+// time ("at") followed by the text.
+func (cmd *cmdSchedule) addOnce(title, kind string, args []string) error {
+	if len(args) < 2 {
+		return invalidInput("error: usage: %v", cmd.syntax)
+	}
+	j := scheduler.Job{
+		Chat: title,
+		Text: strings.Join(args[1:], " "),
+	}
+	if kind == "in" {
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return invalidInput("error: invalid duration %v", args[0])
+		}
+		j.At = time.Now().Add(d)
+	} else {
+		t, err := time.ParseInLocation(schedTimeLayout, args[0], time.Local)
+		if err != nil {
+			return invalidInput("error: invalid time %v (format: %v)", args[0], schedTimeLayout)
+		}
+		j.At = t
+	}
+	if !j.At.After(time.Now()) {
+		return invalidInput("error: the time is in the past")
+	}
+	return cmd.addJob(title, j)
+}
+
+func (cmd *cmdSchedule) removeJob(title, id string) error {
+	switch err := cmd.sched.Remove(id); err {
+	case nil:
+	case scheduler.ErrNotFound:
+		return invalidInput("error: no such job %v", id)
+	case scheduler.ErrStatic:
+		return invalidInput("error: job %v is defined in the config", id)
+	default:
+		return err
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "Job %v removed", id))
+	return nil
+}
+
+func (cmd *cmdSchedule) addJob(title string, j scheduler.Job) error {
+	j, err := cmd.sched.Add(j)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "New job added: %v (next: %v)", j,
+		j.Next().Format(schedTimeLayout)))
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/tgbot/scheduler"
+	"github.com/jroimartin/tgbot/store"
+)
+
+// newTestSchedule returns a !sched command whose jobs are stored in the
+// database in dir, the buffer where it writes and the database.
+func newTestSchedule(t *testing.T, dir string) (Command, *bytes.Buffer, *store.DB) {
+	t.Helper()
+	db, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sched := scheduler.New(db.Namespace("scheduler"), nil)
+	if err := sched.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cmd := NewCmdSchedule(&buf, ScheduleConfig{Enabled: true}, db.Namespace("sched"), sched)
+	return cmd, &buf, db
+}
+
+func TestScheduleInvalidInput(t *testing.T) {
+	cmd, buf, _ := newTestSchedule(t, t.TempDir())
+
+	tests := []struct {
+		text, want string
+	}{
+		{"!sched rm  ", "error: usage: %v"},
+		{"!sched cron  ", "error: usage: %v"},
+		{"!sched rm 7", "error: no such job %v"},
+		{"!sched cron 0 9 * *", "error: usage: %v"},
+		{"!sched cron 0 9 * * 8 hi", "error: invalid cron expression %v"},
+		{"!sched cron @every hi", "error: invalid cron expression %v"},
+		{"!sched cron 0 0 30 2 * hi", "error: invalid cron expression %v"},
+		{"!sched in 5x hi", "error: invalid duration %v"},
+		{"!sched in -1h hi", "error: the time is in the past"},
+		{"!sched at tomorrow hi", "error: invalid time %v (format: %v)"},
+		{"!sched at 2001-01-01T10:00 hi", "error: the time is in the past"},
+	}
+	for _, tt := range tests {
+		if !cmd.Match(tt.text) {
+			t.Errorf("%q does not match", tt.text)
+			continue
+		}
+		err := cmd.Run("chat#id1", "admin", tt.text)
+		var ue *UserError
+		if !errors.As(err, &ue) || !ue.Invalid || ue.Msg != tt.want {
+			t.Errorf("%q: got %#v, want invalid input %q", tt.text, err, tt.want)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected output %q", buf)
+	}
+}
+
+func TestSchedulePersistence(t *testing.T) {
+	dir := t.TempDir()
+	cmd, buf, db := newTestSchedule(t, dir)
+	for _, text := range []string{
+		"!sched cron @weekly weekly text",
+		"!sched in 2h once",
+		"!sched cron 0 9 * * 1-5 weekdays",
+		"!sched rm 2",
+	} {
+		if err := cmd.Run("chat#id1", "admin", text); err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+	}
+	if out := buf.String(); strings.Count(out, "New job added") != 3 || !strings.Contains(out, "Job 2 removed") {
+		t.Errorf("got output %q", out)
+	}
+
+	// The jobs are listed after a restart
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cmd, buf, _ = newTestSchedule(t, t.TempDir())
+	cmd.Run("chat#id1", "admin", "!sched")
+	if !strings.Contains(buf.String(), "There are no scheduled jobs") {
+		t.Errorf("empty scheduler: got %q", buf)
+	}
+	cmd, buf, _ = newTestSchedule(t, dir)
+	cmd.Run("chat#id1", "admin", "!sched")
+	out := buf.String()
+	if !strings.Contains(out, `[1] cron "@weekly" in chat#id1: weekly text`) ||
+		!strings.Contains(out, `[3] cron "0 9 * * 1-5" in chat#id1: weekdays`) ||
+		strings.Contains(out, "once") {
+		t.Errorf("after restart: got %q", out)
+	}
+}
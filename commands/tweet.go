@@ -5,13 +5,14 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strings"
 
 	"github.com/ChimeraCoder/anaconda"
+	"github.com/jroimartin/tgbot/store"
+	"github.com/jroimartin/tgbot/utils"
 )
 
 type cmdTweet struct {
@@ -20,6 +21,9 @@ type cmdTweet struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      TweetConfig
+	ns          store.Namespace
+
+	convs *Conversations
 }
 
 type TweetConfig struct {
@@ -28,15 +32,26 @@ type TweetConfig struct {
 	ConsumerSecret    string
 	AccessToken       string
 	AccessTokenSecret string
+
+	// Confirm makes the command ask for confirmation before tweeting.
+	Confirm bool
+
+	HTTP utils.HTTPConfig
 }
 
-func NewCmdTweet(w io.Writer, config TweetConfig) Command {
+// tweetConfirmState is the state of the conversations waiting for the
+// confirmation of a tweet.
+const tweetConfirmState = "confirm"
+
+func NewCmdTweet(w io.Writer, config TweetConfig, ns store.Namespace, convs *Conversations) Command {
 	return &cmdTweet{
 		syntax:      "!tw tweet",
 		description: "Tweet a message",
 		re:          regexp.MustCompile(`^!tw .+`),
 		w:           w,
 		config:      config,
+		ns:          ns,
+		convs:       convs,
 	}
 }
 
@@ -56,23 +71,79 @@ func (cmd *cmdTweet) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
+// RunMessage asks the sender for confirmation if Confirm is enabled.
+// Otherwise, it behaves as Run.
+func (cmd *cmdTweet) RunMessage(m Message) error {
+	if !cmd.config.Confirm {
+		return cmd.Run(m.Chat, m.From, m.Text)
+	}
+
+	tweetText := strings.TrimSpace(strings.TrimPrefix(m.Text, "!tw"))
+	if err := checkLen(tweetText); err != nil {
+		return err
+	}
+
+	c := cmd.convs.Start(cmd, m.Chat, m.FromID, 0)
+	c.State = tweetConfirmState
+	c.Data["text"] = tweetText
+	fmt.Fprintf(cmd.w, "msg %v %v\n", m.Chat, tr(m.Chat, "%v, confirm tweet? yes/no", m.From))
+	return nil
+}
+
 func (cmd *cmdTweet) Run(title, from, text string) error {
 	tweetText := strings.TrimSpace(strings.TrimPrefix(text, "!tw"))
+	if err := checkLen(tweetText); err != nil {
+		return err
+	}
+	return cmd.post(title, tweetText)
+}
 
+// Continue handles the answer to the confirmation.
+func (cmd *cmdTweet) Continue(c *Conversation, m Message) (done bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(m.Text)) {
+	case "yes", "y":
+		return true, cmd.post(c.Chat, c.Data["text"])
+	case "no", "n":
+		c.Declined = true
+		fmt.Fprintf(cmd.w, "msg %v %v\n", c.Chat, tr(c.Chat, "Tweet discarded"))
+		return true, nil
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", c.Chat, tr(c.Chat, "Please answer yes or no (or !cancel)"))
+	return false, nil
+}
+
+// Abort discards the tweet waiting for confirmation.
+func (cmd *cmdTweet) Abort(c *Conversation, reason AbortReason) {
+	if reason == AbortTimeout {
+		fmt.Fprintf(cmd.w, "msg %v %v\n", c.Chat, tr(c.Chat, "Tweet discarded, no answer"))
+		return
+	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", c.Chat, tr(c.Chat, "Tweet discarded"))
+}
+
+// checkLen rejects the tweets that are too long.
+func checkLen(tweetText string) error {
+	if tweetLen := len(tweetText); tweetLen > 140 {
+		return invalidInputN("%v char? Mmm too much for me, size actually matters",
+			"%v chars? Mmm too much for me, size actually matters", tweetLen, tweetLen)
+	}
+	return nil
+}
+
+func (cmd *cmdTweet) post(title, tweetText string) error {
 	anaconda.SetConsumerKey(cmd.config.ConsumerKey)
 	anaconda.SetConsumerSecret(cmd.config.ConsumerSecret)
 	api := anaconda.NewTwitterApi(cmd.config.AccessToken, cmd.config.AccessTokenSecret)
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return userError(err, "Useless humans...something went wrong")
+	}
+	api.HttpClient = client
 
-	if tweetLen := len(tweetText); tweetLen > 140 {
-		fmt.Fprintf(cmd.w, "msg %v %v chars? Mmm too much for me, size actually matters\n", title, tweetLen)
-		return errors.New("invalid message length")
-	} else {
-		if _, err := api.PostTweet(tweetText, nil); err != nil {
-			fmt.Fprintf(cmd.w, "msg %v Useless humans...something went wrong\n", title)
-			return err
-		}
-		fmt.Fprintf(cmd.w, "msg %v Congrats you did it, new boring tweet posted\n", title)
+	if _, err := api.PostTweet(tweetText, nil); err != nil {
+		return userError(err, "Useless humans...something went wrong")
 	}
+	fmt.Fprintf(cmd.w, "msg %v %v\n", title, tr(title, "Congrats you did it, new boring tweet posted"))
 	return nil
 }
 
@@ -0,0 +1,41 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+func TestTweetTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	cmd := NewCmdTweet(&buf, TweetConfig{Enabled: true, Confirm: true}, store.Namespace{}, nil).(*cmdTweet)
+
+	if err := checkLen(strings.Repeat("x", 140)); err != nil {
+		t.Errorf("140 chars: got %v", err)
+	}
+
+	text := "!tw " + strings.Repeat("x", 141)
+	for _, err := range []error{
+		cmd.Run("chat#id1", "user", text),
+		cmd.RunMessage(Message{Chat: "chat#id1", From: "user", FromID: "user#id1", Text: text}),
+	} {
+		var ue *UserError
+		if !errors.As(err, &ue) || !ue.Invalid {
+			t.Fatalf("got %v, want invalid input", err)
+		}
+		want := "141 chars? Mmm too much for me, size actually matters"
+		if got := ue.Message("chat#id1"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected output %q", buf)
+	}
+}
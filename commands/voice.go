@@ -7,12 +7,11 @@ package commands
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/url"
-	"os"
 	"regexp"
 
+	"github.com/jroimartin/tgbot/media"
+	"github.com/jroimartin/tgbot/store"
 	"github.com/jroimartin/tgbot/utils"
 )
 
@@ -22,21 +21,25 @@ type cmdVoice struct {
 	re          *regexp.Regexp
 	w           io.Writer
 	config      VoiceConfig
+	ns          store.Namespace
 
-	tempDir string
+	media *media.Store
 }
 
 type VoiceConfig struct {
 	Enabled bool
+	HTTP    utils.HTTPConfig
 }
 
-func NewCmdVoice(w io.Writer, config VoiceConfig) Command {
+func NewCmdVoice(w io.Writer, config VoiceConfig, ns store.Namespace, ms *media.Store) Command {
 	return &cmdVoice{
 		syntax:      "!v[en|es|fr|ja] message",
 		description: "text to speech generator courtesy of google translate",
 		re:          regexp.MustCompile(`^!v(es|en|fr|ja)? (.+$)`),
 		w:           w,
 		config:      config,
+		ns:          ns,
+		media:       ms,
 	}
 }
 
@@ -56,15 +59,7 @@ func (cmd *cmdVoice) Match(text string) bool {
 	return cmd.re.MatchString(text)
 }
 
-// Shutdown should remove the temp dir on exit.
 func (cmd *cmdVoice) Shutdown() error {
-	if cmd.tempDir == "" {
-		return nil
-	}
-	log.Println("Removing VOICE sounds dir:", cmd.tempDir)
-	if err := os.RemoveAll(cmd.tempDir); err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -74,26 +69,25 @@ func (cmd *cmdVoice) Run(title, from, text string) error {
 		err  error
 	)
 
-	if cmd.tempDir == "" {
-		cmd.tempDir, err = ioutil.TempDir("", "tgbot-voice-")
-		if err != nil {
-			fmt.Fprintf(cmd.w, "msg %v error: internal command error\n", title)
-			return err
-		}
-		log.Println("Created VOICE sounds dir:", cmd.tempDir)
-	}
-
 	// Get language and text
 	matches := cmd.re.FindStringSubmatch(text)
 	lang := matches[1]
 	msg := matches[2]
 
+	// Use the language of the chat by default
+	if lang == "" {
+		lang, _ = chatLangSet(title)
+	}
+
 	// Download sound
-	path, err = utils.Download(cmd.tempDir, ".mp3", setResourceUrl(lang, msg))
+	client, err := utils.NewClient(cmd.config.HTTP)
+	if err != nil {
+		return userError(err, "error: cannot get sound")
+	}
+	path, err = cmd.media.Download(client, ".mp3", setResourceUrl(lang, msg))
 
 	if err != nil {
-		fmt.Fprintf(cmd.w, "msg %v error: cannot get sound\n", title)
-		return err
+		return userError(err, "error: cannot get sound")
 	}
 
 	// Send to tg as audio
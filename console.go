@@ -0,0 +1,128 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// consoleHelp is shown when the console starts and when an input line
+// cannot be parsed.
+const consoleHelp = "Enter messages as: chat user text"
+
+// serveConsole runs the bot reading messages from the terminal instead
+// of the tg client. Each input line has the format "chat user text" and
+// the commands sent by the bot are pretty-printed to stdout. Names are
+// also used as peer IDs.
+func serveConsole() error {
+	// Only the default account is served
+	accounts = accounts[:1]
+	acct := accounts[0]
+	acct.out = newOutQueue(mediaReleaser{&consoleWriter{w: os.Stdout}})
+	defer acct.out.Close()
+
+	if err := startBot(); err != nil {
+		return err
+	}
+	defer stopBot()
+
+	status.setAlive(acct.Name, true)
+	status.setStarted()
+	defer status.setAlive(acct.Name, false)
+
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		errc <- s.Err()
+	}()
+
+	fmt.Println(consoleHelp)
+	msgID := 0
+	for {
+		select {
+		case <-sig: // Ctrl-C
+			return nil
+		case err := <-errc: // EOF
+			return err
+		case line := <-lines:
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) < 3 {
+				fmt.Println(consoleHelp)
+				continue
+			}
+			msgID++
+			handleMsg(acct, fmt.Sprintf("[MSG] %v - %v %v %v %v %v",
+				msgID, fields[0], fields[0], fields[1], fields[1], fields[2]))
+		}
+	}
+}
+
+// consoleWriter pretty-prints the commands sent by the bot to the tg
+// client.
+type consoleWriter struct {
+	w io.Writer
+}
+
+// consoleActions maps the tg client commands to their description.
+var consoleActions = map[string]string{
+	"send_photo":     "photo",
+	"send_audio":     "audio",
+	"send_document":  "document",
+	"send_file":      "file",
+	"reply_photo":    "photo",
+	"reply_audio":    "audio",
+	"reply_document": "document",
+	"reply_file":     "file",
+}
+
+func (cw *consoleWriter) Write(p []byte) (n int, err error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if err := cw.printCommand(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *consoleWriter) printCommand(line string) error {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		_, err := fmt.Fprintf(cw.w, "> %v\n", line)
+		return err
+	}
+	action, peer, arg := fields[0], fields[1], fields[2]
+
+	// Replies are addressed to a message ID instead of a peer
+	if strings.HasPrefix(action, "reply") {
+		peer = "reply to #" + peer
+	}
+
+	if action == "msg" || action == "reply" {
+		_, err := fmt.Fprintf(cw.w, "[%v] bot: %v\n", peer, arg)
+		return err
+	}
+	if kind, ok := consoleActions[action]; ok {
+		if _, err := os.Stat(arg); err != nil {
+			log.Printf("console: %v not found: %v\n", kind, err)
+		}
+		_, err := fmt.Fprintf(cw.w, "[%v] bot sent %v: %v\n", peer, kind, arg)
+		return err
+	}
+	_, err := fmt.Fprintf(cw.w, "> %v\n", line)
+	return err
+}
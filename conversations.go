@@ -0,0 +1,131 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jroimartin/tgbot/audit"
+	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/i18n"
+)
+
+// cancelCmd aborts the active conversation of the sender.
+const cancelCmd = "!cancel"
+
+// convTick is the interval used to check for expired conversations.
+const convTick = time.Second
+
+// Active conversations between commands and users.
+var convs = commands.NewConversations()
+
+// Closed to stop the goroutine started by startConvs.
+var convsStop chan struct{}
+
+// startConvs starts expiring the conversations that time out in a new
+// goroutine.
+func startConvs() {
+	convsStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(convTick)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				dispatchMu.Lock()
+				for _, c := range convs.Expire(now) {
+					abortConv(c, commands.AbortTimeout)
+				}
+				dispatchMu.Unlock()
+			}
+		}
+	}(convsStop)
+}
+
+// A convInvocation is the invocation that started a conversation. It is
+// audited again with the outcome of the conversation when it ends.
+type convInvocation struct {
+	chat, from peer
+	text       string
+}
+
+// Invocations of the active conversations. Guarded by dispatchMu.
+var convInvocations = make(map[*commands.Conversation]convInvocation)
+
+// trackConv returns true if the invocation of text by from in chat has
+// started a conversation, replacing before, if any. The conversation is
+// audited when it ends.
+func trackConv(before *commands.Conversation, chat, from peer, text string) bool {
+	c := convs.Get(chat.ID, from.ID)
+	if c == nil || c == before {
+		return false
+	}
+	if before != nil {
+		endConv(before, time.Now(), audit.Cancelled, errors.New("replaced"), "")
+	}
+	convInvocations[c] = convInvocation{chat: chat, from: from, text: text}
+	return true
+}
+
+// endConv audits the outcome of the conversation c, which has ended.
+func endConv(c *commands.Conversation, start time.Time, outcome string, err error, ref string) {
+	inv, ok := convInvocations[c]
+	if !ok {
+		return
+	}
+	delete(convInvocations, c)
+	auditInvocation(inv.chat, inv.from, inv.text, start, outcome, err, ref)
+}
+
+// continueConv passes m to the conversation c and audits its outcome if
+// it ends.
+func continueConv(c *commands.Conversation, m commands.Message, inv i18n.TemplateData, context string) {
+	start := time.Now()
+	err := runSafe(c.Command(), m.Chat, context, func() error {
+		return convs.Continue(c, m)
+	})
+	if err != nil {
+		outcome, ref := reportError(m, inv, err)
+		endConv(c, start, outcome, err, ref)
+		return
+	}
+	if convs.Get(c.Chat, c.User) == c {
+		return
+	}
+	outcome := audit.OK
+	if c.Declined {
+		outcome = audit.Cancelled
+	}
+	endConv(c, start, outcome, nil, "")
+}
+
+// abortConv aborts the conversation c, recovering from the panics of its
+// command.
+func abortConv(c *commands.Conversation, reason commands.AbortReason) {
+	endConv(c, time.Now(), audit.Cancelled, errors.New(string(reason)), "")
+	cmd := c.Command()
+	err := runSafe(cmd, c.Chat, fmt.Sprintf("abort %v: chat=%v, user=%v", reason, c.Chat, c.User),
+		func() error {
+			cmd.Abort(c, reason)
+			return nil
+		})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// stopConvs stops expiring conversations.
+func stopConvs() {
+	if convsStop == nil {
+		return
+	}
+	close(convsStop)
+	convsStop = nil
+}
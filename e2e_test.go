@@ -0,0 +1,258 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The end to end tests run tgbot with faketg as its tg client.
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// e2eBot is a tgbot process served by faketg.
+type e2eBot struct {
+	cmd    *exec.Cmd
+	out    *lockedBuffer
+	record string
+	done   chan error
+}
+
+// buildE2E builds tgbot and faketg in dir and returns their paths.
+func buildE2E(t *testing.T, dir string) (tgbot, faketg string) {
+	if testing.Short() {
+		t.Skip("skipping end to end test in short mode")
+	}
+
+	gobin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	tgbot, faketg = filepath.Join(dir, "tgbot"), filepath.Join(dir, "faketg")
+	for bin, pkg := range map[string]string{tgbot: ".", faketg: "./faketg"} {
+		if out, err := exec.Command(gobin, "build", "-o", bin, pkg).CombinedOutput(); err != nil {
+			t.Fatalf("cannot build %v: %v\n%s", pkg, err, out)
+		}
+	}
+	return tgbot, faketg
+}
+
+// startE2E builds tgbot and faketg and runs tgbot with a config that
+// enables the commands in sections and faketg running script.
+func startE2E(t *testing.T, script string, sections ...string) *e2eBot {
+	var cfg string
+	for _, s := range sections {
+		cfg += fmt.Sprintf("[%v]\nEnabled = true\n", s)
+	}
+	return startE2EConfig(t, script, cfg)
+}
+
+// startE2EConfig is like startE2E but the config of the commands is
+// given in cfg.
+func startE2EConfig(t *testing.T, script, cmdCfg string) *e2eBot {
+	dir := t.TempDir()
+	tgbot, faketg := buildE2E(t, dir)
+
+	scriptPath := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fmt.Sprintf("DataDir = %q\nTgBin = %q\nTgPubKey = \"key\"\n",
+		filepath.Join(dir, "data"), faketg)
+	cfg += cmdCfg
+	cfgPath := filepath.Join(dir, "tgbot.cfg")
+	if err := ioutil.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &e2eBot{
+		cmd:    exec.Command(tgbot, cfgPath),
+		out:    &lockedBuffer{},
+		record: filepath.Join(dir, "record"),
+		done:   make(chan error, 1),
+	}
+	b.cmd.Env = append(os.Environ(), "FAKETG_SCRIPT="+scriptPath, "FAKETG_RECORD="+b.record)
+	b.cmd.Stdout, b.cmd.Stderr = b.out, b.out
+	if err := b.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b.done <- b.cmd.Wait()
+	}()
+	t.Cleanup(func() {
+		b.cmd.Process.Kill()
+		if t.Failed() {
+			t.Logf("tgbot output:\n%v", b.out)
+		}
+	})
+	return b
+}
+
+// waitRecord waits until faketg has received the commands in want, in
+// order, and returns all the commands received.
+func (b *e2eBot) waitRecord(t *testing.T, want ...string) []string {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); {
+		data, _ := ioutil.ReadFile(b.record)
+		got = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(got) >= len(want) && strings.Join(got[:len(want)], "\n") == strings.Join(want, "\n") {
+			return got
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("commands: got %q, want %q", got, want)
+	return nil
+}
+
+// shutdown stops tgbot with Ctrl-C and checks that it exits cleanly.
+func (b *e2eBot) shutdown(t *testing.T) {
+	t.Helper()
+	if err := b.cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-b.done:
+		if err != nil {
+			t.Errorf("tgbot exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("tgbot did not exit")
+	}
+	if !strings.Contains(b.out.String(), "Bye!") {
+		t.Error("tgbot did not shut down cleanly")
+	}
+}
+
+func TestE2E(t *testing.T) {
+	b := startE2E(t, `
+[STARTED]
+[MSG] 101 - chat#id1 Chat user#id11 user1 !e hello
+@wait 1
+[MSG] 102 - chat#id1 Chat user#id11 user1 not a command
+[MSG] 103 - chat#id1 Chat user#id12 user2 !e bye
+`, "Echo")
+
+	b.waitRecord(t, "msg chat#id1 hello", "msg chat#id1 bye")
+	b.shutdown(t)
+}
+
+func TestE2EInvalidInput(t *testing.T) {
+	b := startE2E(t, `
+[STARTED]
+[MSG] 101 - chat#id1 Chat user#id11 user1 !lang xx
+`, "Lang")
+
+	// Invalid input is not reported as a failure with a reference
+	b.waitRecord(t, "msg chat#id1 error: unknown language xx")
+	if strings.Contains(b.out.String(), "error ") {
+		t.Error("invalid input was logged as an error")
+	}
+	b.shutdown(t)
+}
+
+func TestE2EConversation(t *testing.T) {
+	b := startE2EConfig(t, `
+[STARTED]
+[MSG] 101 - chat#id1 Chat user#id11 user1 !tw hello
+@wait 1
+[MSG] 102 - chat#id1 Chat user#id12 user2 no
+[MSG] 103 - chat#id2 Chat2 user#id11 user1 no
+[MSG] 104 - chat#id1 Chat user#id11 user1 maybe
+@wait 2
+[MSG] 105 - chat#id1 Chat user#id11 user1 !cancel
+@wait 3
+[MSG] 106 - chat#id1 Chat user#id11 user1 no
+[MSG] 107 - chat#id1 Chat user#id11 user1 !cancel
+`, "[Tweet]\nEnabled = true\nConfirm = true\n")
+
+	// Only the sender answers, in the same chat, until the conversation
+	// is cancelled
+	got := b.waitRecord(t,
+		"msg chat#id1 user1, confirm tweet? yes/no",
+		"msg chat#id1 Please answer yes or no (or !cancel)",
+		"msg chat#id1 Tweet discarded",
+		"msg chat#id1 nothing to cancel")
+	if len(got) != 4 {
+		t.Errorf("unexpected commands: %q", got[4:])
+	}
+	b.shutdown(t)
+}
+
+func TestE2ERestart(t *testing.T) {
+	b := startE2E(t, `
+[STARTED]
+[MSG] 101 - chat#id1 Chat user#id11 user1 !e ping
+@wait 1
+@crash 3
+`, "Echo")
+
+	// The client is restarted and keeps being served
+	b.waitRecord(t, "msg chat#id1 ping", "msg chat#id1 ping", "msg chat#id1 ping")
+	if n := strings.Count(b.out.String(), "restarting client"); n < 2 {
+		t.Errorf("restarts: got %v, want 2", n)
+	}
+	b.shutdown(t)
+}
+
+func TestE2EReplay(t *testing.T) {
+	dir := t.TempDir()
+	tgbot, _ := buildE2E(t, dir)
+	const rec, cfg = "replay/testdata/quotes", "replay/testdata/quotes.cfg"
+
+	out, err := exec.Command(tgbot, "replay", rec, cfg).CombinedOutput()
+	if err != nil || !bytes.Contains(out, []byte("Replay OK")) {
+		t.Fatalf("replay failed: %v\n%s", err, out)
+	}
+
+	// A recording whose golden output differs is reported
+	changed := filepath.Join(dir, "changed")
+	if err := os.Mkdir(changed, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"seed", "input.log", "golden.log", "http.jsonl"} {
+		data, err := ioutil.ReadFile(filepath.Join(rec, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "golden.log" {
+			data = bytes.Replace(data, []byte("Cats are liquid"), []byte("Cats are solid"), 1)
+		}
+		if err := ioutil.WriteFile(filepath.Join(changed, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err = exec.Command(tgbot, "replay", changed, cfg).CombinedOutput()
+	if err == nil {
+		t.Fatalf("replay of a changed recording succeeded:\n%s", out)
+	}
+	if !bytes.Contains(out, []byte("- msg chat#id1 New quote added: Cats are solid")) ||
+		!bytes.Contains(out, []byte("+ msg chat#id1 New quote added: Cats are liquid")) {
+		t.Errorf("missing diff in the output:\n%s", out)
+	}
+}
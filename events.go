@@ -0,0 +1,97 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/commands"
+)
+
+// Event format: "[EVT] kind chat_id chat from_id from [args]".
+var evtRegexp = regexp.MustCompile(`^\[EVT\] ([^ ]+) ([^ ]+) ([^ ]+) ([^ ]+) ([^ ]+)(?: (.*))?$`)
+
+// parseEvent parses an event line. It returns false if the line is not a
+// valid event.
+func parseEvent(line string) (ev commands.Event, chat, from peer, ok bool) {
+	sm := evtRegexp.FindStringSubmatch(line)
+	if sm == nil {
+		return ev, chat, from, false
+	}
+	chat = peer{ID: sm[2], Name: sm[3]}
+	from = peer{ID: sm[4], Name: sm[5]}
+	args := strings.TrimSpace(sm[6])
+
+	ev = commands.Event{
+		Kind:     commands.EventKind(sm[1]),
+		Chat:     chat.ID,
+		ChatName: chat.Name,
+		From:     from.Name,
+		FromID:   from.ID,
+	}
+	switch ev.Kind {
+	case commands.EventJoin, commands.EventLeave:
+		f := strings.Fields(args)
+		if len(f) != 2 {
+			return ev, chat, from, false
+		}
+		ev.UserID, ev.User = f[0], f[1]
+	case commands.EventMedia:
+		f := strings.SplitN(args, " ", 2)
+		ev.Media = f[0]
+		if len(f) == 2 {
+			ev.Text = f[1]
+		}
+	case commands.EventRename:
+		ev.Text = args
+	case commands.EventUserRename:
+	default:
+		return ev, chat, from, false
+	}
+	return ev, chat, from, true
+}
+
+// handleEvent parses the event received by the account a and passes it
+// to the commands that implement commands.EventHandler.
+func handleEvent(a *account, line string) {
+	ev, chat, from, ok := parseEvent(line)
+	if !ok {
+		log.Printf("invalid event: %q\n", line)
+		return
+	}
+	chat, from = a.qualifyPeer(chat), a.qualifyPeer(from)
+	ev.Chat, ev.FromID = chat.ID, from.ID
+	ev.UserID = a.qualify(ev.UserID)
+	status.setLastMsg(time.Now())
+
+	peers.learn(chat)
+	peers.learn(from)
+	if ev.UserID != "" {
+		peers.learn(peer{ID: ev.UserID, Name: a.qualify(ev.User)})
+	}
+
+	if ev.Kind != commands.EventUserRename && !a.isMonitored(chat) {
+		return
+	}
+
+	dispatchMu.Lock()
+	defer dispatchMu.Unlock()
+
+	for _, cmd := range enabledCommands {
+		eh, ok := cmd.(commands.EventHandler)
+		if !ok || !cmd.Enabled() || panics.isDisabled(cmd) || a.disables(cmd) {
+			continue
+		}
+		err := runSafe(cmd, ev.Chat, "event "+line, func() error {
+			return eh.HandleEvent(ev)
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Fakeirc is a fake IRC server used to test the IRC accounts of tgbot. It
+// accepts one client at a time, completes its registration, echoes its
+// JOINs, sends it the lines of a script and records the lines received
+// from it.
+//
+// Usage:
+//
+//	fakeirc [-addr 127.0.0.1:6667] [-record file] script
+//
+// The script is sent once the client is registered. Lines are sent as
+// they are, except empty lines, comments (starting with "#") and the
+// following directives:
+//
+//	@sleep duration   pause the output
+//	@wait n           wait until n PRIVMSGs have been received in total
+//	@drop             close the connection and continue the script when
+//	                  the client reconnects
+//	@exit             exit successfully
+//
+// Lines starting with message tags (e.g. "@account=alice :alice!a@h
+// PRIVMSG #chan :hi") are not directives.
+//
+// Lines received from the client, including the PONGs that answer the
+// PINGs of the script, are appended to the record file, if set.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// received counts the PRIVMSGs received and signals its changes.
+type received struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	n    int
+}
+
+func newReceived() *received {
+	r := &received{}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+func (r *received) inc() {
+	r.mu.Lock()
+	r.n++
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+// wait waits until n PRIVMSGs have been received.
+func (r *received) wait(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.n < n {
+		r.cond.Wait()
+	}
+}
+
+// A client is a connection from tgbot.
+type client struct {
+	conn       net.Conn
+	registered chan struct{}
+	closed     chan struct{}
+
+	once sync.Once
+	mu   sync.Mutex
+	nick string
+}
+
+func (c *client) send(format string, args ...interface{}) {
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+func main() {
+	log.SetPrefix("fakeirc: ")
+	log.SetFlags(0)
+
+	addr := flag.String("addr", "127.0.0.1:6667", "listen address")
+	recordPath := flag.String("record", "", "file where the received lines are recorded")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fakeirc [-addr addr] [-record file] script")
+		os.Exit(2)
+	}
+
+	script, err := readScript(flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var record io.Writer = ioutil.Discard
+	if *recordPath != "" {
+		f, err := os.OpenFile(*recordPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		record = &syncWriter{w: f}
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("listening on", l.Addr())
+
+	rcv := newReceived()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		c := &client{
+			conn:       conn,
+			registered: make(chan struct{}),
+			closed:     make(chan struct{}),
+		}
+		go c.read(record, rcv)
+
+		select {
+		case <-c.registered:
+		case <-c.closed:
+			continue
+		}
+		if script, err = runScript(c, script, rcv); err != nil {
+			log.Fatalln(err)
+		}
+		<-c.closed
+	}
+}
+
+// read reads the lines sent by the client, registering it and echoing
+// its JOINs.
+func (c *client) read(record io.Writer, rcv *received) {
+	defer close(c.closed)
+	defer c.conn.Close()
+
+	var user bool
+	s := bufio.NewScanner(c.conn)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		fmt.Fprintln(record, line)
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "NICK":
+			c.mu.Lock()
+			first := c.nick == ""
+			c.nick = arg
+			c.mu.Unlock()
+			if first && user {
+				c.register()
+			}
+		case "USER":
+			user = true
+			c.mu.Lock()
+			nick := c.nick
+			c.mu.Unlock()
+			if nick != "" {
+				c.register()
+			}
+		case "JOIN":
+			c.mu.Lock()
+			nick := c.nick
+			c.mu.Unlock()
+			c.send(":%v!%v@fakeirc JOIN %v", nick, nick, arg)
+		case "PRIVMSG":
+			rcv.inc()
+		case "QUIT":
+			return
+		}
+	}
+}
+
+func (c *client) register() {
+	c.mu.Lock()
+	nick := c.nick
+	c.mu.Unlock()
+	c.once.Do(func() {
+		c.send(":fakeirc 001 %v :Welcome to fakeirc", nick)
+		close(c.registered)
+	})
+}
+
+// readScript returns the lines of the script in path, without empty lines
+// and comments.
+func readScript(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// runScript sends the lines of the script to c, executing its
+// directives. It returns the rest of the script when the connection is
+// dropped.
+func runScript(c *client, script []string, rcv *received) ([]string, error) {
+	for i, line := range script {
+		// Lines with message tags (e.g. "@account=alice :alice!a@h ...")
+		if !strings.HasPrefix(line, "@") || strings.Contains(strings.Fields(line)[0], "=") {
+			c.send("%v", line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch fields[0] {
+		case "@sleep":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, err
+			}
+			time.Sleep(d)
+		case "@wait":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, err
+			}
+			rcv.wait(n)
+		case "@drop":
+			log.Println("dropping connection")
+			c.conn.Close()
+			return script[i+1:], nil
+		case "@exit":
+			os.Exit(0)
+		default:
+			return nil, fmt.Errorf("unknown directive %q", fields[0])
+		}
+	}
+	return nil, nil
+}
+
+// syncWriter serializes the writes to w.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Faketg is a fake telegram-cli used to test tgbot end to end. It accepts
+// the same flags tgbot passes to telegram-cli, prints the lines of a
+// script as if minoutput.lua had printed them and records the commands
+// received from tgbot.
+//
+// Usage:
+//
+//	FAKETG_SCRIPT=script FAKETG_RECORD=file faketg -R -C -D -W -s lua -k key
+//
+// The script is read from the file in FAKETG_SCRIPT. Lines are printed to
+// stdout as they are, except empty lines, comments (starting with "#")
+// and the following directives:
+//
+//	@sleep duration   pause the output
+//	@slow duration    wait duration before printing every following line
+//	@wait n           wait until n commands have been received in total
+//	@crash [code]     exit immediately with code (default 1)
+//	@exit             exit successfully
+//
+// When the script ends, faketg keeps running until stdin is closed or the
+// command "quit" or "safe_quit" is received, like telegram-cli does.
+//
+// Every command received on stdin is appended to the file in
+// FAKETG_RECORD, if set.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// received counts the commands received and signals its changes.
+type received struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	n      int
+	closed bool
+}
+
+func newReceived() *received {
+	r := &received{}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+func (r *received) inc() {
+	r.mu.Lock()
+	r.n++
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+func (r *received) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+// wait waits until n commands have been received. It returns false if
+// stdin is closed before.
+func (r *received) wait(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.n < n && !r.closed {
+		r.cond.Wait()
+	}
+	return r.n >= n
+}
+
+func main() {
+	log.SetPrefix("faketg: ")
+	log.SetFlags(0)
+
+	flag.Bool("R", false, "disable readline")
+	flag.Bool("C", false, "disable color")
+	flag.Bool("D", false, "disable output")
+	flag.Bool("W", false, "send dialog_list on start")
+	luaScript := flag.String("s", "", "lua script")
+	pubKey := flag.String("k", "", "server public key")
+	flag.Parse()
+
+	if *luaScript == "" || *pubKey == "" {
+		log.Fatalln("-s and -k are required")
+	}
+
+	var record io.Writer = ioutil.Discard
+	if path := os.Getenv("FAKETG_RECORD"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		record = f
+	}
+
+	rcv := newReceived()
+	quit := make(chan struct{})
+	go func() {
+		defer close(quit)
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			line := s.Text()
+			fmt.Fprintln(record, line)
+			rcv.inc()
+			if line == "quit" || line == "safe_quit" {
+				break
+			}
+		}
+		rcv.close()
+	}()
+
+	if path := os.Getenv("FAKETG_SCRIPT"); path != "" {
+		if err := runScript(path, rcv); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	<-quit
+}
+
+// runScript prints the lines of the script in path, executing its
+// directives.
+func runScript(path string, rcv *received) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var delay time.Duration
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "@") {
+			time.Sleep(delay)
+			fmt.Println(line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch fields[0] {
+		case "@sleep", "@slow":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return err
+			}
+			if fields[0] == "@sleep" {
+				time.Sleep(d)
+			} else {
+				delay = d
+			}
+		case "@wait":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+			if !rcv.wait(n) {
+				return fmt.Errorf("stdin closed before receiving %v commands", n)
+			}
+		case "@crash":
+			code := 1
+			if arg != "" {
+				if code, err = strconv.Atoi(arg); err != nil {
+					return err
+				}
+			}
+			log.Println("crashing")
+			os.Exit(code)
+		case "@exit":
+			os.Exit(0)
+		default:
+			return fmt.Errorf("unknown directive %q", fields[0])
+		}
+	}
+	return s.Err()
+}
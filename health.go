@@ -0,0 +1,146 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stallTimeout is the time the outbound queue can go without making
+// progress before it is considered stalled.
+const stallTimeout = 30 * time.Second
+
+// backendStatus holds the state of the tg clients as seen by the bot.
+type backendStatus struct {
+	mu      sync.Mutex
+	alive   map[string]bool // account -> its tg client process is running
+	started bool            // all the clients have replayed their binlog
+	lastMsg time.Time       // last message received
+}
+
+// status is the state of the tg clients.
+var status backendStatus
+
+// setAlive sets whether the client of the account is running.
+func (s *backendStatus) setAlive(account string, alive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alive == nil {
+		s.alive = make(map[string]bool)
+	}
+	s.alive[account] = alive
+	if !alive {
+		s.started = false
+	}
+}
+
+func (s *backendStatus) setStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+}
+
+func (s *backendStatus) setLastMsg(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastMsg = t
+}
+
+// healthReport is the body returned by the health endpoints. Alive is
+// true if the clients of all the accounts are running.
+type healthReport struct {
+	Alive       bool            `json:"alive"`
+	Accounts    []accountHealth `json:"accounts"`
+	Started     bool            `json:"started"`
+	LastMessage *time.Time      `json:"last_message,omitempty"`
+	Queue       struct {
+		Pending  int    `json:"pending"`
+		Draining bool   `json:"draining"`
+		Error    string `json:"error,omitempty"`
+	} `json:"queue"`
+}
+
+// accountHealth is the state of the client of an account.
+type accountHealth struct {
+	Name  string `json:"name"`
+	Alive bool   `json:"alive"`
+}
+
+func (s *backendStatus) report() healthReport {
+	var r healthReport
+
+	s.mu.Lock()
+	r.Alive = len(s.alive) > 0
+	for name, alive := range s.alive {
+		r.Alive = r.Alive && alive
+		r.Accounts = append(r.Accounts, accountHealth{Name: name, Alive: alive})
+	}
+	sort.Slice(r.Accounts, func(i, j int) bool {
+		return r.Accounts[i].Name < r.Accounts[j].Name
+	})
+	r.Started = s.started
+	if !s.lastMsg.IsZero() {
+		t := s.lastMsg
+		r.LastMessage = &t
+	}
+	s.mu.Unlock()
+
+	r.Queue.Draining = true
+	for _, a := range accounts {
+		if a.out == nil {
+			continue
+		}
+		ok, pending, err := a.out.draining(stallTimeout)
+		r.Queue.Draining = r.Queue.Draining && ok
+		r.Queue.Pending += pending
+		if err != nil && r.Queue.Error == "" {
+			r.Queue.Error = err.Error()
+		}
+	}
+	return r
+}
+
+// serveHealth starts the HTTP server that exposes the health endpoints of
+// status on addr.
+func serveHealth(addr string) {
+	mux := healthHandler(&status)
+	go func() {
+		log.Println("Health endpoints listening on", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// healthHandler returns the handler of /healthz and /readyz. /healthz
+// reports whether the tg clients are alive. /readyz also requires the
+// clients to be started and the outbound queues to be draining.
+func healthHandler(s *backendStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		rep := s.report()
+		writeHealth(w, rep, rep.Alive)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		rep := s.report()
+		writeHealth(w, rep, rep.Alive && rep.Started && rep.Queue.Draining)
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHealth(t *testing.T, h http.Handler, path string) (int, healthReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var rep healthReport
+	if err := json.NewDecoder(w.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, rep
+}
+
+func TestHealthAccounts(t *testing.T) {
+	old := accounts
+	accounts = nil
+	defer func() { accounts = old }()
+
+	s := &backendStatus{}
+	h := healthHandler(s)
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("no clients: got %v, want 503", code)
+	}
+
+	s.setAlive("a", true)
+	s.setAlive("b", true)
+	s.setStarted()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code, rep := getHealth(t, h, path); code != http.StatusOK || !rep.Alive {
+			t.Errorf("%v: got %v %+v, want 200", path, code, rep)
+		}
+	}
+
+	// A client that is down makes the bot unhealthy, even if another one
+	// is restarted meanwhile
+	s.setAlive("b", false)
+	s.setAlive("a", false)
+	s.setAlive("a", true)
+	code, rep := getHealth(t, h, "/healthz")
+	if code != http.StatusServiceUnavailable || rep.Alive {
+		t.Errorf("client down: got %v %+v, want 503", code, rep)
+	}
+	want := []accountHealth{{"a", true}, {"b", false}}
+	if len(rep.Accounts) != 2 || rep.Accounts[0] != want[0] || rep.Accounts[1] != want[1] {
+		t.Errorf("accounts: got %+v, want %+v", rep.Accounts, want)
+	}
+	if rep.Started {
+		t.Error("started with a client down")
+	}
+
+	s.setAlive("b", true)
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("clients up: got %v, want 200", code)
+	}
+	if code, _ := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("not started: got %v, want 503", code)
+	}
+}
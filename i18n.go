@@ -0,0 +1,58 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/i18n"
+)
+
+// Translations of the messages sent by the bot and language of every
+// chat.
+var (
+	catalog = i18n.NewCatalog()
+	locales *i18n.Locales
+)
+
+// initI18n loads the translations and the templates and shares them
+// with the commands.
+func initI18n() error {
+	if globalConfig.LocaleDir != "" {
+		if err := catalog.LoadDir(globalConfig.LocaleDir); err != nil {
+			return err
+		}
+	}
+	locales = i18n.NewLocales(db.Namespace("locales"), globalConfig.Locale)
+	commands.SetI18n(catalog, locales)
+
+	templates, err := i18n.ParseTemplates(globalConfig.Templates)
+	if err != nil {
+		return err
+	}
+	commands.SetTemplates(templates)
+	return nil
+}
+
+// tr translates the message key into the language of chat.
+func tr(chat, key string, args ...interface{}) string {
+	return commands.Translate(chat, key, args...)
+}
+
+// newInvocation returns the template variables of the command in m.
+func newInvocation(m commands.Message) i18n.TemplateData {
+	d := i18n.TemplateData{
+		Chat:   m.ChatName,
+		ChatID: m.Chat,
+		Sender: m.From,
+	}
+	fields := strings.SplitN(m.Text, " ", 2)
+	d.Command = fields[0]
+	if len(fields) == 2 {
+		d.Args = strings.TrimSpace(fields[1])
+	}
+	return d
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package i18n translates the messages sent by the bot. Messages are
+// identified by their English format string, which is also used when
+// there is no translation, so the code keeps being readable and untranslated
+// messages still make sense.
+//
+// Translations are loaded from TOML files named after the language
+// (e.g. "es.toml"). Every key is an English format string and its value
+// is either the translation or, for messages that depend on a number, a
+// table with its plural forms keyed by the singular English form:
+//
+//	"The list has been reset" = "La lista se ha vaciado"
+//
+//	["%v char? Mmm too much for me, size actually matters"]
+//	one = "¿%v carácter? Mmm demasiado para mí"
+//	other = "¿%v caracteres? Mmm demasiado para mí, el tamaño sí importa"
+//
+// As in any TOML file, the tables must follow the plain keys.
+//
+// Translations use the same verbs as the fmt package. Explicit argument
+// indexes (e.g. "%[2]v") can be used to reorder the arguments.
+package i18n
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jroimartin/tgbot/store"
+)
+
+// DefaultLang is the language of the messages in the code.
+const DefaultLang = "en"
+
+// A Message is the translation of a message. Messages that do not
+// depend on a number only set Other.
+type Message struct {
+	One   string
+	Other string
+}
+
+// A Catalog holds the translations of the messages into every language.
+type Catalog struct {
+	mu   sync.RWMutex
+	msgs map[string]map[string]Message
+}
+
+// NewCatalog returns an empty catalog.
+func NewCatalog() *Catalog {
+	return &Catalog{msgs: make(map[string]map[string]Message)}
+}
+
+// LoadDir loads the translations of every "<lang>.toml" file in dir.
+func (c *Catalog) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		lang := strings.TrimSuffix(filepath.Base(f), ".toml")
+		if err := c.LoadFile(lang, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile loads the translations into lang from the TOML file path.
+func (c *Catalog) LoadFile(lang, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if _, err := toml.Decode(string(b), &raw); err != nil {
+		return fmt.Errorf("i18n: %v: %v", path, err)
+	}
+
+	msgs := make(map[string]Message)
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			msgs[k] = Message{Other: v}
+		case map[string]interface{}:
+			one, _ := v["one"].(string)
+			other, _ := v["other"].(string)
+			if other == "" {
+				return fmt.Errorf("i18n: %v: %q: missing plural form \"other\"", path, k)
+			}
+			msgs[k] = Message{One: one, Other: other}
+		default:
+			return fmt.Errorf("i18n: %v: %q: invalid translation", path, k)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.msgs[lang] == nil {
+		c.msgs[lang] = make(map[string]Message)
+	}
+	for k, m := range msgs {
+		c.msgs[lang][k] = m
+	}
+	return nil
+}
+
+// Langs returns the languages with translations, plus DefaultLang.
+func (c *Catalog) Langs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	langs := []string{DefaultLang}
+	for l := range c.msgs {
+		if l != DefaultLang {
+			langs = append(langs, l)
+		}
+	}
+	sort.Strings(langs[1:])
+	return langs
+}
+
+// HasLang returns true if lang is DefaultLang or has translations.
+func (c *Catalog) HasLang(lang string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.msgs[lang]
+	return ok || lang == DefaultLang
+}
+
+// T translates the message key into lang and formats it with args.
+func (c *Catalog) T(lang, key string, args ...interface{}) string {
+	format := key
+	if m, ok := c.lookup(lang, key); ok {
+		format = m.Other
+	}
+	return sprintf(format, args)
+}
+
+// N translates the message key, which depends on n, into lang and
+// formats it with args. plural is the English plural form of key.
+func (c *Catalog) N(lang, key, plural string, n int, args ...interface{}) string {
+	one := pluralRule(lang)(n)
+	format := plural
+	if one {
+		format = key
+	}
+	if m, ok := c.lookup(lang, key); ok {
+		format = m.Other
+		if one && m.One != "" {
+			format = m.One
+		}
+	}
+	return sprintf(format, args)
+}
+
+func (c *Catalog) lookup(lang, key string) (Message, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	m, ok := c.msgs[lang][key]
+	return m, ok
+}
+
+func sprintf(format string, args []interface{}) string {
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// pluralRules report whether n takes the "one" form in a language.
+// Languages not listed use the English rule.
+var pluralRules = map[string]func(n int) bool{
+	"fr": func(n int) bool { return n == 0 || n == 1 },
+	"ja": func(n int) bool { return false },
+}
+
+func pluralRule(lang string) func(n int) bool {
+	if r, ok := pluralRules[lang]; ok {
+		return r
+	}
+	return func(n int) bool { return n == 1 }
+}
+
+// langKey is the key of the language of a chat.
+const langKey = "lang"
+
+// Locales stores the language selected for every chat.
+type Locales struct {
+	ns  store.Namespace
+	def string
+}
+
+// NewLocales returns the Locales stored in ns. Chats without language
+// use def.
+func NewLocales(ns store.Namespace, def string) *Locales {
+	if def == "" {
+		def = DefaultLang
+	}
+	return &Locales{ns: ns, def: def}
+}
+
+// Get returns the language of chat.
+func (l *Locales) Get(chat string) string {
+	lang, ok := l.Lookup(chat)
+	if !ok {
+		return l.def
+	}
+	return lang
+}
+
+// Lookup returns the language set for chat, if any.
+func (l *Locales) Lookup(chat string) (string, bool) {
+	var lang string
+	ok, err := l.ns.Chat(chat).Get(langKey, &lang)
+	if err != nil {
+		log.Printf("i18n: cannot get language of %v: %v\n", chat, err)
+	}
+	return lang, ok && err == nil
+}
+
+// Set sets the language of chat.
+func (l *Locales) Set(chat, lang string) error {
+	return l.ns.Chat(chat).Put(langKey, lang)
+}
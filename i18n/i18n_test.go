@@ -0,0 +1,204 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i18n
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+const testCatalog = `
+"Hello %v" = "Hola %v"
+"Bye" = "Adiós"
+
+["%v item"]
+one = "%v elemento"
+other = "%v elementos"
+
+["%v file"]
+other = "%v ficheros"
+`
+
+func writeCatalog(t *testing.T, dir, lang, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, lang+".toml")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	writeCatalog(t, dir, "es", testCatalog)
+	writeCatalog(t, dir, "fr", `"Bye" = "Au revoir"`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not toml"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCatalog()
+	if err := c.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(c.Langs(), " "); got != "en es fr" {
+		t.Errorf("langs: got %q, want %q", got, "en es fr")
+	}
+	for _, tt := range []struct {
+		lang string
+		want bool
+	}{
+		{"en", true},
+		{"es", true},
+		{"fr", true},
+		{"de", false},
+		{"", false},
+	} {
+		if got := c.HasLang(tt.lang); got != tt.want {
+			t.Errorf("HasLang(%q): got %v, want %v", tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name, data string
+	}{
+		{"bad toml", `"Bye" = `},
+		{"missing other", "[\"%v item\"]\none = \"%v elemento\"\n"},
+		{"not a string", `"Bye" = 1`},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := writeCatalog(t, dir, "es", tt.data)
+		c := NewCatalog()
+		if err := c.LoadFile("es", path); err == nil {
+			t.Errorf("%v: got no error", tt.name)
+		}
+		if err := c.LoadDir(dir); err == nil {
+			t.Errorf("%v: LoadDir: got no error", tt.name)
+		}
+		if c.HasLang("es") {
+			t.Errorf("%v: the language was loaded", tt.name)
+		}
+	}
+}
+
+// TestShippedCatalogs checks that the translations in doc/locales load.
+func TestShippedCatalogs(t *testing.T) {
+	c := NewCatalog()
+	if err := c.LoadDir(filepath.Join("..", "doc", "locales")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasLang("es") {
+		t.Fatal("es: not loaded")
+	}
+	want := "¿141 caracteres? Mmm demasiado para mí, el tamaño sí importa"
+	if got := c.N("es", "%v char? Mmm too much for me, size actually matters",
+		"%v chars? Mmm too much for me, size actually matters", 141, 141); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCatalog()
+	if err := c.LoadFile("es", writeCatalog(t, dir, "es", testCatalog)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages without translation and unknown languages fall back to
+	// English
+	tests := []struct {
+		lang, key string
+		args      []interface{}
+		want      string
+	}{
+		{"es", "Hello %v", []interface{}{"Ana"}, "Hola Ana"},
+		{"es", "Bye", nil, "Adiós"},
+		{"es", "Untranslated %v", []interface{}{1}, "Untranslated 1"},
+		{"en", "Hello %v", []interface{}{"Ana"}, "Hello Ana"},
+		{"de", "Bye", nil, "Bye"},
+		{"", "Bye", nil, "Bye"},
+		{"es", "100%", nil, "100%"},
+	}
+	for _, tt := range tests {
+		if got := c.T(tt.lang, tt.key, tt.args...); got != tt.want {
+			t.Errorf("T(%q, %q): got %q, want %q", tt.lang, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCatalog()
+	for _, lang := range []string{"es", "fr", "ja"} {
+		if err := c.LoadFile(lang, writeCatalog(t, dir, lang, testCatalog)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		lang, key, plural string
+		n                 int
+		want              string
+	}{
+		{"en", "%v item", "%v items", 1, "1 item"},
+		{"en", "%v item", "%v items", 0, "0 items"},
+		{"en", "%v item", "%v items", 2, "2 items"},
+		{"es", "%v item", "%v items", 1, "1 elemento"},
+		{"es", "%v item", "%v items", 0, "0 elementos"},
+		{"es", "%v item", "%v items", 5, "5 elementos"},
+		// French takes the "one" form for 0 too
+		{"fr", "%v item", "%v items", 0, "0 elemento"},
+		{"fr", "%v item", "%v items", 2, "2 elementos"},
+		// Japanese has no "one" form
+		{"ja", "%v item", "%v items", 1, "1 elementos"},
+		// Without "one", "other" is used for every number
+		{"es", "%v file", "%v files", 1, "1 ficheros"},
+		// Untranslated messages and languages fall back to English
+		{"es", "%v dog", "%v dogs", 1, "1 dog"},
+		{"es", "%v dog", "%v dogs", 3, "3 dogs"},
+		{"de", "%v item", "%v items", 1, "1 item"},
+		{"de", "%v item", "%v items", 3, "3 items"},
+	}
+	for _, tt := range tests {
+		if got := c.N(tt.lang, tt.key, tt.plural, tt.n, tt.n); got != tt.want {
+			t.Errorf("N(%q, %q, %v): got %q, want %q", tt.lang, tt.key, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLocales(t *testing.T) {
+	db, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := NewLocales(db.Namespace("locales"), "")
+	if got := l.Get("chat#id1"); got != DefaultLang {
+		t.Errorf("no default: got %q, want %q", got, DefaultLang)
+	}
+	l = NewLocales(db.Namespace("locales"), "es")
+	if got := l.Get("chat#id1"); got != "es" {
+		t.Errorf("default: got %q, want es", got)
+	}
+	if _, ok := l.Lookup("chat#id1"); ok {
+		t.Error("Lookup: got a language, want none")
+	}
+	if err := l.Set("chat#id1", "fr"); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Get("chat#id1"); got != "fr" {
+		t.Errorf("got %q, want fr", got)
+	}
+	if got := l.Get("chat#id2"); got != "es" {
+		t.Errorf("other chat: got %q, want es", got)
+	}
+}
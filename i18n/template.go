@@ -0,0 +1,107 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i18n
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TemplateData holds the variables available to the templates.
+type TemplateData struct {
+	// Chat is the name of the chat and ChatID its ID.
+	Chat   string
+	ChatID string
+
+	// Sender is the name of the user who ran the command.
+	Sender string
+
+	// Command is the command being run (e.g. "!q") and Args the rest
+	// of the text.
+	Command string
+	Args    string
+
+	// Result is the first value of the message (e.g. the quote in
+	// "New quote added: %v") and Values all of them.
+	Result string
+	Values []interface{}
+
+	// Error is the error returned by the command, if any.
+	Error string
+
+	// Text is the message that would have been sent without the
+	// template, already translated.
+	Text string
+}
+
+// Templates override messages, identified by their English format
+// string, with text/template templates.
+type Templates struct {
+	t map[string]*template.Template
+}
+
+// ParseTemplates parses the templates in defs, which maps message keys
+// to templates. Every template is executed with empty data, with as many
+// values as verbs in its key, so the references to unknown variables are
+// reported here instead of when the message is sent.
+func ParseTemplates(defs map[string]string) (*Templates, error) {
+	keys := make([]string, 0, len(defs))
+	for k := range defs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ts := &Templates{t: make(map[string]*template.Template)}
+	for _, k := range keys {
+		t, err := template.New(k).Option("missingkey=error").Parse(defs[k])
+		if err != nil {
+			return nil, fmt.Errorf("i18n: template %q: %v", k, err)
+		}
+		if err := t.Execute(ioutil.Discard, TemplateData{Values: sampleValues(k)}); err != nil {
+			return nil, fmt.Errorf("i18n: template %q: %v", k, err)
+		}
+		ts.t[k] = t
+	}
+	return ts, nil
+}
+
+// sampleValues returns an empty value for every verb in the format
+// string key.
+func sampleValues(key string) []interface{} {
+	n := strings.Count(strings.Replace(key, "%%", "", -1), "%")
+	values := make([]interface{}, n)
+	for i := range values {
+		values[i] = ""
+	}
+	return values
+}
+
+// Execute executes the template of the message key. It returns false if
+// there is no template for key or it fails.
+func (ts *Templates) Execute(key string, data TemplateData) (string, bool) {
+	if ts == nil {
+		return "", false
+	}
+	t, ok := ts.t[key]
+	if !ok {
+		return "", false
+	}
+	if len(data.Values) > 0 {
+		data.Result = fmt.Sprint(data.Values[0])
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Printf("i18n: template %q: %v\n", key, err)
+		return "", false
+	}
+	// Commands are sent to the tg client line by line
+	return strings.Replace(buf.String(), "\n", " ", -1), true
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package i18n
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		defs map[string]string
+		want string
+	}{
+		{"syntax", map[string]string{"Bye": "{{.Sender"}, `template "Bye"`},
+		{"unknown variable", map[string]string{"Bye": "{{.Sendr}}"}, "Sendr"},
+		{"unknown function", map[string]string{"Bye": "{{upper .Sender}}"}, "upper"},
+		{"value out of range", map[string]string{"Hello %v": "{{index .Values 1}}"}, "out of range"},
+		{"first of many", map[string]string{"A": "ok", "B": "{{.X}}", "C": "{{.Y}}"}, `template "B"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseTemplates(tt.defs)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want an error with %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Every variable can be used
+	ts, err := ParseTemplates(map[string]string{
+		"All": "{{.Chat}} {{.ChatID}} {{.Sender}} {{.Command}} {{.Args}} " +
+			"{{.Result}} {{.Values}} {{.Error}} {{.Text}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts.Execute("All", TemplateData{}); !ok {
+		t.Error("the template was not executed")
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	ts, err := ParseTemplates(map[string]string{
+		"New quote added: %v":  "{{.Sender}} added quote #{{.Result}} in {{.Chat}}",
+		"%v and %v":            "{{index .Values 1}} then {{index .Values 0}}",
+		"error: command error": "{{.Command}} failed{{if .Error}}: {{.Error}}{{end}}",
+		"Text":                 "«{{.Text}}»\n({{.Args}})",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := TemplateData{
+		Chat:    "Team",
+		ChatID:  "chat#id1",
+		Sender:  "alice",
+		Command: "!q",
+		Args:    "add hi",
+		Text:    "translated",
+	}
+	tests := []struct {
+		key    string
+		values []interface{}
+		err    string
+		want   string
+	}{
+		// Result is the first value
+		{"New quote added: %v", []interface{}{7}, "", "alice added quote #7 in Team"},
+		{"New quote added: %v", nil, "", "alice added quote # in Team"},
+		{"%v and %v", []interface{}{"a", 2}, "", "2 then a"},
+		{"error: command error", nil, "", "!q failed"},
+		{"error: command error", nil, "timeout", "!q failed: timeout"},
+		// Messages are sent in one line
+		{"Text", nil, "", "«translated» (add hi)"},
+	}
+	for _, tt := range tests {
+		d := d
+		d.Values, d.Error = tt.values, tt.err
+		got, ok := ts.Execute(tt.key, d)
+		if !ok || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.key, got, ok, tt.want)
+		}
+	}
+
+	// Messages without template and failing templates are not
+	// overridden
+	if _, ok := ts.Execute("Bye", d); ok {
+		t.Error("executed a missing template")
+	}
+	if _, ok := ts.Execute("%v and %v", d); ok {
+		t.Error("a failing template was used")
+	}
+	var nilTemplates *Templates
+	if _, ok := nilTemplates.Execute("Text", d); ok {
+		t.Error("nil templates: executed a template")
+	}
+}
+
+func TestParseTemplatesEmpty(t *testing.T) {
+	ts, err := ParseTemplates(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts.Execute("Bye", TemplateData{}); ok {
+		t.Error("executed a missing template")
+	}
+}
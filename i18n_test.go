@@ -0,0 +1,47 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/i18n"
+)
+
+func TestInitI18nTemplates(t *testing.T) {
+	setTestDB(t, t.TempDir())
+	old := globalConfig
+	t.Cleanup(func() {
+		globalConfig = old
+		commands.SetI18n(i18n.NewCatalog(), nil)
+		commands.SetTemplates(nil)
+	})
+
+	// Invalid templates stop the bot at startup
+	globalConfig.Templates = map[string]string{"nothing to cancel": "{{.Nothing}}"}
+	if err := initI18n(); err == nil {
+		t.Error("invalid template: got no error")
+	}
+
+	globalConfig.Templates = map[string]string{
+		"nothing to cancel": "{{.Sender}}: no {{.Command}} to undo",
+		"%v (ref %v)":       "{{.Error}} [{{index .Values 1}}]",
+		"error: usage: %v":  "{{.Result}}",
+	}
+	if err := initI18n(); err != nil {
+		t.Fatal(err)
+	}
+	commands.SetInvocation(newInvocation(commands.Message{
+		Chat: "chat#id1", From: "alice", Text: "!cancel now",
+	}))
+	defer commands.SetInvocation(i18n.TemplateData{})
+	if got, want := tr("chat#id1", "nothing to cancel"), "alice: no !cancel to undo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := tr("chat#id1", "%v (ref %v)", "boom", "3f2a1c"), " [3f2a1c]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
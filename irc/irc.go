@@ -0,0 +1,416 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package irc implements a minimal IRC client. It registers with the
+// server, joins the configured channels, answers PINGs and reconnects when
+// the connection is lost.
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxText is the maximum length in bytes of the text of a PRIVMSG. IRC
+// lines are limited to 512 bytes, including the prefix added by the
+// server when relaying the message, so some room is left for it.
+const MaxText = 400
+
+// Reconnection delays. The delay doubles after every failed attempt.
+var (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// ErrClosed is returned when using a closed client.
+var ErrClosed = errors.New("irc: client closed")
+
+// Config is the configuration of a client.
+type Config struct {
+	// Server is the address of the server (e.g. "irc.example.com:6697").
+	Server string
+	TLS    bool
+
+	// Nick, User and RealName are sent when registering. User and
+	// RealName default to Nick.
+	Nick     string
+	User     string
+	RealName string
+	Password string
+
+	// Channels joined after registering.
+	Channels []string
+
+	// Caps are the IRCv3 capabilities requested when registering (e.g.
+	// "account-tag"). Servers that do not support them are used without
+	// them.
+	Caps []string
+}
+
+// A Message is a line received from the server.
+type Message struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// ParseMessage parses an IRC line without the trailing CRLF.
+func ParseMessage(line string) (Message, error) {
+	var m Message
+	if strings.HasPrefix(line, "@") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return m, fmt.Errorf("irc: invalid line %q", line)
+		}
+		m.Tags = parseTags(line[1:i])
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return m, fmt.Errorf("irc: invalid line %q", line)
+		}
+		m.Prefix, line = line[1:i], strings.TrimLeft(line[i:], " ")
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") && m.Command != "" {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		i := strings.Index(line, " ")
+		if i < 0 {
+			i = len(line)
+		}
+		if m.Command == "" {
+			m.Command = strings.ToUpper(line[:i])
+		} else {
+			m.Params = append(m.Params, line[:i])
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	if m.Command == "" {
+		return m, fmt.Errorf("irc: invalid line %q", line)
+	}
+	return m, nil
+}
+
+// tagEscapes unescapes the values of the message tags.
+var tagEscapes = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// parseTags parses the tags of a message, without the leading "@".
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		tags[kv[0]] = tagEscapes.Replace(kv[1])
+	}
+	return tags
+}
+
+// Nick returns the nick in the prefix of m.
+func (m Message) Nick() string {
+	if i := strings.IndexAny(m.Prefix, "!@"); i >= 0 {
+		return m.Prefix[:i]
+	}
+	return m.Prefix
+}
+
+// Param returns the i-th parameter of m or "".
+func (m Message) Param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// A Handler is called with every message received, except PINGs, from the
+// goroutine that reads from the server. The registration is completed
+// when the handler receives the command "001".
+type Handler func(m Message)
+
+// A Client is a connection to an IRC server that is reestablished when it
+// is lost.
+type Client struct {
+	cfg     Config
+	handler Handler
+
+	mu     sync.Mutex
+	conn   net.Conn
+	nick   string
+	closed bool
+	done   chan struct{}
+}
+
+// NewClient returns a client configured by cfg that passes the received
+// messages to handler. Run must be called to connect it.
+func NewClient(cfg Config, handler Handler) *Client {
+	if cfg.User == "" {
+		cfg.User = cfg.Nick
+	}
+	if cfg.RealName == "" {
+		cfg.RealName = cfg.Nick
+	}
+	return &Client{
+		cfg:     cfg,
+		handler: handler,
+		nick:    cfg.Nick,
+		done:    make(chan struct{}),
+	}
+}
+
+// Run connects to the server and serves the connection, reconnecting
+// when it is lost, until the client is closed.
+func (c *Client) Run() {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := c.serve()
+		if c.isClosed() {
+			return
+		}
+		log.Printf("irc: %v: %v\n", c.cfg.Server, err)
+
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Printf("irc: reconnecting in %v\n", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// serve connects and registers with the server and reads from it until
+// the connection is lost.
+func (c *Client) serve() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.cfg.TLS {
+		conn, err = tls.Dial("tcp", c.cfg.Server, nil)
+	} else {
+		conn, err = net.Dial("tcp", c.cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.nick = c.cfg.Nick
+	c.mu.Unlock()
+	defer conn.Close()
+
+	if len(c.cfg.Caps) > 0 {
+		c.send("CAP REQ :" + strings.Join(c.cfg.Caps, " "))
+	}
+	if c.cfg.Password != "" {
+		c.send("PASS " + c.cfg.Password)
+	}
+	c.send("NICK " + c.cfg.Nick)
+	c.send(fmt.Sprintf("USER %v 0 * :%v", c.cfg.User, c.cfg.RealName))
+
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		m, err := ParseMessage(strings.TrimRight(s.Text(), "\r"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		switch m.Command {
+		case "PING":
+			c.send("PONG :" + m.Param(0))
+			continue
+		case "CAP":
+			// The registration waits for the end of the negotiation
+			if sub := m.Param(1); sub == "ACK" || sub == "NAK" {
+				c.send("CAP END")
+			}
+		case "001":
+			c.setNick(m.Param(0))
+			for _, ch := range c.cfg.Channels {
+				c.send("JOIN " + ch)
+			}
+		case "433": // ERR_NICKNAMEINUSE
+			nick := c.Nick() + "_"
+			c.setNick(nick)
+			c.send("NICK " + nick)
+		case "NICK":
+			if m.Nick() == c.Nick() {
+				c.setNick(m.Param(0))
+			}
+		}
+		c.handler(m)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed")
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Client) setNick(nick string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nick = nick
+}
+
+// Nick returns the current nick of the client.
+func (c *Client) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// send sends a raw line to the server. Lines with CR, LF or NUL are
+// rejected, since they would inject commands.
+func (c *Client) send(line string) error {
+	if strings.ContainsAny(line, "\r\n\x00") {
+		return fmt.Errorf("irc: invalid line %q", line)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return errors.New("irc: not connected")
+	}
+	_, err := fmt.Fprintf(c.conn, "%v\r\n", line)
+	return err
+}
+
+// newlines converts the line breaks of the texts sent with Privmsg to LF
+// and removes the NULs.
+var newlines = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "")
+
+// Privmsg sends text to target, which can be a channel or a nick. Text
+// is split in several messages if it is too long or has several lines,
+// separated by LF, CR or CRLF.
+func (c *Client) Privmsg(target, text string) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	for _, line := range strings.Split(newlines.Replace(text), "\n") {
+		for _, part := range Split(line, MaxText) {
+			if err := c.send(fmt.Sprintf("PRIVMSG %v :%v", target, part)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close quits and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	fmt.Fprint(conn, "QUIT :Bye!\r\n")
+	return conn.Close()
+}
+
+// MatchMask returns true if the prefix nick!user@host matches pattern,
+// which can have the wildcards "*" and "?". The comparison is case
+// insensitive.
+func MatchMask(pattern, prefix string) bool {
+	return matchWild(strings.ToLower(pattern), strings.ToLower(prefix))
+}
+
+func matchWild(p, s string) bool {
+	for p != "" {
+		switch p[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWild(p[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(s)
+			p, s = p[1:], s[n:]
+		default:
+			if s == "" || p[0] != s[0] {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+// Split splits text in parts of at most max bytes, breaking at spaces
+// when possible and never in the middle of a UTF-8 sequence. Empty texts
+// are sent as a single space, since IRC does not allow empty messages.
+func Split(text string, max int) []string {
+	if text == "" {
+		return []string{" "}
+	}
+
+	var parts []string
+	for len(text) > max {
+		i := max
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		if i == 0 {
+			i = max
+		}
+		// The part can end right before a space
+		if sp := strings.LastIndex(text[:i+1], " "); sp > 0 {
+			i = sp
+		}
+		parts = append(parts, text[:i])
+		text = strings.TrimLeft(text[i:], " ")
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package irc
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+	}{
+		{"PING :irc.example.com", Message{Command: "PING", Params: []string{"irc.example.com"}}},
+		{
+			":alice!a@host PRIVMSG #chan :hello  world",
+			Message{Prefix: "alice!a@host", Command: "PRIVMSG", Params: []string{"#chan", "hello  world"}},
+		},
+		{
+			":srv 001 tgbot :Welcome",
+			Message{Prefix: "srv", Command: "001", Params: []string{"tgbot", "Welcome"}},
+		},
+		{"join #chan", Message{Command: "JOIN", Params: []string{"#chan"}}},
+		{
+			`@account=alice;msgid=a\sb\:c;flag :alice!a@host PRIVMSG tgbot ::)`,
+			Message{
+				Tags:    map[string]string{"account": "alice", "msgid": "a b;c", "flag": ""},
+				Prefix:  "alice!a@host",
+				Command: "PRIVMSG",
+				Params:  []string{"tgbot", ":)"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseMessage(tt.line)
+		if err != nil {
+			t.Errorf("ParseMessage(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseMessage(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", ":prefix-only", "@tags-only", ":prefix "} {
+		if _, err := ParseMessage(line); err == nil {
+			t.Errorf("ParseMessage(%q): got nil error", line)
+		}
+	}
+}
+
+func TestNick(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"alice!a@host": "alice",
+		"alice@host":   "alice",
+		"irc.server":   "irc.server",
+	} {
+		if got := (Message{Prefix: prefix}).Nick(); got != want {
+			t.Errorf("Nick of %q = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"", 10, []string{" "}},
+		{"short", 10, []string{"short"}},
+		{"hello world foo", 11, []string{"hello world", "foo"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// "ñ" is 2 bytes and must not be broken
+		{"ñññ", 3, []string{"ñ", "ñ", "ñ"}},
+		{"añb", 2, []string{"a", "ñ", "b"}},
+	}
+	for _, tt := range tests {
+		got := Split(tt.text, tt.max)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Split(%q, %v) = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+	}
+
+	text := strings.Repeat("ñandú ", 200)
+	for _, part := range Split(text, MaxText) {
+		if len(part) > MaxText {
+			t.Errorf("part of %v bytes, max %v", len(part), MaxText)
+		}
+		if !utf8.ValidString(part) {
+			t.Errorf("invalid UTF-8 in part %q", part)
+		}
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		pattern, prefix string
+		want            bool
+	}{
+		{"alice!a@host", "alice!a@host", true},
+		{"Alice!A@Host", "alice!a@host", true},
+		{"alice!*@host", "alice!anything@host", true},
+		{"alice!*@*.example.com", "alice!a@x.example.com", true},
+		{"alice!*@*.example.com", "alice!a@example.org", false},
+		{"alic?!a@host", "alice!a@host", true},
+		{"alice!a@host", "alice2!a@host", false},
+		{"*!*@trusted", "mallory!m@untrusted", false},
+	}
+	for _, tt := range tests {
+		if got := MatchMask(tt.pattern, tt.prefix); got != tt.want {
+			t.Errorf("MatchMask(%q, %q) = %v, want %v", tt.pattern, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// A stubServer is a local IRC server that hands the accepted connections
+// to the test.
+type stubServer struct {
+	l     net.Listener
+	conns chan *stubConn
+}
+
+type stubConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubServer{l: l, conns: make(chan *stubConn, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- &stubConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+// accept returns the next connection of the client.
+func (s *stubServer) accept() *stubConn {
+	select {
+	case c := <-s.conns:
+		c.t.Cleanup(func() { c.conn.Close() })
+		return c
+	case <-time.After(5 * time.Second):
+		panic("no connection")
+	}
+}
+
+// readLine returns the next line sent by the client.
+func (c *stubConn) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading from client: %v", err)
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		c.t.Fatalf("line without CRLF: %q", line)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect reads the next lines and checks that they are want.
+func (c *stubConn) expect(want ...string) {
+	c.t.Helper()
+	for _, w := range want {
+		if got := c.readLine(); got != w {
+			c.t.Fatalf("got line %q, want %q", got, w)
+		}
+	}
+}
+
+func (c *stubConn) send(line string) {
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+// register completes the registration of a client.
+func (c *stubConn) register(caps bool) {
+	c.t.Helper()
+	if caps {
+		c.expect("CAP REQ :account-tag")
+	}
+	c.expect("PASS secret", "NICK tgbot", "USER tgbot 0 * :tgbot")
+	if caps {
+		c.send(":srv CAP * ACK :account-tag")
+		c.expect("CAP END")
+	}
+	c.send(":srv 001 tgbot :Welcome")
+	c.expect("JOIN #chan")
+}
+
+func newTestClient(t *testing.T, s *stubServer, caps []string) (*Client, chan Message) {
+	msgs := make(chan Message, 100)
+	c := NewClient(Config{
+		Server:   s.l.Addr().String(),
+		Nick:     "tgbot",
+		Password: "secret",
+		Channels: []string{"#chan"},
+		Caps:     caps,
+	}, func(m Message) { msgs <- m })
+	go c.Run()
+	t.Cleanup(func() { c.Close() })
+	return c, msgs
+}
+
+func nextMsg(t *testing.T, msgs chan Message, cmd string) Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-msgs:
+			if m.Command == cmd {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no %v received", cmd)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := newStubServer(t)
+	c, msgs := newTestClient(t, s, []string{"account-tag"})
+
+	conn := s.accept()
+	conn.register(true)
+
+	conn.send("PING :token")
+	conn.expect("PONG :token")
+
+	conn.send("@account=alice :alice!a@host PRIVMSG #chan :!e hi")
+	m := nextMsg(t, msgs, "PRIVMSG")
+	if m.Tags["account"] != "alice" || m.Nick() != "alice" || m.Param(1) != "!e hi" {
+		t.Errorf("got message %+v", m)
+	}
+
+	// Nick in use
+	conn.send(":srv 433 * tgbot :Nickname is already in use")
+	conn.expect("NICK tgbot_")
+	if c.Nick() != "tgbot_" {
+		t.Errorf("nick: got %q, want tgbot_", c.Nick())
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.expect("QUIT :Bye!")
+	if err := c.Privmsg("#chan", "hi"); err != ErrClosed {
+		t.Errorf("Privmsg after Close: got %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestPrivmsg(t *testing.T) {
+	s := newStubServer(t)
+	c, _ := newTestClient(t, s, nil)
+
+	conn := s.accept()
+	conn.register(false)
+
+	// Line breaks and NULs must not inject commands
+	if err := c.Privmsg("#chan", "one\r\ntwo\rQUIT :x\x00\nthree"); err != nil {
+		t.Fatal(err)
+	}
+	conn.expect(
+		"PRIVMSG #chan :one",
+		"PRIVMSG #chan :two",
+		"PRIVMSG #chan :QUIT :x",
+		"PRIVMSG #chan :three",
+	)
+
+	long := strings.Repeat("a", MaxText+10)
+	if err := c.Privmsg("alice", long); err != nil {
+		t.Fatal(err)
+	}
+	conn.expect("PRIVMSG alice :"+long[:MaxText], "PRIVMSG alice :"+long[MaxText:])
+
+	if err := c.send("PRIVMSG #chan :a\r\nQUIT"); err == nil {
+		t.Error("send: got nil error with CRLF")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	oldMin, oldMax := minBackoff, maxBackoff
+	minBackoff, maxBackoff = 20*time.Millisecond, 80*time.Millisecond
+	defer func() { minBackoff, maxBackoff = oldMin, oldMax }()
+
+	s := newStubServer(t)
+	newTestClient(t, s, nil)
+
+	// Drop the connections as soon as they are established and check
+	// the delays between them
+	var last time.Time
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		conn := s.accept()
+		now := time.Now()
+		if i > 0 {
+			delays = append(delays, now.Sub(last))
+		}
+		last = now
+		conn.conn.Close()
+	}
+	want := []time.Duration{20, 40, 80, 80}
+	for i, d := range delays {
+		if min := want[i] * time.Millisecond; d < min {
+			t.Errorf("delay %v: got %v, want at least %v", i, d, min)
+		}
+		if d > time.Second {
+			t.Errorf("delay %v: got %v, want less than 1s", i, d)
+		}
+	}
+
+	// The client registers again after reconnecting
+	conn := s.accept()
+	conn.register(false)
+}
@@ -0,0 +1,379 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/irc"
+)
+
+// Configuration of an account served on IRC instead of Telegram.
+type ircConfig struct {
+	Server   string // e.g. "irc.example.com:6697"
+	TLS      bool
+	Nick     string
+	User     string
+	RealName string
+	Password string
+	Channels []string
+
+	// The media sent by the commands are served on MediaAddr and sent
+	// as links under MediaURL (e.g. "http://bot.example.com:8081/").
+	// Without them, media are not sent.
+	MediaAddr string
+	MediaURL  string
+}
+
+// maxIRCMsgs is the number of received messages kept to answer them with
+// replies.
+const maxIRCMsgs = 1000
+
+// ircBridge connects the bot to IRC. It translates the received messages
+// into the lines printed by minoutput.lua and the commands sent to the tg
+// client into IRC messages, so IRC channels are served as Telegram chats.
+// Channels are identified by their name (e.g. "#team") and users by their
+// nick.
+type ircBridge struct {
+	client *irc.Client
+	lines  *io.PipeWriter
+	media  *mediaServer
+
+	mu      sync.Mutex
+	started bool
+	lastID  int
+	msgs    map[string]ircMsg
+	ids     []string
+}
+
+// An ircMsg is a message received on IRC. mask is the nick!user@host of
+// the sender and account its services account, if the server sends it.
+type ircMsg struct {
+	chat, nick    string
+	mask, account string
+}
+
+// startIRC connects the account to IRC.
+func (a *account) startIRC() error {
+	cfg := a.IRC
+	if cfg.Server == "" || cfg.Nick == "" {
+		return fmt.Errorf("account %q: IRC Server and Nick are required", a.Name)
+	}
+
+	r, w := io.Pipe()
+	b := &ircBridge{
+		lines: w,
+		msgs:  make(map[string]ircMsg),
+	}
+	if cfg.MediaAddr != "" {
+		ms, err := newMediaServer(cfg.MediaAddr, cfg.MediaURL)
+		if err != nil {
+			return err
+		}
+		b.media = ms
+	}
+	b.client = irc.NewClient(irc.Config{
+		Server:   cfg.Server,
+		TLS:      cfg.TLS,
+		Nick:     cfg.Nick,
+		User:     cfg.User,
+		RealName: cfg.RealName,
+		Password: cfg.Password,
+		Channels: cfg.Channels,
+		Caps:     []string{"account-tag"},
+	}, b.handle)
+	go b.client.Run()
+
+	a.stdout, a.stdin = r, b
+	a.irc = b
+	return nil
+}
+
+// isIRCAdmin returns true if the sender of m is an admin of the IRC
+// account a. Anyone can take a nick, so admins are identified by their
+// services account ("$a:account") or their nick!user@host mask, which can
+// have wildcards.
+func (a *account) isIRCAdmin(m commands.Message) bool {
+	if a.irc == nil {
+		return false
+	}
+	_, id := accountOf(m.ID)
+	msg, ok := a.irc.getMsg(id)
+	if !ok {
+		return false
+	}
+	for _, ad := range a.Admins {
+		if strings.HasPrefix(ad, ircAccountPrefix) {
+			if msg.account != "" && strings.EqualFold(ad[len(ircAccountPrefix):], msg.account) {
+				return true
+			}
+			continue
+		}
+		if irc.MatchMask(ad, msg.mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// ircAccountPrefix prefixes the admins identified by their services
+// account.
+const ircAccountPrefix = "$a:"
+
+// validIRCAdmin returns true if ad identifies an IRC user by account or
+// by mask.
+func validIRCAdmin(ad string) bool {
+	if strings.HasPrefix(ad, ircAccountPrefix) {
+		return len(ad) > len(ircAccountPrefix)
+	}
+	i, j := strings.Index(ad, "!"), strings.Index(ad, "@")
+	return i > 0 && j > i+1 && j < len(ad)-1
+}
+
+// handle translates the IRC messages into minoutput.lua lines.
+func (b *ircBridge) handle(m irc.Message) {
+	nick := m.Nick()
+	switch m.Command {
+	case "001":
+		b.mu.Lock()
+		started := b.started
+		b.started = true
+		b.mu.Unlock()
+		if !started {
+			b.print(startedLine)
+		}
+	case "PRIVMSG":
+		target, text := m.Param(0), m.Param(1)
+		if nick == b.client.Nick() || nick == "" {
+			return
+		}
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+		} else if strings.HasPrefix(text, "\x01") {
+			// Other CTCP requests
+			return
+		}
+		chat := target
+		if !isChannel(target) {
+			chat = nick
+		}
+		id := b.addMsg(ircMsg{
+			chat:    chat,
+			nick:    nick,
+			mask:    m.Prefix,
+			account: m.Tags["account"],
+		})
+		b.print(fmt.Sprintf("[MSG] %v - %v %v %v %v %v", id, chat, chat, nick, nick, text))
+	case "JOIN", "PART":
+		if nick == b.client.Nick() {
+			return
+		}
+		kind := "join"
+		if m.Command == "PART" {
+			kind = "leave"
+		}
+		ch := m.Param(0)
+		b.print(fmt.Sprintf("[EVT] %v %v %v %v %v %v %v", kind, ch, ch, nick, nick, nick, nick))
+	}
+}
+
+// isChannel returns true if target is the name of a channel.
+func isChannel(target string) bool {
+	return target != "" && strings.ContainsAny(target[:1], "#&+!")
+}
+
+func (b *ircBridge) print(line string) {
+	if _, err := fmt.Fprintln(b.lines, line); err != nil {
+		log.Println("irc:", err)
+	}
+}
+
+// addMsg stores m, so it can be answered with replies, and returns its
+// ID.
+func (b *ircBridge) addMsg(m ircMsg) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	id := fmt.Sprint(b.lastID)
+	b.msgs[id] = m
+	b.ids = append(b.ids, id)
+	if len(b.ids) > maxIRCMsgs {
+		delete(b.msgs, b.ids[0])
+		b.ids = b.ids[1:]
+	}
+	return id
+}
+
+func (b *ircBridge) getMsg(id string) (ircMsg, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.msgs[id]
+	return m, ok
+}
+
+// Write translates the commands for the tg client into IRC messages.
+// Replies in channels mention the author of the original message, and
+// media are sent as links. Other commands are ignored. If a message
+// cannot be sent, it returns the number of bytes of the commands already
+// sent.
+func (b *ircBridge) Write(p []byte) (n int, err error) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if err := b.writeLine(strings.TrimSuffix(line, "\n")); err != nil {
+			return n, err
+		}
+		n += len(line)
+	}
+	return n, nil
+}
+
+// writeLine sends the command in line.
+func (b *ircBridge) writeLine(line string) error {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return nil
+	}
+	action, to, arg := fields[0], fields[1], fields[2]
+
+	prefix := ""
+	if strings.HasPrefix(action, "reply") {
+		m, ok := b.getMsg(to)
+		if !ok {
+			log.Printf("irc: unknown message %v\n", to)
+			return nil
+		}
+		to = m.chat
+		if isChannel(m.chat) {
+			prefix = m.nick + ": "
+		}
+		action = strings.Replace(action, "reply", "send", 1)
+	}
+
+	var text string
+	switch action {
+	case "msg", "send":
+		text = arg
+	case "send_photo", "send_audio", "send_document", "send_file":
+		if b.media == nil {
+			log.Printf("irc: cannot send %v: MediaAddr is not set\n", arg)
+			return nil
+		}
+		var err error
+		if text, err = b.media.add(arg); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return b.client.Privmsg(to, prefix+text)
+}
+
+// Close disconnects from IRC.
+func (b *ircBridge) Close() error {
+	err := b.client.Close()
+	b.lines.Close()
+	if b.media != nil {
+		b.media.Close()
+	}
+	return err
+}
+
+// mediaServer serves the files sent by the commands over HTTP. Only the
+// files that have been sent are served, under random names. Files with
+// the same content are served under the same name, so their links can be
+// reused.
+type mediaServer struct {
+	url string
+	srv *http.Server
+
+	mu    sync.Mutex
+	files map[string]string // name -> path
+	names map[string]string // hash -> name
+}
+
+// newMediaServer starts serving on addr the files that are linked under
+// baseURL.
+func newMediaServer(addr, baseURL string) (*mediaServer, error) {
+	if baseURL == "" {
+		baseURL = "http://" + addr + "/"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ms := &mediaServer{
+		url:   strings.TrimSuffix(baseURL, "/") + "/",
+		files: make(map[string]string),
+		names: make(map[string]string),
+	}
+	ms.srv = &http.Server{Handler: ms}
+	go func() {
+		log.Println("IRC media listening on", addr)
+		if err := ms.srv.Serve(l); err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return ms, nil
+}
+
+// add serves the file in path and returns its URL.
+func (ms *mediaServer) add(path string) (string, error) {
+	hash, hashed := mediaStore.Hash(path)
+	if hashed {
+		ms.mu.Lock()
+		name, ok := ms.names[hash]
+		if ok {
+			ms.files[name] = path
+		}
+		ms.mu.Unlock()
+		if ok {
+			return ms.url + name, nil
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b) + filepath.Ext(path)
+
+	ms.mu.Lock()
+	ms.files[name] = path
+	if hashed {
+		ms.names[hash] = name
+	}
+	ms.mu.Unlock()
+	return ms.url + name, nil
+}
+
+func (ms *mediaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// MediaURL can have a path, removed by a proxy
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	ms.mu.Lock()
+	path, ok := ms.files[name]
+	ms.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// Close stops serving the files.
+func (ms *mediaServer) Close() error {
+	return ms.srv.Close()
+}
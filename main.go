@@ -5,23 +5,32 @@
 package main
 
 import (
-	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/jroimartin/tgbot/audit"
 	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/i18n"
+	"github.com/jroimartin/tgbot/store"
+	"github.com/jroimartin/tgbot/utils"
 )
 
 var (
-	// Message format: "[MSG] title from msg".
-	msgRegexp = regexp.MustCompile(`^\[MSG\] ([^ ]+) ([^ ]+) (.*)$`)
+	// Message format: "[MSG] msg_id reply_id chat_id chat from_id from msg".
+	// reply_id is "-" if the message is not a reply.
+	msgRegexp = regexp.MustCompile(`^\[MSG\] ([^ ]+) ([^ ]+) ([^ ]+) ([^ ]+) ([^ ]+) ([^ ]+) (.*)$`)
 
 	// Global configuration.
 	globalConfig config
@@ -29,48 +38,152 @@ var (
 	// Enabled commands.
 	enabledCommands = []commands.Command{}
 
+	// Name of the config section of every command.
+	commandNames = make(map[commands.Command]string)
+
+	// Serializes the execution of commands.
+	dispatchMu sync.Mutex
+
 	// Channel used to receive OS signals.
 	sig = make(chan os.Signal, 1)
 
-	// Communication pipes with the tg client
-	stdoutTg io.ReadCloser
-	stdinTg  io.WriteCloser
+	// Persistent storage shared by the commands
+	db *store.DB
 )
 
+// defaultDataDir is the data directory used when DataDir is not set.
+const defaultDataDir = "tgbot-data"
+
+// startedLine is printed by minoutput.lua once the tg client has finished
+// replaying the binlog and getting the difference.
+const startedLine = "[STARTED]"
+
 // Configuration used for bot and commands.
 type config struct {
-	TgBin     string
-	TgPubKey  string
-	MinOutput string
-	Chats     []string
-	Echo      commands.EchoConfig
-	Quotes    commands.QuotesConfig
-	Ano       commands.AnoConfig
-	Breakfast commands.BreakfastConfig
-	Voice     commands.VoiceConfig
-	Bing      commands.BingConfig
-	Fcdg      commands.FcdgConfig
-	Hater     commands.HaterConfig
-	Tweet     commands.TweetConfig
+	TgBin       string
+	TgPubKey    string
+	MinOutput   string
+	HealthAddr  string
+	DataDir     string
+	Chats       []string
+	Admins      []string
+	Reply       bool
+	BotName     string
+	MentionOnly []string
+	Locale      string
+	LocaleDir   string
+	Templates   map[string]string
+	PanicLimit  int
+	PanicWindow string
+	Account     []accountConfig
+	HTTP        utils.HTTPConfig
+	Media       mediaConfig
+	Echo        commands.EchoConfig
+	Quotes      commands.QuotesConfig
+	Ano         commands.AnoConfig
+	Breakfast   commands.BreakfastConfig
+	Voice       commands.VoiceConfig
+	Bing        commands.BingConfig
+	Fcdg        commands.FcdgConfig
+	Hater       commands.HaterConfig
+	Tweet       commands.TweetConfig
+	Schedule    commands.ScheduleConfig
+	Audit       commands.AuditConfig
+	Lang        commands.LangConfig
 }
 
+const usage = `usage: tgbot [console] config
+       tgbot record|replay dir config`
+
+// Modes of operation.
+const (
+	modeServe   = ""
+	modeConsole = "console"
+	modeRecord  = "record"
+	modeReplay  = "replay"
+)
+
+// Mode of operation and its argument.
+var mode, modeDir string
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "usage: tgbot config")
+	args := os.Args[1:]
+	switch {
+	case len(args) == 2 && args[0] == modeConsole:
+		mode, args = args[0], args[1:]
+	case len(args) == 3 && (args[0] == modeRecord || args[0] == modeReplay):
+		mode, modeDir, args = args[0], args[1], args[2:]
+	}
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(2)
 	}
-	configFile := os.Args[1]
+	configFile := args[0]
 	if _, err := toml.DecodeFile(configFile, &globalConfig); err != nil {
 		log.Fatalln(err)
 	}
-	for i := range globalConfig.Chats {
-		globalConfig.Chats[i] = strings.Replace(globalConfig.Chats[i], " ", "_", -1)
+	if err := initAccounts(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if globalConfig.DataDir == "" {
+		globalConfig.DataDir = defaultDataDir
+	}
+	if mode == modeRecord || mode == modeReplay {
+		// Recordings always start from an empty state
+		dir, err := ioutil.TempDir("", "tgbot-"+mode+"-")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer os.RemoveAll(dir)
+		globalConfig.DataDir = dir
+		globalConfig.Audit.Path = ""
+	}
+	var err error
+	db, err = store.Open(globalConfig.DataDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	peers = newPeerResolver(db.Namespace("peers"))
+
+	if err := initI18n(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := initPanics(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := initHTTP(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := initMedia(); err != nil {
+		log.Fatalln(err)
+	}
+	defer closeMedia()
+
+	if err := initAudit(); err != nil {
+		log.Fatalln(err)
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
 	}
 
 	// Clean shutdown with Ctrl-C
-	signal.Notify(sig, os.Interrupt, os.Kill)
+	signal.Notify(sig, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	if err := listenAndServe(); err != nil {
+	var serve func() error
+	switch mode {
+	case modeConsole:
+		serve = serveConsole
+	case modeRecord:
+		serve = serveRecord
+	case modeReplay:
+		serve = serveReplay
+	default:
+		serve = listenAndServe
+	}
+	if err := serve(); err != nil {
 		log.Fatalln(err)
 	}
 
@@ -78,74 +191,164 @@ func main() {
 }
 
 func listenAndServe() error {
-	// -R: disable readline, -C: disable color, -D: disable output,
-	// -W: send dialog_list on start, -s: lua script
-	cmd := exec.Command(globalConfig.TgBin, "-R", "-C", "-D", "-W",
-		"-s", globalConfig.MinOutput,
-		"-k", globalConfig.TgPubKey)
+	if recorder != nil && len(accounts) > 1 {
+		return errors.New("record: only one account is supported")
+	}
 
-	stdoutTg, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+	for _, a := range accounts {
+		defer a.stop()
+		if err := a.start(); err != nil {
+			return err
+		}
+		status.setAlive(a.Name, true)
 	}
-	stdinTg, err = cmd.StdinPipe()
-	if err != nil {
-		return err
+
+	if globalConfig.HealthAddr != "" {
+		serveHealth(globalConfig.HealthAddr)
 	}
 
-	if err := cmd.Start(); err != nil {
+	if err := startBot(); err != nil {
 		return err
 	}
-
-	// initCommads must be caled after stdinTg and stdoutTg has bee initialized
-	initCommads()
-	defer shutdownCommands()
+	defer stopBot()
 
 	log.Println("Monitoring...")
-	s := bufio.NewScanner(stdoutTg)
+	lines := make(chan accountLine)
+	exits := make(chan accountExit)
+	restarts := make(chan *account)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, a := range accounts {
+		go a.scan(lines, exits, stop)
+	}
+
+	// Clients that exit are restarted after a backoff
+	scheduleRestart := func(a *account) {
+		d := a.nextBackoff()
+		log.Printf("restarting client in %v (account %q)\n", d, a.Name)
+		time.AfterFunc(d, func() {
+			select {
+			case restarts <- a:
+			case <-stop:
+			}
+		})
+	}
+
 readLoop:
 	for {
 		select {
 		case <-sig: // Ctrl-C
 			break readLoop
-		default:
-			if !s.Scan() {
-				break readLoop
+		case e := <-exits:
+			if e.err != nil {
+				log.Printf("account %q: %v\n", e.a.Name, e.err)
+			}
+			status.setAlive(e.a.Name, false)
+			scheduleRestart(e.a)
+		case a := <-restarts:
+			if err := a.restart(); err != nil {
+				log.Printf("account %q: cannot restart client: %v\n", a.Name, err)
+				scheduleRestart(a)
+				continue
 			}
-			handleMsg(s.Text())
+			status.setAlive(a.Name, true)
+			go a.scan(lines, exits, stop)
+		case l := <-lines:
+			if recorder != nil {
+				fmt.Fprintln(recorder.Input, l.line)
+			}
+			handleLine(l.a, l.line)
 		}
 	}
-	if err := s.Err(); err != nil {
-		return err
+	for _, a := range accounts {
+		status.setAlive(a.Name, false)
 	}
+	return nil
+}
 
-	if err := cmd.Wait(); err != nil {
+// startBot initializes the commands and starts the scheduler. It must be
+// called after the output queues of the accounts have been initialized.
+func startBot() error {
+	cmdOut = &replyWriter{w: accountRouter{}}
+	if err := initScheduler(); err != nil {
 		return err
 	}
+	initCommads()
 
+	// Recordings must not depend on time
+	if mode != modeRecord && mode != modeReplay {
+		sched.Start()
+		startConvs()
+	}
 	return nil
 }
 
+// stopBot stops the scheduler and shuts down the commands.
+func stopBot() {
+	sched.Stop()
+	stopConvs()
+	shutdownCommands()
+}
+
 // initCommads enables plugins.
 func initCommads() {
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdEcho(stdinTg, globalConfig.Echo))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdQuotes(stdinTg, globalConfig.Quotes))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdAno(stdinTg, globalConfig.Ano))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdBreakfast(stdinTg, globalConfig.Breakfast))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdVoice(stdinTg, globalConfig.Voice))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdBing(stdinTg, globalConfig.Bing))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdFcdg(stdinTg, globalConfig.Fcdg))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdHater(stdinTg, globalConfig.Hater))
-	enabledCommands = append(enabledCommands,
-		commands.NewCmdTweet(stdinTg, globalConfig.Tweet))
+	enableCommand("Echo", commands.NewCmdEcho(cmdOut, globalConfig.Echo,
+		db.Namespace("echo")))
+	enableCommand("Quotes", commands.NewCmdQuotes(cmdOut, globalConfig.Quotes,
+		db.Namespace("quotes")))
+	enableCommand("Ano", commands.NewCmdAno(cmdOut, globalConfig.Ano,
+		db.Namespace("ano"), mediaStore))
+	enableCommand("Breakfast", commands.NewCmdBreakfast(cmdOut, globalConfig.Breakfast,
+		db.Namespace("breakfast")))
+	enableCommand("Voice", commands.NewCmdVoice(cmdOut, globalConfig.Voice,
+		db.Namespace("voice"), mediaStore))
+	enableCommand("Bing", commands.NewCmdBing(cmdOut, globalConfig.Bing,
+		db.Namespace("bing"), mediaStore))
+	enableCommand("Fcdg", commands.NewCmdFcdg(cmdOut, globalConfig.Fcdg,
+		db.Namespace("fcdg"), mediaStore))
+	enableCommand("Hater", commands.NewCmdHater(cmdOut, globalConfig.Hater,
+		db.Namespace("hater")))
+	enableCommand("Tweet", commands.NewCmdTweet(cmdOut, globalConfig.Tweet,
+		db.Namespace("tweet"), convs))
+	enableCommand("Schedule", commands.NewCmdSchedule(cmdOut, globalConfig.Schedule,
+		db.Namespace("schedule"), sched))
+	enableCommand("Audit", commands.NewCmdAudit(cmdOut, globalConfig.Audit,
+		db.Namespace("audit"), auditLog))
+	enableCommand("Lang", commands.NewCmdLang(cmdOut, globalConfig.Lang,
+		db.Namespace("lang")))
+}
+
+// initHTTP sets the default configuration of the HTTP clients and checks
+// the configuration of every service, so errors such as missing
+// certificates are reported on start.
+func initHTTP() error {
+	if err := utils.SetHTTPDefaults(globalConfig.HTTP); err != nil {
+		return err
+	}
+	services := []struct {
+		name string
+		cfg  utils.HTTPConfig
+	}{
+		{"Quotes", globalConfig.Quotes.HTTP},
+		{"Ano", globalConfig.Ano.HTTP},
+		{"Voice", globalConfig.Voice.HTTP},
+		{"Bing", globalConfig.Bing.HTTP},
+		{"Fcdg", globalConfig.Fcdg.HTTP},
+		{"Tweet", globalConfig.Tweet.HTTP},
+	}
+	for _, s := range services {
+		if _, err := utils.NewClient(s.cfg); err != nil {
+			return fmt.Errorf("%v.HTTP: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// enableCommand adds cmd, configured in the section name of the config,
+// to the enabled commands.
+func enableCommand(name string, cmd commands.Command) {
+	enabledCommands = append(enabledCommands, cmd)
+	commandNames[cmd] = name
 }
 
 // shutdownCommands gracefully shuts down all commands.
@@ -160,57 +363,205 @@ func shutdownCommands() {
 	}
 }
 
-// handleMsg parses the message and calls handleCommand
-// with the title, from and text of the message.
-func handleMsg(msg string) {
-	sm := msgRegexp.FindStringSubmatch(msg)
-	if len(sm) != 4 {
+// handleLine handles a line printed by the tg client of the account a.
+func handleLine(a *account, line string) {
+	if line == startedLine {
+		log.Printf("client started (account %q)\n", a.Name)
+		a.setStarted()
+		return
+	}
+	if strings.HasPrefix(line, "[EVT] ") {
+		handleEvent(a, line)
 		return
 	}
-	title := sm[1]
-	from := sm[2]
-	text := sm[3]
-	log.Printf("DEBUG: title=%v, from=%v, text=%v\n", title, from, text)
+	handleMsg(a, line)
+}
 
-	if !isMonitored(title) {
+// handleMsg parses the message received by the account a and calls
+// handleCommand with it. The IDs of the message are qualified with the
+// name of the account.
+func handleMsg(a *account, msg string) {
+	sm := msgRegexp.FindStringSubmatch(msg)
+	if len(sm) != 8 {
 		return
 	}
+	m := commands.Message{
+		ID:        sm[1],
+		ReplyToID: sm[2],
+		Chat:      sm[3],
+		ChatName:  sm[4],
+		FromID:    sm[5],
+		From:      sm[6],
+		Text:      sm[7],
+	}
+	if m.ReplyToID == "-" {
+		m.ReplyToID = ""
+	}
+	m.ID, m.ReplyToID = a.qualify(m.ID), a.qualify(m.ReplyToID)
+	m.Chat, m.FromID = a.qualify(m.Chat), a.qualify(m.FromID)
+	status.setLastMsg(time.Now())
+	log.Printf("DEBUG: chat=%v (%v), from=%v (%v), text=%v\n",
+		m.ChatName, m.Chat, m.From, m.FromID, m.Text)
 
-	handleCommand(title, from, text)
-}
+	chat := peer{ID: m.Chat, Name: a.qualify(m.ChatName)}
+	from := peer{ID: m.FromID, Name: a.qualify(m.From)}
+	peers.learn(chat)
+	peers.learn(from)
 
-// isMonitored returns true if "title" is monitored.
-func isMonitored(title string) bool {
-	if len(globalConfig.Chats) == 0 {
-		return true
+	if !a.isMonitored(chat) {
+		return
 	}
-	for _, c := range globalConfig.Chats {
-		if c == title {
-			return true
+
+	// Only the messages of the monitored chats are remembered, and
+	// replies must be in the chat of the original message
+	if m.ReplyToID != "" {
+		if r, ok := recentMsgs.get(m.ReplyToID); ok && r.Chat == m.Chat {
+			m.ReplyTo = &r
 		}
 	}
-	return false
+	recentMsgs.add(m)
+
+	// In groups, some commands are only for the bot when it is mentioned
+	m.Private = isPrivate(chat, from)
+	text, mentioned := stripMention(a, m.Text)
+	if !m.Private && !mentioned && needsMention(a, text) {
+		return
+	}
+	m.Text = text
+
+	handleCommand(m)
 }
 
-// handleCommand selects the command and executes it.
-func handleCommand(title, from, text string) {
+// handleCommand selects the command and executes it. Commands receive
+// the chat ID, so they can use it both to answer and to key their state.
+// If Reply is enabled, the answers are sent as replies to m. Texts that
+// do not match any command continue the active conversation of the
+// sender, if any. It returns false if no command matches the text.
+func handleCommand(m commands.Message) bool {
+	acct, _ := accountOf(m.Chat)
+	chat := peer{ID: m.Chat, Name: m.ChatName}
+	from := peer{ID: m.FromID, Name: m.From}
+	title, text := m.Chat, m.Text
+
+	dispatchMu.Lock()
+	defer dispatchMu.Unlock()
+
+	if globalConfig.Reply {
+		cmdOut.setTarget(title, m.ID)
+		defer cmdOut.setTarget("", "")
+	}
+
+	inv := newInvocation(m)
+	commands.SetInvocation(inv)
+	defer commands.SetInvocation(i18n.TemplateData{})
+
 	if strings.HasPrefix(text, "!?") {
 		for _, cmd := range enabledCommands {
-			if cmd.Enabled() && cmd.Syntax() != "" {
-				fmt.Fprintf(stdinTg, "msg %v - %v: %v\n",
-					title, cmd.Syntax(), cmd.Description())
+			if cmd.Enabled() && !panics.isDisabled(cmd) && !acct.disables(cmd) && cmd.Syntax() != "" {
+				fmt.Fprintf(cmdOut, "msg %v - %v: %v\n",
+					title, cmd.Syntax(), tr(title, cmd.Description()))
 			}
 		}
-		return
+		return true
+	}
+
+	if strings.TrimSpace(text) == cancelCmd {
+		c := convs.Cancel(title, from.ID)
+		if c == nil {
+			fmt.Fprintf(cmdOut, "msg %v %v\n", title, tr(title, "nothing to cancel"))
+			return true
+		}
+		abortConv(c, commands.AbortCancel)
+		return true
 	}
 
+	context := fmt.Sprintf("chat=%v (%v), from=%v (%v), text=%q",
+		chat.Name, chat.ID, from.Name, from.ID, text)
+
 	for _, cmd := range enabledCommands {
-		if cmd.Enabled() && cmd.Match(text) {
-			if err := cmd.Run(title, from, text); err != nil {
-				log.Println(err)
-				fmt.Fprintf(stdinTg, "msg %v error: command error\n", title)
+		if cmd.Enabled() && !panics.isDisabled(cmd) && !acct.disables(cmd) && cmd.Match(text) {
+			start := time.Now()
+			if sc, ok := cmd.(commands.ScopedCommand); ok && !sc.Scope().Allows(m.Private) {
+				msg := "error: this command only works in groups"
+				if sc.Scope() == commands.ScopePrivate {
+					msg = "error: this command only works in private chats"
+				}
+				fmt.Fprintf(cmdOut, "msg %v %v\n", title, tr(title, msg))
+				auditInvocation(chat, from, text, start, audit.Denied, nil, "")
+				return true
+			}
+			if ac, ok := cmd.(commands.AdminCommand); ok && ac.AdminOnly() && !acct.isAdmin(m) {
+				log.Printf("%v is not allowed to run %q\n", from.ID, text)
+				fmt.Fprintf(cmdOut, "msg %v %v\n", title, tr(title, "error: permission denied"))
+				auditInvocation(chat, from, text, start, audit.Denied, nil, "")
+				return true
+			}
+			conv := convs.Get(title, from.ID)
+			err := runSafe(cmd, title, context, func() error {
+				if mr, ok := cmd.(commands.MessageRunner); ok {
+					return mr.RunMessage(m)
+				}
+				return cmd.Run(title, from.Name, text)
+			})
+			if err != nil {
+				outcome, ref := reportError(m, inv, err)
+				auditInvocation(chat, from, text, start, outcome, err, ref)
+				return true
 			}
-			return
+			outcome := audit.OK
+			if trackConv(conv, chat, from, text) {
+				outcome = audit.Pending
+			}
+			auditInvocation(chat, from, text, start, outcome, nil, "")
+			return true
+		}
+	}
+
+	if c := convs.Get(title, from.ID); c != nil {
+		continueConv(c, m, inv, context)
+		return true
+	}
+	return false
+}
+
+// reportError logs the error returned by the command in m and tells the
+// user. The message of a commands.UserError is sent as is, other errors
+// get a generic one. Errors caused by the input of the user are answered
+// with their message alone. For the rest, both the log entry and the
+// message include a short reference. It returns the outcome of the
+// invocation and the reference, if any.
+func reportError(m commands.Message, inv i18n.TemplateData, err error) (outcome, ref string) {
+	inv.Error = err.Error()
+	var ue *commands.UserError
+	if errors.As(err, &ue) {
+		inv.Error = ""
+		if ue.Cause != nil {
+			inv.Error = ue.Cause.Error()
 		}
 	}
+	commands.SetInvocation(inv)
+
+	msg := tr(m.Chat, "error: command error")
+	if ue != nil {
+		msg = ue.Message(m.Chat)
+	}
+	if ue != nil && ue.Invalid {
+		fmt.Fprintf(cmdOut, "msg %v %v\n", m.Chat, msg)
+		return audit.Invalid, ""
+	}
+
+	ref = errorRef()
+	log.Printf("error %v: %q: %v\n", ref, m.Text, err)
+	fmt.Fprintf(cmdOut, "msg %v %v\n", m.Chat, tr(m.Chat, "%v (ref %v)", msg, ref))
+	return audit.Error, ref
+}
+
+// errorRef returns a new reference of an error. It does not use the
+// random generator of the commands, which is seeded in replays.
+func errorRef() string {
+	var b [3]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%06x", time.Now().UnixNano()&0xffffff)
+	}
+	return hex.EncodeToString(b[:])
 }
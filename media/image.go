@@ -0,0 +1,393 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/utils"
+)
+
+// A Kind is the way a file must be sent.
+type Kind int
+
+// Kinds of files.
+const (
+	// Document files are sent as they are.
+	Document Kind = iota
+	// Photo files are JPEG or PNG images within the limits of Telegram.
+	Photo
+	// Animation files are animated GIFs.
+	Animation
+)
+
+// Limits of the photos. Bigger images are downsized, and the ones that
+// cannot be shown as photos are sent as documents.
+const (
+	// MaxPhotoSide is the size of the longest side of the photos, in
+	// pixels.
+	MaxPhotoSide = 2560
+	// MaxPhotoSize is the size of the largest photo file.
+	MaxPhotoSize = 10 << 20
+	// MaxPhotoRatio is the largest ratio between the sides of a photo.
+	MaxPhotoRatio = 20
+	// MaxPixels is the number of pixels of the largest image that is
+	// decoded.
+	MaxPixels = 25 << 20
+)
+
+// jpegQuality is the quality of the re-encoded JPEG images.
+const jpegQuality = 90
+
+// Converter is the path of the program used to convert to PNG the images
+// that cannot be decoded (e.g. WebP). It is called with the paths of the
+// image and the PNG file as arguments. If empty, those images are sent as
+// documents.
+var Converter string
+
+// convertTimeout is the time limit of the Converter.
+const convertTimeout = time.Minute
+
+// normalize prepares the image in path to be sent: the format is detected
+// from its content, unsupported formats are converted to PNG, big images
+// are downsized and the EXIF metadata is removed. It returns the path of
+// the resulting file, which replaces the original one, and how it must be
+// sent. Files that are not images are returned unchanged as documents.
+func normalize(path string) (string, Kind, error) {
+	return normalizeImage(path, false)
+}
+
+func normalizeImage(path string, converted bool) (string, Kind, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", Document, err
+	}
+
+	var ext string
+	switch ctype := http.DetectContentType(data); {
+	case ctype == "image/jpeg":
+		ext = ".jpg"
+	case ctype == "image/png":
+		ext = ".png"
+	case ctype == "image/gif":
+		ext = ".gif"
+	case strings.HasPrefix(ctype, "image/") && Converter != "" && !converted:
+		out, err := convert(path)
+		if err != nil {
+			log.Printf("media: cannot convert %v: %v\n", path, err)
+			return path, Document, nil
+		}
+		return normalizeImage(out, true)
+	default:
+		return path, Document, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		return path, Document, nil
+	}
+	long, short := cfg.Width, cfg.Height
+	if short > long {
+		long, short = short, long
+	}
+	if long*short > MaxPixels || long > MaxPhotoRatio*short {
+		return rename(path, ext, Document)
+	}
+
+	var (
+		img         image.Image
+		orientation = 1
+		encode      = long > MaxPhotoSide || len(data) > MaxPhotoSize
+	)
+	switch ext {
+	case ".gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return path, Document, nil
+		}
+		if len(g.Image) > 1 {
+			return rename(path, ext, Animation)
+		}
+		img, ext, encode = g.Image[0], ".png", true
+	case ".jpg":
+		var hasExif bool
+		hasExif, orientation = jpegExif(data)
+		encode = encode || hasExif || cfg.ColorModel == color.CMYKModel
+		if encode {
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		}
+	case ".png":
+		encode = encode || pngExif(data)
+		if encode {
+			img, err = png.Decode(bytes.NewReader(data))
+		}
+	}
+	if err != nil {
+		return path, Document, nil
+	}
+	if !encode {
+		return rename(path, ext, Photo)
+	}
+
+	if long > MaxPhotoSide {
+		img = resize(img, MaxPhotoSide)
+	}
+	img = orient(img, orientation)
+	out, ext, err := encodePhoto(img, ext)
+	if err != nil {
+		return "", Document, err
+	}
+	if len(out) > MaxPhotoSize {
+		return rename(path, ext, Document)
+	}
+
+	f, err := utils.TempFile(filepath.Dir(path), "", ext)
+	if err != nil {
+		return "", Document, err
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", Document, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", Document, err
+	}
+	os.Remove(path)
+	return f.Name(), Photo, nil
+}
+
+// rename sets the extension ext to the file in path.
+func rename(path, ext string, kind Kind) (string, Kind, error) {
+	if filepath.Ext(path) == ext {
+		return path, kind, nil
+	}
+	newPath := strings.TrimSuffix(path, filepath.Ext(path)) + ext
+	if err := os.Rename(path, newPath); err != nil {
+		return "", Document, err
+	}
+	return newPath, kind, nil
+}
+
+// convert converts the image in path to PNG using the Converter and
+// returns the path of the PNG file, which replaces the original one.
+func convert(path string) (string, error) {
+	f, err := utils.TempFile(filepath.Dir(path), "", ".png")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), convertTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, Converter, path, f.Name()).CombinedOutput(); err != nil {
+		os.Remove(f.Name())
+		if len(out) > 0 {
+			return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+		}
+		return "", err
+	}
+	os.Remove(path)
+	return f.Name(), nil
+}
+
+// encodePhoto encodes img in the format of the extension ext, falling back
+// to JPEG if a PNG is too big. It returns the encoded image and its
+// extension.
+func encodePhoto(img image.Image, ext string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if ext == ".png" {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		if buf.Len() <= MaxPhotoSize {
+			return buf.Bytes(), ext, nil
+		}
+		buf.Reset()
+	}
+
+	// JPEG has no transparency
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ".jpg", nil
+}
+
+// resize returns img downsized so its longest side is max pixels. Every
+// pixel is the average of the pixels of img it covers.
+func resize(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*h/dh, (dy+1)*h/dh
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*w/dw, (dx+1)*w/dw
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					cr, cg, cb, ca := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// orient returns img transformed as indicated by the EXIF orientation o,
+// so it is shown right once the EXIF metadata is removed.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// jpegExif returns whether the JPEG image in data has EXIF metadata and
+// its orientation, which is 1 if it is not set.
+func jpegExif(data []byte) (hasExif bool, orientation int) {
+	orientation = 1
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda { // Start of scan
+			break
+		}
+		// The length includes its own 2 bytes
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			hasExif = true
+			if o := exifOrientation(seg[6:]); o != 0 {
+				orientation = o
+			}
+		}
+		i += 2 + n
+	}
+	return hasExif, orientation
+}
+
+// exifOrientation returns the orientation set in the TIFF structure of an
+// EXIF segment, or 0 if it is not set.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			return int(bo.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// pngExif returns whether the PNG image in data has EXIF metadata.
+func pngExif(data []byte) bool {
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			return true
+		case "IDAT":
+			// eXIf must precede the image data
+			return false
+		}
+		if n < 0 || n > len(data) {
+			return false
+		}
+		i += 12 + n
+	}
+	return false
+}
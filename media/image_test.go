@@ -0,0 +1,186 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exifTIFF returns the TIFF structure of an EXIF segment with the given
+// orientation.
+func exifTIFF(bo binary.ByteOrder, orientation uint16) []byte {
+	var b bytes.Buffer
+	if bo == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	binary.Write(&b, bo, uint16(42))
+	binary.Write(&b, bo, uint32(8)) // offset of IFD0
+	binary.Write(&b, bo, uint16(2)) // entries
+	// An unrelated entry (ImageWidth) and the orientation
+	binary.Write(&b, bo, []uint16{0x0100, 3})
+	binary.Write(&b, bo, uint32(1))
+	binary.Write(&b, bo, []uint16{100, 0})
+	binary.Write(&b, bo, []uint16{0x0112, 3})
+	binary.Write(&b, bo, uint32(1))
+	binary.Write(&b, bo, []uint16{orientation, 0})
+	binary.Write(&b, bo, uint32(0)) // next IFD
+	return b.Bytes()
+}
+
+// withExif returns the JPEG image j with an APP1 segment with tiff.
+func withExif(j, tiff []byte) []byte {
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(seg)+2))
+	out := append([]byte{}, j[:2]...)
+	out = append(out, app1...)
+	out = append(out, seg...)
+	return append(out, j[2:]...)
+}
+
+func testJPEG(t *testing.T) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewRGBA(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestJpegExif(t *testing.T) {
+	j := testJPEG(t)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		exif        bool
+		orientation int
+	}{
+		{"plain", j, false, 1},
+		{"big endian", withExif(j, exifTIFF(binary.BigEndian, 6)), true, 6},
+		{"little endian", withExif(j, exifTIFF(binary.LittleEndian, 8)), true, 8},
+		{"no orientation", withExif(j, []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")), true, 1},
+		{"bad tiff", withExif(j, []byte("XX")), true, 1},
+		{"bad ifd offset", withExif(j, []byte("MM\x00\x2a\xff\xff\xff\xf0")), true, 1},
+		{"truncated ifd", withExif(j, []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x05\x01\x12")), true, 1},
+		// Malformed segments must not panic
+		{"zero length", []byte("\xff\xd8\xff\xe1\x00\x00Exif\x00\x00MM"), false, 1},
+		{"length 1", []byte("\xff\xd8\xff\xe1\x00\x01Exif\x00\x00MM"), false, 1},
+		{"length too big", []byte("\xff\xd8\xff\xe1\xff\xffExif"), false, 1},
+		{"truncated", []byte("\xff\xd8\xff"), false, 1},
+		{"empty", nil, false, 1},
+	}
+	for _, tt := range tests {
+		exif, o := jpegExif(tt.data)
+		if exif != tt.exif || o != tt.orientation {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, exif, o, tt.exif, tt.orientation)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	for o := uint16(1); o <= 8; o++ {
+		if got := exifOrientation(exifTIFF(binary.BigEndian, o)); got != int(o) {
+			t.Errorf("orientation %v: got %v", o, got)
+		}
+	}
+	for _, tiff := range [][]byte{nil, []byte("MM"), []byte("MM\x00\x2a\x00\x00\x00\x08")} {
+		if got := exifOrientation(tiff); got != 0 {
+			t.Errorf("exifOrientation(%q) = %v, want 0", tiff, got)
+		}
+	}
+}
+
+// pngChunk returns a PNG chunk with an invalid CRC, which pngExif does
+// not check.
+func pngChunk(typ string, data []byte) []byte {
+	c := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	c = append(c, typ...)
+	c = append(c, data...)
+	return append(c, 0, 0, 0, 0)
+}
+
+func TestPngExif(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	p := b.Bytes()
+	ihdr := 8 + 12 + 13 // signature and IHDR chunk
+
+	withChunk := func(c []byte) []byte {
+		out := append([]byte{}, p[:ihdr]...)
+		out = append(out, c...)
+		return append(out, p[ihdr:]...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"plain", p, false},
+		{"exif", withChunk(pngChunk("eXIf", []byte("MM\x00\x2a"))), true},
+		{"other chunk", withChunk(pngChunk("tEXt", []byte("a\x00b"))), false},
+		// eXIf after the image data is ignored
+		{"exif after IDAT", append(append([]byte{}, p...), pngChunk("eXIf", nil)...), false},
+		{"huge length", withChunk([]byte("\xff\xff\xff\xffeXIf")), true},
+		{"bad length", append(append([]byte{}, p[:ihdr]...), "\x7f\xff\xff\xfftEXt"...), false},
+		{"truncated", p[:10], false},
+	}
+	for _, tt := range tests {
+		if got := pngExif(tt.data); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 image with a red pixel at the top left corner
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+
+	// Position of the red pixel once oriented
+	tests := []struct {
+		o    int
+		w, h int
+		x, y int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+		{9, 3, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		img := orient(src, tt.o)
+		b := img.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %v: got %vx%v, want %vx%v", tt.o, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				isRed := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)) == red
+				if isRed != (x == tt.x && y == tt.y) {
+					t.Errorf("orientation %v: pixel %v,%v red=%v", tt.o, x, y, isRed)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package media implements the store of the media files sent by the bot
+// commands. Files are kept in one directory, limited in size and age, and
+// the least recently used ones are removed when the limits are exceeded.
+// Files referenced by the commands waiting to be sent are never removed.
+// Files with the same content are stored once, and the store remembers the
+// files recently sent to every chat, so commands can avoid repeating them.
+// Images are normalized when they are added, so they can be sent as photos.
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/utils"
+)
+
+// Defaults of the limits of the store.
+const (
+	DefaultMaxSize = 512 << 20
+	DefaultMaxAge  = 24 * time.Hour
+)
+
+// Names of the files of the store. The marker file is created in the
+// directories of the stores, and only the files with the prefix are
+// removed. Files are downloaded to the staging directory before they are
+// added.
+const (
+	markerFile = ".tgbot-media"
+	filePrefix = "media-"
+	stagingDir = ".staging"
+)
+
+// MinKeep is the time files are kept after being used, so the clients
+// have time to upload them after reading the command that sends them.
+const MinKeep = time.Minute
+
+// RecentSize is the number of files remembered per chat by Sent.
+const RecentSize = 50
+
+// A file is a file in the store.
+type file struct {
+	path    string
+	hash    string
+	kind    Kind
+	size    int64
+	created time.Time
+	used    time.Time
+	refs    int
+}
+
+// A Store holds the media files sent by the commands.
+type Store struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	files  map[string]*file    // path -> file
+	hashes map[string]*file    // hash -> file
+	recent map[string][]string // chat -> hashes
+	size   int64
+}
+
+// Open opens the store in dir, creating the directory if it does not
+// exist. Directories that are not empty must have been created by Open,
+// so the files of others are never removed. The files left in dir by
+// previous runs are removed, so dir must not be shared with other
+// processes. The least recently used files are removed when the store
+// exceeds maxSize bytes, and files older than maxAge are removed as well.
+// Zero limits take the default values.
+func Open(dir string, maxSize int64, maxAge time.Duration) (*Store, error) {
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := filepath.Join(dir, markerFile)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		if len(infos) > 0 {
+			return nil, fmt.Errorf("media: %v is not empty and is not a media directory", dir)
+		}
+		if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Leftovers from crashed runs
+	n := 0
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), filePrefix) {
+			os.Remove(filepath.Join(dir, fi.Name()))
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("media: removed %v files left in %v\n", n, dir)
+	}
+	staging := filepath.Join(dir, stagingDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(staging, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		files:   make(map[string]*file),
+		hashes:  make(map[string]*file),
+		recent:  make(map[string][]string),
+	}, nil
+}
+
+// Dir returns the directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Download downloads targetURL with the client c to a new file with the
+// extension ext (or the one of the content, if empty) and returns its
+// path. If the store already has a file with the same content, the path of
+// that file is returned instead.
+func (s *Store) Download(c *http.Client, ext, targetURL string) (path string, err error) {
+	path, err = utils.Download(c, filepath.Join(s.dir, stagingDir), ext, targetURL)
+	if err != nil {
+		return "", err
+	}
+	if path, err = s.Add(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Add moves the file in path, which must be in the same file system, to
+// the store and returns its new path. The files that exceed the limits
+// are removed. If the store already has a file with the same content, the
+// file in path is removed and the path of the existing one is returned.
+// Images are normalized first. On error, the file is removed.
+func (s *Store) Add(path string) (string, error) {
+	normalized, kind, err := normalize(path)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	path = normalized
+	fi, err := os.Stat(path)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	h, err := hashFile(path)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.hashes[h]; ok && f.path != path {
+		os.Remove(path)
+		f.used = now
+		return f.path, nil
+	}
+	if filepath.Dir(path) != s.dir || !strings.HasPrefix(filepath.Base(path), filePrefix) {
+		newPath := filepath.Join(s.dir, filePrefix+filepath.Base(path))
+		if err := os.Rename(path, newPath); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		path = newPath
+	}
+	if f, ok := s.files[path]; ok {
+		s.size -= f.size
+		delete(s.hashes, f.hash)
+	}
+	f := &file{
+		path:    path,
+		hash:    h,
+		kind:    kind,
+		size:    fi.Size(),
+		created: now,
+		used:    now,
+	}
+	s.files[path] = f
+	s.hashes[h] = f
+	s.size += fi.Size()
+	s.evictLocked(now)
+	return path, nil
+}
+
+// hashFile returns the hash of the content of the file in path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash returns the hash of the content of the file in path. It returns
+// false if the file is not in the store.
+func (s *Store) Hash(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok {
+		return "", false
+	}
+	return f.hash, true
+}
+
+// Kind returns how the file in path must be sent. Files that are not in
+// the store are documents.
+func (s *Store) Kind(path string) Kind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.files[path]; ok {
+		return f.kind
+	}
+	return Document
+}
+
+// Sent records that the file in path has been sent to chat. Only the last
+// RecentSize files of every chat are remembered.
+func (s *Store) Sent(chat, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok {
+		return
+	}
+	hashes := s.recent[chat]
+	for i, h := range hashes {
+		if h == f.hash {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			break
+		}
+	}
+	hashes = append(hashes, f.hash)
+	if len(hashes) > RecentSize {
+		hashes = hashes[len(hashes)-RecentSize:]
+	}
+	s.recent[chat] = hashes
+}
+
+// Recent returns true if a file with the content of the one in path has
+// been sent recently to chat. Files are remembered even after they are
+// removed from the store.
+func (s *Store) Recent(chat, path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok {
+		return false
+	}
+	for _, h := range s.recent[chat] {
+		if h == f.hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Ref marks the file in path as used until Unref is called. It returns
+// false if the file is not in the store.
+func (s *Store) Ref(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok {
+		return false
+	}
+	f.refs++
+	f.used = time.Now()
+	return true
+}
+
+// Unref releases a reference taken with Ref.
+func (s *Store) Unref(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[path]
+	if !ok || f.refs == 0 {
+		return
+	}
+	f.refs--
+	f.used = time.Now()
+}
+
+// Evict removes the files that exceed the limits of the store.
+func (s *Store) Evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictLocked(time.Now())
+}
+
+// evictLocked removes the files older than maxAge and, while the store is
+// too big, the least recently used ones. Referenced files and the ones
+// used during the last MinKeep are kept.
+func (s *Store) evictLocked(now time.Time) {
+	var files []*file
+	for _, f := range s.files {
+		if f.refs > 0 || now.Sub(f.used) < MinKeep {
+			continue
+		}
+		if now.Sub(f.created) > s.maxAge {
+			s.removeLocked(f)
+			continue
+		}
+		files = append(files, f)
+	}
+	if s.size <= s.maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.Before(files[j].used)
+	})
+	for _, f := range files {
+		if s.size <= s.maxSize {
+			break
+		}
+		s.removeLocked(f)
+	}
+}
+
+func (s *Store) removeLocked(f *file) {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		log.Println("media:", err)
+	}
+	s.size -= f.size
+	delete(s.files, f.path)
+	if s.hashes[f.hash] == f {
+		delete(s.hashes, f.hash)
+	}
+}
+
+// Close removes all the files of the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.files {
+		s.removeLocked(f)
+	}
+	return os.RemoveAll(filepath.Join(s.dir, stagingDir))
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package media
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenForeignDir(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "bot.db")
+	if err := ioutil.WriteFile(db, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(dir, 0, 0); err == nil {
+		t.Fatal("Open of a directory with foreign files: got nil error")
+	}
+	if _, err := os.Stat(db); err != nil {
+		t.Errorf("foreign file removed: %v", err)
+	}
+}
+
+func TestOpenLeftovers(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "media")
+	s, err := Open(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := addFile(t, s, "a.mp3", "sound")
+	if filepath.Dir(added) != dir || !strings.HasPrefix(filepath.Base(added), filePrefix) {
+		t.Errorf("added file %v is not in the store", added)
+	}
+
+	// Files of others added later are kept
+	other := filepath.Join(dir, "other.txt")
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(added); !os.IsNotExist(err) {
+		t.Errorf("leftover %v not removed: %v", added, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("foreign file removed: %v", err)
+	}
+}
+
+// addFile adds to s a new file with the given name and content.
+func addFile(t *testing.T, s *Store, name, content string) string {
+	t.Helper()
+	path := filepath.Join(s.Dir(), stagingDir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.Add(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return added
+}
+
+func TestAddDuplicate(t *testing.T) {
+	s, err := Open(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a := addFile(t, s, "a.mp3", "sound")
+	b := addFile(t, s, "b.mp3", "sound")
+	c := addFile(t, s, "c.mp3", "other sound")
+	if a != b {
+		t.Errorf("duplicated file stored twice: %v, %v", a, b)
+	}
+	if a == c {
+		t.Errorf("different files stored once: %v", a)
+	}
+	if s.Kind(a) != Document {
+		t.Errorf("kind of %v: got %v, want %v", a, s.Kind(a), Document)
+	}
+
+	s.Sent("chat", a)
+	if !s.Recent("chat", b) || s.Recent("chat", c) || s.Recent("other", a) {
+		t.Error("wrong recent files")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/media"
+)
+
+// mediaTick is how often the media files older than MaxAge are removed.
+const mediaTick = 10 * time.Minute
+
+// Configuration of the media store.
+type mediaConfig struct {
+	Dir     string // defaults to DataDir/media
+	MaxSize int    // in MB
+	MaxAge  string
+
+	// Converter converts to PNG the images in formats that cannot be
+	// decoded, like WebP (e.g. a script that runs ImageMagick).
+	Converter string
+}
+
+var (
+	// Store of the media files sent by the commands.
+	mediaStore *media.Store
+
+	mediaStop chan struct{}
+)
+
+// initMedia opens the media store and starts removing the old files
+// periodically.
+func initMedia() error {
+	cfg := globalConfig.Media
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(globalConfig.DataDir, "media")
+	}
+	var maxAge time.Duration
+	if cfg.MaxAge != "" {
+		d, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid Media.MaxAge: %v", err)
+		}
+		maxAge = d
+	}
+
+	media.Converter = cfg.Converter
+
+	var err error
+	mediaStore, err = media.Open(cfg.Dir, int64(cfg.MaxSize)<<20, maxAge)
+	if err != nil {
+		return err
+	}
+
+	mediaStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(mediaTick)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				mediaStore.Evict()
+			}
+		}
+	}(mediaStop)
+	return nil
+}
+
+// closeMedia stops removing old files and removes all the media files.
+func closeMedia() {
+	close(mediaStop)
+	mediaStore.Close()
+}
+
+// mediaPath returns the path of the file sent by the tg client command in
+// line, if any.
+func mediaPath(line string) (string, bool) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+	if len(fields) != 3 || fields[0] == "msg" || fields[0] == "reply" {
+		return "", false
+	}
+	for action, reply := range replyActions {
+		if fields[0] == action || fields[0] == reply {
+			return fields[2], true
+		}
+	}
+	return "", false
+}
+
+// refMedia references the media files sent by the commands in p, so they
+// are not removed while they are queued.
+func refMedia(p []byte) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if path, ok := mediaPath(line); ok {
+			mediaStore.Ref(path)
+		}
+	}
+}
+
+// sentMedia records the media files sent by the commands in p to every
+// chat, so the commands can avoid sending them again.
+func sentMedia(p []byte) {
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if path, ok := mediaPath(line); ok && strings.HasPrefix(fields[0], "send_") {
+			mediaStore.Sent(fields[1], path)
+		}
+	}
+}
+
+// mediaReleaser releases the media files referenced by refMedia once the
+// commands that send them are written to w.
+type mediaReleaser struct {
+	w io.Writer
+}
+
+func (mr mediaReleaser) Write(p []byte) (n int, err error) {
+	n, err = mr.w.Write(p)
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if path, ok := mediaPath(line); ok {
+			mediaStore.Unref(path)
+		}
+	}
+	return n, err
+}
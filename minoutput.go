@@ -0,0 +1,79 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// minOutputVersion is the version of the lines printed by minoutput.lua
+// that the bot understands. It must match protocol_version in the
+// script and be increased with every incompatible change of the format
+// of the [MSG] and [EVT] lines.
+const minOutputVersion = 1
+
+// minOutputScript is the minoutput.lua script shipped with the bot.
+//
+//go:embed scripts/minoutput.lua
+var minOutputScript []byte
+
+// protoVersionRegexp extracts protocol_version from minoutput.lua.
+var protoVersionRegexp = regexp.MustCompile(`(?m)^protocol_version = (\d+)`)
+
+// checkMinOutput returns an error if script does not use the protocol
+// version expected by the bot.
+func checkMinOutput(script []byte) error {
+	sm := protoVersionRegexp.FindSubmatch(script)
+	if sm == nil {
+		return fmt.Errorf("minoutput: protocol_version not found, want %v", minOutputVersion)
+	}
+	v, err := strconv.Atoi(string(sm[1]))
+	if err != nil {
+		return fmt.Errorf("minoutput: invalid protocol_version: %v", err)
+	}
+	if v != minOutputVersion {
+		return fmt.Errorf("minoutput: protocol_version is %v, want %v", v, minOutputVersion)
+	}
+	return nil
+}
+
+// minOutputFile is the name of the copy of the embedded script written
+// to DataDir.
+const minOutputFile = "minoutput.lua"
+
+// minOutputPath returns the path of the lua script passed to the tg
+// client. If minOutput is set, it is used. Otherwise, the embedded script
+// is written to dataDir, unless it is already there, so no copy is left
+// behind when the bot exits abruptly.
+func minOutputPath(minOutput, dataDir string) (string, error) {
+	if minOutput != "" {
+		script, err := ioutil.ReadFile(minOutput)
+		if err != nil {
+			return "", err
+		}
+		if err := checkMinOutput(script); err != nil {
+			return "", fmt.Errorf("%v: %v", minOutput, err)
+		}
+		return minOutput, nil
+	}
+
+	if err := checkMinOutput(minOutputScript); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dataDir, minOutputFile)
+	if script, err := ioutil.ReadFile(path); err == nil && bytes.Equal(script, minOutputScript) {
+		return path, nil
+	}
+	if err := ioutil.WriteFile(path, minOutputScript, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
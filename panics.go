@@ -0,0 +1,118 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/commands"
+)
+
+// Defaults of the panic limits.
+const (
+	defaultPanicLimit  = 3
+	defaultPanicWindow = 10 * time.Minute
+)
+
+// Commands that panicked recently and the ones disabled because of it.
+var panics = &panicTracker{
+	limit:    defaultPanicLimit,
+	window:   defaultPanicWindow,
+	times:    make(map[commands.Command][]time.Time),
+	disabled: make(map[commands.Command]bool),
+}
+
+// initPanics sets the panic limits from the config.
+func initPanics() error {
+	if globalConfig.PanicLimit != 0 {
+		panics.limit = globalConfig.PanicLimit
+	}
+	if globalConfig.PanicWindow != "" {
+		d, err := time.ParseDuration(globalConfig.PanicWindow)
+		if err != nil {
+			return fmt.Errorf("invalid PanicWindow: %v", err)
+		}
+		panics.window = d
+	}
+	return nil
+}
+
+// panicTracker disables the commands that panic limit times within
+// window.
+type panicTracker struct {
+	limit  int
+	window time.Duration
+
+	mu       sync.Mutex
+	times    map[commands.Command][]time.Time
+	disabled map[commands.Command]bool
+}
+
+// record records a panic of cmd at now. It returns true if cmd has
+// panicked too many times within the window and has been disabled.
+func (pt *panicTracker) record(cmd commands.Command, now time.Time) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	var recent []time.Time
+	for _, t := range pt.times[cmd] {
+		if now.Sub(t) < pt.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	pt.times[cmd] = recent
+
+	if len(recent) >= pt.limit && !pt.disabled[cmd] {
+		pt.disabled[cmd] = true
+		return true
+	}
+	return false
+}
+
+// isDisabled returns true if cmd has been disabled after panicking.
+func (pt *panicTracker) isDisabled(cmd commands.Command) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	return pt.disabled[cmd]
+}
+
+// A panicError is returned by runSafe when f panics.
+type panicError struct {
+	val interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.val)
+}
+
+// runSafe calls f, which runs cmd for the message described by context,
+// and recovers from its panics. The stack is logged and the panic is
+// returned as an error. If cmd panics too often, it is disabled and the
+// chat is told.
+func runSafe(cmd commands.Command, chat, context string, f func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		log.Printf("panic running %q: %v: %v\n%s", cmd.Syntax(), context, r, debug.Stack())
+		err = &panicError{val: r}
+
+		if panics.record(cmd, time.Now()) {
+			log.Printf("disabling %q: too many panics\n", cmd.Syntax())
+			if chat != "" {
+				fmt.Fprintf(cmdOut, "msg %v %v\n", chat,
+					tr(chat, "%v has been disabled after failing repeatedly", cmd.Syntax()))
+			}
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/tgbot/commands"
+)
+
+// panicCmd is a command whose runs panic.
+type panicCmd struct {
+	commands.Command
+}
+
+func (cmd *panicCmd) Syntax() string {
+	return "!panic"
+}
+
+func newPanicTracker(limit int, window time.Duration) *panicTracker {
+	return &panicTracker{
+		limit:    limit,
+		window:   window,
+		times:    make(map[commands.Command][]time.Time),
+		disabled: make(map[commands.Command]bool),
+	}
+}
+
+// setTestPanics sets panics to a new tracker and cmdOut to a buffer for
+// the duration of the test.
+func setTestPanics(t *testing.T, limit int, window time.Duration) *bytes.Buffer {
+	oldPanics, oldOut := panics, cmdOut
+	var buf bytes.Buffer
+	panics = newPanicTracker(limit, window)
+	cmdOut = &replyWriter{w: &buf}
+	t.Cleanup(func() {
+		panics, cmdOut = oldPanics, oldOut
+	})
+	return &buf
+}
+
+func TestPanicTracker(t *testing.T) {
+	pt := newPanicTracker(3, 10*time.Minute)
+	cmd, other := &panicCmd{}, &panicCmd{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		cmd      commands.Command
+		after    time.Duration
+		disable  bool
+		disabled bool
+	}{
+		{cmd, 0, false, false},
+		{cmd, time.Minute, false, false},
+		// The panics of other commands do not count
+		{other, 2 * time.Minute, false, false},
+		// The first panic is out of the window
+		{cmd, 10 * time.Minute, false, false},
+		{cmd, 10*time.Minute + 30*time.Second, true, true},
+		// Disabled once
+		{cmd, 12 * time.Minute, false, true},
+	}
+	for i, tt := range tests {
+		if got := pt.record(tt.cmd, start.Add(tt.after)); got != tt.disable {
+			t.Errorf("%v: record: got %v, want %v", i, got, tt.disable)
+		}
+		if got := pt.isDisabled(cmd); got != tt.disabled {
+			t.Errorf("%v: isDisabled: got %v, want %v", i, got, tt.disabled)
+		}
+	}
+	if pt.isDisabled(other) {
+		t.Error("other command disabled")
+	}
+}
+
+func TestRunSafe(t *testing.T) {
+	buf := setTestPanics(t, 2, time.Hour)
+	cmd := &panicCmd{}
+
+	// Errors are returned as is
+	want := errors.New("fail")
+	if err := runSafe(cmd, "chat#id1", "test", func() error { return want }); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	// Panics are recovered and returned as errors
+	for i := 0; i < 2; i++ {
+		err := runSafe(cmd, "chat#id1", "test", func() error { panic("boom") })
+		if pe, ok := err.(*panicError); !ok || pe.val != "boom" {
+			t.Fatalf("got %#v, want a panicError", err)
+		}
+	}
+	if !panics.isDisabled(cmd) {
+		t.Error("the command was not disabled")
+	}
+	want2 := "msg chat#id1 !panic has been disabled after failing repeatedly\n"
+	if got := buf.String(); got != want2 {
+		t.Errorf("got %q, want %q", got, want2)
+	}
+
+	// Panics without chat are not told
+	buf.Reset()
+	other := &panicCmd{}
+	for i := 0; i < 2; i++ {
+		runSafe(other, "", "test", func() error { panic("boom") })
+	}
+	if !panics.isDisabled(other) || buf.Len() != 0 {
+		t.Errorf("no chat: disabled %v, output %q", panics.isDisabled(other), buf)
+	}
+}
+
+func TestRunSafeWindow(t *testing.T) {
+	setTestPanics(t, 2, 50*time.Millisecond)
+	cmd := &panicCmd{}
+
+	for i := 0; i < 3; i++ {
+		runSafe(cmd, "", "test", func() error { panic("boom") })
+		time.Sleep(100 * time.Millisecond)
+	}
+	if panics.isDisabled(cmd) {
+		t.Error("disabled by panics out of the window")
+	}
+}
+
+func TestInitPanics(t *testing.T) {
+	setTestPanics(t, defaultPanicLimit, defaultPanicWindow)
+	old := globalConfig
+	t.Cleanup(func() { globalConfig = old })
+
+	globalConfig.PanicLimit, globalConfig.PanicWindow = 0, ""
+	if err := initPanics(); err != nil || panics.limit != 3 || panics.window != 10*time.Minute {
+		t.Errorf("defaults: got %v, %v, %v", panics.limit, panics.window, err)
+	}
+	globalConfig.PanicLimit, globalConfig.PanicWindow = 5, "1h"
+	if err := initPanics(); err != nil || panics.limit != 5 || panics.window != time.Hour {
+		t.Errorf("got %v, %v, %v", panics.limit, panics.window, err)
+	}
+	globalConfig.PanicWindow = "10"
+	if err := initPanics(); err == nil || !strings.Contains(err.Error(), "PanicWindow") {
+		t.Errorf("invalid window: got %v", err)
+	}
+}
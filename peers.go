@@ -0,0 +1,158 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+// A peer is a chat or a user. ID is stable (e.g. chat#id1234) and can be
+// used as peer in the tg client commands. Name is the print name, which
+// changes when the chat or user is renamed.
+type peer struct {
+	ID   string
+	Name string
+}
+
+// noName is the name printed by minoutput.lua for peers without name.
+const noName = "-"
+
+// isPeerID returns true if ref is a peer ID instead of a name.
+func isPeerID(ref string) bool {
+	return strings.Contains(ref, "#id")
+}
+
+// Kinds of peers. Chats and users have separate names, so users cannot
+// take the names of chats.
+const (
+	chatPeer = "chat"
+	userPeer = "user"
+)
+
+// peerKind returns the kind of the peer with the given ID. IRC users are
+// identified by their nick, which has no "#".
+func peerKind(id string) string {
+	_, id = accountOf(id)
+	if strings.HasPrefix(id, "user#") || !strings.Contains(id, "#") {
+		return userPeer
+	}
+	return chatPeer
+}
+
+// peerResolver maps the names of chats and users to their IDs. A name is
+// bound to the ID of the first peer of its kind seen with it, so config
+// entries that reference chats by name keep working after the chat is
+// renamed.
+type peerResolver struct {
+	ns store.Namespace
+
+	mu    sync.Mutex
+	names map[string]string // kind:name -> ID
+}
+
+// Resolver of names to peer IDs.
+var peers *peerResolver
+
+// newPeerResolver returns a peerResolver that persists the known names in
+// ns.
+func newPeerResolver(ns store.Namespace) *peerResolver {
+	return &peerResolver{
+		ns:    ns,
+		names: make(map[string]string),
+	}
+}
+
+// learn binds the name of p to its ID if the name is not already bound
+// to a peer of the same kind. Names that look like peer IDs and missing
+// names are never bound. The first time a chat is seen, the data stored
+// by the commands under its name is moved to its ID.
+func (r *peerResolver) learn(p peer) {
+	if _, name := accountOf(p.Name); name == "" || name == noName ||
+		p.Name == p.ID || isPeerID(p.Name) {
+		return
+	}
+	kind := peerKind(p.ID)
+	key := kind + ":" + p.Name
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.names[key]; ok {
+		return
+	}
+	var id string
+	found, err := r.ns.Global().Get(key, &id)
+	if err != nil {
+		log.Println("cannot resolve peer:", err)
+		return
+	}
+	if found {
+		r.names[key] = id
+		return
+	}
+
+	if err := r.ns.Global().Put(key, p.ID); err != nil {
+		log.Println("cannot store peer:", err)
+		return
+	}
+	r.names[key] = p.ID
+	if kind != chatPeer {
+		return
+	}
+	if err := db.RenameChat(p.Name, p.ID); err != nil {
+		log.Println("cannot migrate chat data:", err)
+	}
+}
+
+// resolve returns the ID bound to ref if it is a known name of a chat or,
+// otherwise, of a user. If it is not, ref is returned.
+func (r *peerResolver) resolve(ref string) string {
+	if id, ok := r.resolveKind(chatPeer, ref); ok {
+		return id
+	}
+	id, _ := r.resolveKind(userPeer, ref)
+	return id
+}
+
+// resolveKind returns the ID bound to ref if it is a known name of a
+// peer of the given kind. Otherwise, ref and false are returned.
+func (r *peerResolver) resolveKind(kind, ref string) (string, bool) {
+	if isPeerID(ref) {
+		return ref, false
+	}
+	key := kind + ":" + ref
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.names[key]; ok {
+		return id, true
+	}
+	var id string
+	found, err := r.ns.Global().Get(key, &id)
+	if err != nil {
+		log.Println("cannot resolve peer:", err)
+		return ref, false
+	}
+	if !found {
+		return ref, false
+	}
+	r.names[key] = id
+	return id, true
+}
+
+// matches returns true if ref (an ID or a name) references p. Names only
+// reference peers of their kind.
+func (r *peerResolver) matches(ref string, p peer) bool {
+	if ref == p.ID {
+		return true
+	}
+	id, ok := r.resolveKind(peerKind(p.ID), ref)
+	return ok && id == p.ID
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+// setTestDB sets db to a new database for the duration of the test.
+func setTestDB(t *testing.T, dir string) *store.DB {
+	t.Helper()
+	d, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = d
+	t.Cleanup(func() {
+		d.Close()
+		db = old
+	})
+	return d
+}
+
+func setTestAccounts(t *testing.T, a ...*account) {
+	old := accounts
+	accounts = a
+	t.Cleanup(func() { accounts = old })
+}
+
+func TestPeerResolver(t *testing.T) {
+	setTestAccounts(t, &account{})
+	d := setTestDB(t, t.TempDir())
+	r := newPeerResolver(d.Namespace("peers"))
+
+	for _, p := range []peer{
+		{"chat#id1", "Team"},
+		{"chat#id2", "Team"}, // name already taken
+		{"user#id5", "alice"},
+		{"user#id6", "Team"}, // user names are separate
+		{"user#id7", "-"},
+		{"user#id8", ""},
+		{"chat#id3", "chat#id9"},
+		{"#irc", "#irc"},
+	} {
+		r.learn(p)
+	}
+
+	resolveTests := []struct {
+		ref, want string
+	}{
+		{"Team", "chat#id1"},
+		{"alice", "user#id5"},
+		{"chat#id2", "chat#id2"},
+		{"-", "-"},
+		{"", ""},
+		{"chat#id9", "chat#id9"},
+		{"unknown", "unknown"},
+	}
+	for _, tt := range resolveTests {
+		if got := r.resolve(tt.ref); got != tt.want {
+			t.Errorf("resolve(%q): got %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+
+	matchTests := []struct {
+		ref  string
+		p    peer
+		want bool
+	}{
+		{"Team", peer{"chat#id1", "Team"}, true},
+		{"Team", peer{"chat#id2", "Team"}, false},
+		{"Team", peer{"user#id6", "Team"}, true}, // the user name Team
+		{"Team", peer{"user#id5", "alice"}, false},
+		{"chat#id2", peer{"chat#id2", "Team"}, true},
+		{"alice", peer{"user#id5", "alice"}, true},
+		{"alice", peer{"user#id6", "alice"}, false},
+		{"unknown", peer{"chat#id4", "unknown"}, false},
+	}
+	for _, tt := range matchTests {
+		if got := r.matches(tt.ref, tt.p); got != tt.want {
+			t.Errorf("matches(%q, %v): got %v, want %v", tt.ref, tt.p, got, tt.want)
+		}
+	}
+
+	// The names are persisted
+	r = newPeerResolver(d.Namespace("peers"))
+	if got := r.resolve("Team"); got != "chat#id1" {
+		t.Errorf("after restart: got %q, want chat#id1", got)
+	}
+	r.learn(peer{"chat#id2", "Team"})
+	if got := r.resolve("Team"); got != "chat#id1" {
+		t.Errorf("after restart: got %q, want chat#id1", got)
+	}
+}
+
+func TestPeerResolverAccounts(t *testing.T) {
+	setTestAccounts(t, &account{}, &account{accountConfig: accountConfig{Name: "work"}})
+	d := setTestDB(t, t.TempDir())
+	r := newPeerResolver(d.Namespace("peers"))
+
+	r.learn(peer{"chat#id1", "Team"})
+	r.learn(peer{"work/chat#id1", "work/Team"})
+	r.learn(peer{"work/user#id5", "work/-"})
+	if got := r.resolve("Team"); got != "chat#id1" {
+		t.Errorf("got %q, want chat#id1", got)
+	}
+	if got := r.resolve("work/Team"); got != "work/chat#id1" {
+		t.Errorf("got %q, want work/chat#id1", got)
+	}
+	if got := r.resolve("work/-"); got != "work/-" {
+		t.Errorf("unnamed peer: got %q, want work/-", got)
+	}
+}
+
+func TestRenameChatData(t *testing.T) {
+	setTestAccounts(t, &account{})
+	d := setTestDB(t, t.TempDir())
+	r := newPeerResolver(d.Namespace("peers"))
+
+	// Data stored under a chat name before the chat is seen
+	quotes := d.Namespace("quotes")
+	if err := quotes.Chat("Team").Put("quotes", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := quotes.Chat("alice").Put("quotes", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.learn(peer{"user#id5", "alice"})
+	r.learn(peer{"chat#id1", "Team"})
+	var got []string
+	if found, err := quotes.Chat("chat#id1").Get("quotes", &got); err != nil || !found || len(got) != 1 || got[0] != "a" {
+		t.Errorf("migrated data: got %v, %v, %v", got, found, err)
+	}
+	if found, _ := quotes.Chat("Team").Get("quotes", &got); found {
+		t.Error("the data is still stored under the name")
+	}
+	// Users have no chat data to migrate
+	if found, _ := quotes.Chat("alice").Get("quotes", &got); !found {
+		t.Error("the data of a user name was moved")
+	}
+
+	// Only the first chat seen with the name gets its data
+	if err := quotes.Chat("Team").Put("quotes", []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	r.learn(peer{"chat#id2", "Team"})
+	if found, _ := quotes.Chat("chat#id2").Get("quotes", &got); found {
+		t.Errorf("data migrated to a second chat: %v", got)
+	}
+}
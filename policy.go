@@ -0,0 +1,60 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "strings"
+
+// isPrivate returns true if chat is a private chat with from. The tg
+// client reports the other user as the chat of private messages, and the
+// secret chat as the chat of secret ones.
+func isPrivate(chat, from peer) bool {
+	_, id := accountOf(chat.ID)
+	return strings.HasPrefix(id, "user#") || strings.HasPrefix(id, "encr_chat#") ||
+		chat.ID == from.ID
+}
+
+// stripMention removes the mention of the bot of the account a from
+// text, which can be written before the command ("@bot !sb cats"),
+// appended to it ("!sb@bot cats") or at the end of the text ("!sb cats
+// @bot"). It returns the text without the mention and true if the bot
+// was mentioned.
+func stripMention(a *account, text string) (string, bool) {
+	if a.BotName == "" {
+		return text, false
+	}
+	mention := "@" + strings.ToLower(a.BotName)
+	lower := strings.ToLower(text)
+
+	if strings.HasPrefix(lower, mention+" ") {
+		return strings.TrimSpace(text[len(mention):]), true
+	}
+	if strings.HasSuffix(lower, " "+mention) {
+		return strings.TrimSpace(text[:len(text)-len(mention)]), true
+	}
+
+	cmd := lower
+	if i := strings.Index(lower, " "); i >= 0 {
+		cmd = lower[:i]
+	}
+	if strings.HasSuffix(cmd, mention) {
+		return text[:len(cmd)-len(mention)] + text[len(cmd):], true
+	}
+	if lower == mention {
+		return "", true
+	}
+	return text, false
+}
+
+// needsMention returns true if the command in text only runs in the
+// groups of the account a when the bot is mentioned.
+func needsMention(a *account, text string) bool {
+	cmd := strings.SplitN(text, " ", 2)[0]
+	for _, c := range a.MentionOnly {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
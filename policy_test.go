@@ -0,0 +1,56 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestIsPrivate(t *testing.T) {
+	old := accounts
+	accounts = []*account{{}}
+	defer func() { accounts = old }()
+
+	tests := []struct {
+		chat, from string
+		want       bool
+	}{
+		{"user#id5", "user#id5", true},
+		{"encr_chat#id7", "user#id5", true},
+		{"chat#id1", "user#id5", false},
+		{"channel#id2", "user#id5", false},
+		{"alice", "alice", true},
+	}
+	for _, tt := range tests {
+		got := isPrivate(peer{ID: tt.chat}, peer{ID: tt.from})
+		if got != tt.want {
+			t.Errorf("isPrivate(%v, %v): got %v, want %v", tt.chat, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestStripMention(t *testing.T) {
+	a := &account{accountConfig: accountConfig{BotName: "My_Bot"}}
+	tests := []struct {
+		text, want string
+		mentioned  bool
+	}{
+		{"@my_bot !sb cats", "!sb cats", true},
+		{"!sb@My_Bot cats", "!sb cats", true},
+		{"!sb cats @my_bot", "!sb cats", true},
+		{"@my_bot", "", true},
+		{"!sb cats", "!sb cats", false},
+		{"!sb @my_botty", "!sb @my_botty", false},
+	}
+	for _, tt := range tests {
+		got, mentioned := stripMention(a, tt.text)
+		if got != tt.want || mentioned != tt.mentioned {
+			t.Errorf("stripMention(%q): got %q, %v, want %q, %v",
+				tt.text, got, mentioned, tt.want, tt.mentioned)
+		}
+	}
+
+	if got, mentioned := stripMention(&account{}, "@my_bot"); got != "@my_bot" || mentioned {
+		t.Errorf("stripMention without BotName: got %q, %v", got, mentioned)
+	}
+}
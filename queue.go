@@ -0,0 +1,112 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// queueSize is the maximum number of commands that can be waiting to be
+// sent to the tg client before writers block.
+const queueSize = 256
+
+// errQueueClosed is returned by the writes to a closed outQueue.
+var errQueueClosed = errors.New("queue: closed")
+
+// outQueue is an io.Writer that queues the commands sent to the tg client
+// and writes them from its own goroutine, in order.
+type outQueue struct {
+	w    io.Writer
+	ch   chan []byte
+	done chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	senders  sync.WaitGroup // writers sending to ch
+	pending  int
+	progress time.Time // last write, or first enqueue after being idle
+	err      error
+}
+
+// newOutQueue returns an outQueue that writes to w and starts the
+// goroutine that drains it.
+func newOutQueue(w io.Writer) *outQueue {
+	q := &outQueue{
+		w:    w,
+		ch:   make(chan []byte, queueSize),
+		done: make(chan struct{}),
+	}
+	go q.drain()
+	return q
+}
+
+// Write queues a copy of p. Every call to Write is expected to contain
+// a complete command. It fails if the queue is closed.
+func (q *outQueue) Write(p []byte) (n int, err error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0, errQueueClosed
+	}
+	if q.pending == 0 {
+		q.progress = time.Now()
+	}
+	q.pending++
+	q.senders.Add(1)
+	q.mu.Unlock()
+
+	q.ch <- b
+	q.senders.Done()
+	return len(p), nil
+}
+
+// Close stops the queue and waits until all the pending commands have
+// been sent. The writes that started before Close are sent too.
+func (q *outQueue) Close() error {
+	q.mu.Lock()
+	closed := q.closed
+	q.closed = true
+	q.mu.Unlock()
+
+	if !closed {
+		q.senders.Wait()
+		close(q.ch)
+	}
+	<-q.done
+	return nil
+}
+
+func (q *outQueue) drain() {
+	defer close(q.done)
+	for b := range q.ch {
+		_, err := q.w.Write(b)
+		if err != nil {
+			log.Println("cannot send command:", err)
+		}
+
+		q.mu.Lock()
+		q.pending--
+		q.progress = time.Now()
+		q.err = err
+		q.mu.Unlock()
+	}
+}
+
+// draining returns true if the queue is empty or it has made progress
+// during the last d. It also returns the number of pending commands and
+// the error returned by the last write, if any.
+func (q *outQueue) draining(d time.Duration) (ok bool, pending int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ok = q.pending == 0 || time.Since(q.progress) < d
+	return ok, q.pending, q.err
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOutQueue(t *testing.T) {
+	out := &lockedBuffer{}
+	q := newOutQueue(out)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(q, "msg chat#id1 %v\n", i)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "msg chat#id1 0\nmsg chat#id1 1\nmsg chat#id1 2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := q.Write([]byte("msg chat#id1 late\n")); err != errQueueClosed {
+		t.Errorf("write after Close: got %v, want %v", err, errQueueClosed)
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestOutQueueConcurrentClose(t *testing.T) {
+	out := &lockedBuffer{}
+	q := newOutQueue(out)
+
+	// The writes racing with Close are either sent or rejected
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for i := 0; i < 2*queueSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.Write([]byte("msg chat#id1 x\n")); err == nil {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			} else if err != errQueueClosed {
+				t.Error(err)
+			}
+		}()
+	}
+	q.Close()
+	wg.Wait()
+	if n := strings.Count(out.String(), "\n"); n != sent {
+		t.Errorf("sent %v commands, got %v", sent, n)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/tgbot/replay"
+	"github.com/jroimartin/tgbot/utils"
+)
+
+// Recorder used in record mode. It is nil in any other mode.
+var recorder *replay.Recorder
+
+// serveRecord runs the bot like listenAndServe, recording the session in
+// modeDir so it can be replayed later.
+func serveRecord() error {
+	seed := time.Now().UnixNano()
+	var err error
+	recorder, err = replay.NewRecorder(modeDir, seed)
+	if err != nil {
+		return err
+	}
+	defer recorder.Close()
+
+	utils.Seed(seed)
+	utils.WrapTransport = recorder.WrapTransport
+
+	log.Println("Recording session in", modeDir)
+	return listenAndServe()
+}
+
+// serveReplay replays the session recorded in modeDir, with all the HTTP
+// services stubbed, and compares the commands sent by the bot with the
+// recorded ones.
+func serveReplay() error {
+	rp, err := replay.Load(modeDir)
+	if err != nil {
+		return err
+	}
+	utils.Seed(rp.Seed)
+	utils.WrapTransport = rp.WrapTransport
+
+	var out bytes.Buffer
+	accounts = accounts[:1]
+	acct := accounts[0]
+	acct.out = newOutQueue(mediaReleaser{&out})
+
+	if err := startBot(); err != nil {
+		return err
+	}
+	status.setAlive(acct.Name, true)
+	for _, line := range rp.Input {
+		handleLine(acct, line)
+	}
+	stopBot()
+	acct.out.Close()
+
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if out.Len() == 0 {
+		got = nil
+	}
+	if diff := replay.Diff(rp.Golden, got); diff != "" {
+		fmt.Fprint(os.Stderr, diff)
+		return errors.New("replay: output differs from the recording")
+	}
+	log.Printf("Replay OK (%v input lines, %v commands)\n", len(rp.Input), len(got))
+	return nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package replay records sessions of the bot and replays them. A
+// recording is a directory that contains the lines printed by the tg
+// client, the commands sent by the bot (the golden output), the HTTP
+// exchanges made by the commands and the seed of the random generator.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the files inside a recording.
+const (
+	InputFile  = "input.log"
+	GoldenFile = "golden.log"
+	HTTPFile   = "http.jsonl"
+	SeedFile   = "seed"
+)
+
+// exchange is a recorded HTTP request and its response.
+type exchange struct {
+	Method      string
+	URL         string
+	BodyHash    string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// A Recorder writes a new recording.
+type Recorder struct {
+	// Input receives the lines printed by the tg client.
+	Input io.Writer
+	// Output receives the commands sent by the bot.
+	Output io.Writer
+
+	files []*os.File
+
+	mu   sync.Mutex
+	http *json.Encoder
+}
+
+// NewRecorder creates a recording in dir that uses the given seed.
+func NewRecorder(dir string, seed int64) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, SeedFile),
+		[]byte(strconv.FormatInt(seed, 10)+"\n"), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{}
+	var fs [3]*os.File
+	for i, name := range []string{InputFile, GoldenFile, HTTPFile} {
+		fs[i], err = os.Create(filepath.Join(dir, name))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, fs[i])
+	}
+	r.Input, r.Output = fs[0], fs[1]
+	r.http = json.NewEncoder(fs[2])
+	return r, nil
+}
+
+// Close closes the files of the recording.
+func (r *Recorder) Close() error {
+	var err error
+	for _, f := range r.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// WrapTransport returns a transport that records the exchanges made
+// through tr.
+func (r *Recorder) WrapTransport(tr http.RoundTripper) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hash, err := bodyHash(req)
+		if err != nil {
+			return nil, err
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		err = r.http.Encode(exchange{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			BodyHash:    hash,
+			Status:      res.StatusCode,
+			ContentType: res.Header.Get("Content-Type"),
+			Body:        body,
+		})
+		return res, err
+	})
+}
+
+// A Replay is a loaded recording.
+type Replay struct {
+	Seed   int64
+	Input  []string
+	Golden []string
+
+	mu        sync.Mutex
+	exchanges []exchange
+	used      []bool
+}
+
+// Load loads the recording stored in dir.
+func Load(dir string) (*Replay, error) {
+	seed, err := ioutil.ReadFile(filepath.Join(dir, SeedFile))
+	if err != nil {
+		return nil, err
+	}
+	rp := &Replay{}
+	rp.Seed, err = strconv.ParseInt(strings.TrimSpace(string(seed)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if rp.Input, err = readLines(filepath.Join(dir, InputFile)); err != nil {
+		return nil, err
+	}
+	if rp.Golden, err = readLines(filepath.Join(dir, GoldenFile)); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, HTTPFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var e exchange
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		rp.exchanges = append(rp.exchanges, e)
+	}
+	rp.used = make([]bool, len(rp.exchanges))
+	return rp, nil
+}
+
+// WrapTransport returns a transport that answers the requests with the
+// recorded responses, in the same order they were recorded. Requests
+// that were not recorded get a 503 response. The wrapped transport is
+// ignored, so no request reaches the network.
+func (rp *Replay) WrapTransport(http.RoundTripper) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hash, err := bodyHash(req)
+		if err != nil {
+			return nil, err
+		}
+
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		for i, e := range rp.exchanges {
+			if rp.used[i] || e.Method != req.Method ||
+				e.URL != req.URL.String() || e.BodyHash != hash {
+				continue
+			}
+			rp.used[i] = true
+			return newResponse(req, e.Status, e.ContentType, e.Body), nil
+		}
+		return newResponse(req, http.StatusServiceUnavailable, "text/plain",
+			[]byte("replay: request not recorded\n")), nil
+	})
+}
+
+// refRegexp matches the references of the errors reported to the users.
+var refRegexp = regexp.MustCompile(`\(ref [0-9a-f]{6}\)`)
+
+// Normalize removes from the command line the parts that change between
+// runs, like the paths of the downloaded files and the references of the
+// errors.
+func Normalize(line string) string {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) == 3 && (strings.HasPrefix(fields[0], "send_") ||
+		strings.HasPrefix(fields[0], "reply_")) {
+		fields[2] = fmt.Sprintf("<file%v>", filepath.Ext(fields[2]))
+	}
+	return refRegexp.ReplaceAllString(strings.Join(fields, " "), "(ref <ref>)")
+}
+
+// Diff compares the normalized lines of want and got. It returns a
+// description of the differences or the empty string if they are equal.
+func Diff(want, got []string) string {
+	a := make([]string, len(want))
+	for i := range want {
+		a[i] = Normalize(want[i])
+	}
+	b := make([]string, len(got))
+	for i := range got {
+		b[i] = Normalize(got[i])
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(&buf, "  %v\n", a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&buf, "+ %v\n", b[j])
+			changed = true
+			j++
+		default:
+			fmt.Fprintf(&buf, "- %v\n", a[i])
+			changed = true
+			i++
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return buf.String()
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// bodyHash returns the hash of the body of req, restoring the body so it
+// can be sent.
+func bodyHash(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func newResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replay
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sample is the recording in testdata. The end to end tests of the main
+// package replay it with the bot.
+const sample = "testdata/quotes"
+
+func do(t *testing.T, client *http.Client, method, url, body string) (int, string) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestLoad(t *testing.T) {
+	rp, err := Load(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Seed == 0 {
+		t.Error("seed not loaded")
+	}
+	if len(rp.Input) != 5 || rp.Input[0] != "[STARTED]" {
+		t.Errorf("input: got %q", rp.Input)
+	}
+	if len(rp.Golden) != 4 || rp.Golden[0] != "msg chat#id1 hello" {
+		t.Errorf("golden: got %q", rp.Golden)
+	}
+	if len(rp.exchanges) != 3 {
+		t.Errorf("exchanges: got %v, want 3", len(rp.exchanges))
+	}
+
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("loaded an empty directory")
+	}
+}
+
+func TestReplayTransport(t *testing.T) {
+	rp, err := Load(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rp.WrapTransport(nil)}
+	const url = "http://quotes.example.com/quotes"
+
+	// Every recorded exchange is answered once
+	for i := 0; i < 2; i++ {
+		status, body := do(t, client, "GET", url, "")
+		if status != http.StatusOK || !strings.HasPrefix(body, "The cat sat on the mat\n") {
+			t.Errorf("GET %v: got %v %q", i, status, body)
+		}
+	}
+	if status, _ := do(t, client, "GET", url, ""); status != http.StatusServiceUnavailable {
+		t.Errorf("third GET: got %v, want 503", status)
+	}
+
+	// Requests with other bodies or URLs were not recorded
+	if status, _ := do(t, client, "POST", url, "Dogs are solid"); status != http.StatusServiceUnavailable {
+		t.Errorf("POST with another body: got %v, want 503", status)
+	}
+	if status, _ := do(t, client, "POST", url+"?x", "Cats are liquid"); status != http.StatusServiceUnavailable {
+		t.Errorf("POST to another URL: got %v, want 503", status)
+	}
+	if status, _ := do(t, client, "POST", url, "Cats are liquid"); status != http.StatusOK {
+		t.Errorf("POST: got %v, want 200", status)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var n int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%v %v %s", n, r.Method, body)
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	r, err := NewRecorder(dir, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(r.Input, "[STARTED]")
+	fmt.Fprintln(r.Output, "msg chat#id1 hi")
+	client := &http.Client{Transport: r.WrapTransport(http.DefaultTransport)}
+	_, body1 := do(t, client, "GET", s.URL, "")
+	_, body2 := do(t, client, "POST", s.URL, "data")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recording answers the same requests without the server
+	s.Close()
+	rp, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Seed != 42 || fmt.Sprint(rp.Input) != "[[STARTED]]" || fmt.Sprint(rp.Golden) != "[msg chat#id1 hi]" {
+		t.Errorf("got seed %v, input %q, golden %q", rp.Seed, rp.Input, rp.Golden)
+	}
+	client = &http.Client{Transport: rp.WrapTransport(nil)}
+	if _, got := do(t, client, "POST", s.URL, "data"); got != body2 {
+		t.Errorf("POST: got %q, want %q", got, body2)
+	}
+	if _, got := do(t, client, "GET", s.URL, ""); got != body1 {
+		t.Errorf("GET: got %q, want %q", got, body1)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"msg chat#id1 hello world", "msg chat#id1 hello world"},
+		{"send_photo chat#id1 /tmp/tgbot123/a.png", "send_photo chat#id1 <file.png>"},
+		{"reply_document 7 /tmp/x/report.pdf", "reply_document 7 <file.pdf>"},
+		{"msg chat#id1 error: cannot get pic (ref 3f2a1c)", "msg chat#id1 error: cannot get pic (ref <ref>)"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.line); got != tt.want {
+			t.Errorf("Normalize(%q): got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := []string{"msg chat#id1 a", "send_photo chat#id1 /tmp/1/x.png", "msg chat#id1 c"}
+	b := []string{"msg chat#id1 a", "send_photo chat#id1 /tmp/2/x.png", "msg chat#id1 c"}
+	if d := Diff(a, b); d != "" {
+		t.Errorf("equal after normalizing: got diff\n%v", d)
+	}
+
+	b = []string{"msg chat#id1 a", "msg chat#id1 b", "msg chat#id1 c"}
+	want := "  msg chat#id1 a\n" +
+		"+ msg chat#id1 b\n" +
+		"- send_photo chat#id1 <file.png>\n" +
+		"  msg chat#id1 c\n"
+	if d := Diff(a, b); d != want {
+		t.Errorf("got diff\n%vwant\n%v", d, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/tgbot/commands"
+)
+
+// maxRecentMsgs is the number of messages remembered to resolve the
+// messages replied to.
+const maxRecentMsgs = 1000
+
+// recentMsgs remembers the last messages received by the bot.
+var recentMsgs = &msgCache{msgs: make(map[string]commands.Message)}
+
+// msgCache is a bounded cache of messages indexed by ID. The oldest
+// messages are evicted first.
+type msgCache struct {
+	mu    sync.Mutex
+	msgs  map[string]commands.Message
+	order []string
+}
+
+// add adds m to the cache. Messages without ID are ignored.
+func (c *msgCache) add(m commands.Message) {
+	if m.ID == "" || m.ID == "-" {
+		return
+	}
+	m.ReplyTo = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.msgs[m.ID]; !ok {
+		c.order = append(c.order, m.ID)
+	}
+	c.msgs[m.ID] = m
+	if len(c.order) > maxRecentMsgs {
+		delete(c.msgs, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// get returns the message with the given ID, if it is in the cache.
+func (c *msgCache) get(id string) (commands.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, ok := c.msgs[id]
+	return m, ok
+}
+
+// replyActions maps the tg client commands that send something to a
+// peer to the ones that send it as a reply to a message.
+var replyActions = map[string]string{
+	"msg":           "reply",
+	"send_photo":    "reply_photo",
+	"send_audio":    "reply_audio",
+	"send_document": "reply_document",
+	"send_file":     "reply_file",
+}
+
+// replyWriter is the io.Writer used by the commands. While a reply target
+// is set, it rewrites the commands sent to the target's chat so they
+// reply to the target message. Otherwise lines are written unchanged.
+type replyWriter struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	chat  string
+	msgID string
+}
+
+// Output of the commands.
+var cmdOut *replyWriter
+
+// setTarget makes the following commands sent to chat reply to the
+// message msgID. An empty msgID disables the rewriting.
+func (rw *replyWriter) setTarget(chat, msgID string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if msgID == "-" {
+		msgID = ""
+	}
+	rw.chat, rw.msgID = chat, msgID
+}
+
+func (rw *replyWriter) Write(p []byte) (n int, err error) {
+	sentMedia(p)
+
+	rw.mu.Lock()
+	chat, msgID := rw.chat, rw.msgID
+	rw.mu.Unlock()
+
+	if msgID == "" {
+		return rw.w.Write(p)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) == 3 && fields[1] == chat {
+			if action, ok := replyActions[fields[0]]; ok {
+				line = action + " " + msgID + " " + fields[2]
+			}
+		}
+		buf.WriteString(line)
+	}
+	if _, err := rw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
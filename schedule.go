@@ -0,0 +1,59 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jroimartin/tgbot/commands"
+	"github.com/jroimartin/tgbot/scheduler"
+)
+
+// schedulerUser is the sender of the messages generated by scheduled
+// jobs.
+var schedulerUser = peer{ID: "scheduler", Name: "scheduler"}
+
+// Scheduler used to run timed and recurring jobs.
+var sched *scheduler.Scheduler
+
+// initScheduler creates the scheduler and loads the jobs stored in the
+// database and the ones defined in the config.
+func initScheduler() error {
+	sched = scheduler.New(db.Namespace("scheduler"), runScheduled)
+	if err := sched.Load(); err != nil {
+		return err
+	}
+	for i, j := range globalConfig.Schedule.Job {
+		if j.ID == "" {
+			j.ID = fmt.Sprintf("cfg%v", i+1)
+		}
+		j.Chat = strings.Replace(j.Chat, " ", "_", -1)
+		j.Static = true
+		if _, err := sched.Add(j); err != nil {
+			log.Printf("cannot add job %v: %v\n", j.ID, err)
+		}
+	}
+	return nil
+}
+
+// runScheduled runs the text of a job as if it had been sent to chat,
+// which can be a peer ID or a name. If the text does not match any
+// command, it is sent as a message.
+func runScheduled(chat, text string) {
+	p := peer{ID: peers.resolve(chat), Name: chat}
+	m := commands.Message{
+		Chat:     p.ID,
+		ChatName: p.Name,
+		From:     schedulerUser.Name,
+		FromID:   schedulerUser.ID,
+		Text:     text,
+		Private:  isPrivate(p, schedulerUser),
+	}
+	if !handleCommand(m) {
+		fmt.Fprintf(cmdOut, "msg %v %v\n", p.ID, text)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Cron is a parsed cron expression.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar are true when the day of month or the day of
+	// week fields are "*". When both fields are restricted, a day matches
+	// if any of them matches.
+	domStar, dowStar bool
+}
+
+// cronField describes the valid range of a field of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are Sunday
+}
+
+// cronMacros are the supported shorthands.
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// ParseCron parses a standard cron expression with five fields (minute,
+// hour, day of month, month and day of week). Each field can be "*", a
+// number, a range ("1-5"), a list ("1,3,5") and any of them with a step
+// ("*/15", "0-30/10"). The macros @yearly, @monthly, @weekly, @daily and
+// @hourly are also accepted.
+func ParseCron(expr string) (*Cron, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron: expected %v fields in %q", len(cronFields), expr)
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	c := &Cron{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("cron: invalid step in %v %q", f.name, s)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(r[0])
+			hi, err2 = strconv.Atoi(r[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("cron: invalid range in %v %q", f.name, s)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("cron: invalid value in %v %q", f.name, s)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("cron: %v out of range in %q", f.name, s)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t that matches the expression. It
+// returns the zero time if there is no such time in the next five years.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+const testLayout = "2006-01-02 15:04 Mon"
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr, from string
+		want       []string // next runs
+	}{
+		{
+			"*/15 * * * *", "2024-01-01 10:07 Mon",
+			[]string{"2024-01-01 10:15 Mon", "2024-01-01 10:30 Mon", "2024-01-01 10:45 Mon", "2024-01-01 11:00 Mon"},
+		},
+		{
+			"0-30/10 9 * * *", "2024-01-01 09:25 Mon",
+			[]string{"2024-01-01 09:30 Mon", "2024-01-02 09:00 Tue", "2024-01-02 09:10 Tue"},
+		},
+		{
+			"0 8,12,18 * * *", "2024-01-01 12:00 Mon",
+			[]string{"2024-01-01 18:00 Mon", "2024-01-02 08:00 Tue"},
+		},
+		{
+			"30 9 * * 1-5", "2024-01-05 10:00 Fri",
+			[]string{"2024-01-08 09:30 Mon", "2024-01-09 09:30 Tue"},
+		},
+		{
+			"0 0 * * 7", "2024-01-01 00:00 Mon",
+			[]string{"2024-01-07 00:00 Sun", "2024-01-14 00:00 Sun"},
+		},
+		{
+			"@weekly", "2024-01-03 12:00 Wed",
+			[]string{"2024-01-07 00:00 Sun", "2024-01-14 00:00 Sun"},
+		},
+		{
+			"@monthly", "2024-01-31 23:59 Wed",
+			[]string{"2024-02-01 00:00 Thu", "2024-03-01 00:00 Fri"},
+		},
+		{
+			"0 12 29 2 *", "2024-03-01 00:00 Fri",
+			[]string{"2028-02-29 12:00 Tue"},
+		},
+		{
+			// Both days restricted: either of them matches
+			"0 0 13 * 5", "2024-09-01 00:00 Sun",
+			[]string{"2024-09-06 00:00 Fri", "2024-09-13 00:00 Fri", "2024-09-20 00:00 Fri"},
+		},
+		{
+			"5 * 1 1 *", "2024-01-01 22:30 Mon",
+			[]string{"2024-01-01 23:05 Mon", "2025-01-01 00:05 Wed"},
+		},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		next, err := time.ParseInLocation(testLayout, tt.from, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			next = c.Next(next)
+			if got := next.Format(testLayout); got != want {
+				t.Errorf("%q: got %v, want %v", tt.expr, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestCronNever(t *testing.T) {
+	c, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := c.Next(time.Now()); !next.IsZero() {
+		t.Errorf("got %v, want the zero time", next)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@every",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+		"-1 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): got no error", expr)
+		}
+	}
+}
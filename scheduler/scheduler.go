@@ -0,0 +1,283 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package scheduler runs timed and recurring bot actions. Jobs are either
+// recurring (defined by a cron expression) or one-shot (run once at a
+// given time). Jobs added at runtime are persisted, so they survive
+// restarts.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+// tick is the interval used to check for due jobs.
+const tick = time.Second
+
+// Keys used in the store.
+const (
+	seqKey    = "seq"
+	jobPrefix = "job:"
+)
+
+// Errors returned by Remove.
+var (
+	ErrNotFound = errors.New("scheduler: job not found")
+	ErrStatic   = errors.New("scheduler: job defined in the config")
+)
+
+// A Job is an action executed by the scheduler. Text is sent to Chat as
+// if it had been written there, so it is run as a command when it
+// matches one. Otherwise, it is sent as a message.
+type Job struct {
+	ID   string
+	Chat string
+	Text string
+
+	// Cron is the cron expression of recurring jobs.
+	Cron string
+	// At is the time when one-shot jobs must run.
+	At time.Time
+
+	// Static jobs come from the configuration and are not persisted.
+	Static bool `json:"-" toml:"-"`
+
+	next time.Time
+	cron *Cron
+}
+
+// Next returns the next time the job will run.
+func (j Job) Next() time.Time {
+	return j.next
+}
+
+// String returns a human readable description of the job.
+func (j Job) String() string {
+	when := "at " + j.At.Format("2006-01-02 15:04")
+	if j.Cron != "" {
+		when = fmt.Sprintf("cron %q", j.Cron)
+	}
+	return fmt.Sprintf("[%v] %v in %v: %v", j.ID, when, j.Chat, j.Text)
+}
+
+// A RunFunc is called for every job that is due.
+type RunFunc func(chat, text string)
+
+// A Scheduler runs jobs when they are due.
+type Scheduler struct {
+	ns  store.Namespace
+	run RunFunc
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a Scheduler that calls run for every job that is due. The
+// jobs added at runtime are persisted in ns.
+func New(ns store.Namespace, run RunFunc) *Scheduler {
+	return &Scheduler{
+		ns:   ns,
+		run:  run,
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Load loads the persisted jobs. One-shot jobs that should have run
+// while the bot was down are run as soon as the scheduler starts.
+func (s *Scheduler) Load() error {
+	return s.ns.Global().View(func(tx *store.Tx) error {
+		keys, err := tx.Keys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, jobPrefix) {
+				continue
+			}
+			var j Job
+			if _, err := tx.Get(k, &j); err != nil {
+				return err
+			}
+			if err := j.init(time.Now()); err != nil {
+				log.Printf("scheduler: discarding job %v: %v\n", j.ID, err)
+				continue
+			}
+			s.mu.Lock()
+			s.jobs[j.ID] = &j
+			s.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// Add adds a job to the scheduler. Jobs without ID get a new one. Jobs
+// that are not static are persisted. It returns the added job.
+func (s *Scheduler) Add(j Job) (Job, error) {
+	if j.Chat == "" || j.Text == "" {
+		return Job{}, errors.New("scheduler: chat and text are required")
+	}
+	if err := j.init(time.Now()); err != nil {
+		return Job{}, err
+	}
+	if j.Cron == "" && j.next.Before(time.Now()) {
+		return Job{}, errors.New("scheduler: time is in the past")
+	}
+
+	if !j.Static {
+		err := s.ns.Global().Update(func(tx *store.Tx) error {
+			if j.ID == "" {
+				var seq int
+				if _, err := tx.Get(seqKey, &seq); err != nil {
+					return err
+				}
+				seq++
+				if err := tx.Put(seqKey, seq); err != nil {
+					return err
+				}
+				j.ID = strconv.Itoa(seq)
+			}
+			return tx.Put(jobPrefix+j.ID, j)
+		})
+		if err != nil {
+			return Job{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[j.ID]; ok && j.Static {
+		return Job{}, fmt.Errorf("scheduler: duplicated job ID %q", j.ID)
+	}
+	s.jobs[j.ID] = &j
+	return j, nil
+}
+
+// Remove removes the job with the given ID. Static jobs cannot be
+// removed.
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if j.Static {
+		return ErrStatic
+	}
+	if err := s.ns.Global().Delete(jobPrefix + id); err != nil {
+		return err
+	}
+	delete(s.jobs, id)
+	return nil
+}
+
+// Jobs returns the scheduled jobs sorted by their next run time.
+func (s *Scheduler) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].next.Before(jobs[k].next)
+	})
+	return jobs
+}
+
+// Start starts running jobs in a new goroutine.
+func (s *Scheduler) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.loop()
+}
+
+// Stop stops the scheduler and waits until the running job, if any, has
+// finished.
+func (s *Scheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			for _, j := range s.due(now) {
+				s.run(j.Chat, j.Text)
+			}
+		}
+	}
+}
+
+// due returns the jobs that must run at now and schedules their next
+// run. One-shot jobs are removed.
+func (s *Scheduler) due(now time.Time) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []Job
+	for id, j := range s.jobs {
+		if j.next.After(now) {
+			continue
+		}
+		jobs = append(jobs, *j)
+
+		if j.cron != nil {
+			j.next = j.cron.Next(now)
+			continue
+		}
+		delete(s.jobs, id)
+		if !j.Static {
+			if err := s.ns.Global().Delete(jobPrefix + id); err != nil {
+				log.Printf("scheduler: cannot delete job %v: %v\n", id, err)
+			}
+		}
+	}
+	return jobs
+}
+
+// init validates the job and computes its next run time.
+func (j *Job) init(now time.Time) error {
+	if (j.Cron == "") == j.At.IsZero() {
+		return errors.New("scheduler: either cron or time must be set")
+	}
+	if j.Cron == "" {
+		j.next = j.At
+		return nil
+	}
+	c, err := ParseCron(j.Cron)
+	if err != nil {
+		return err
+	}
+	j.cron = c
+	j.next = c.Next(now)
+	if j.next.IsZero() {
+		return errors.New("scheduler: cron expression never matches")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scheduler
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/tgbot/store"
+)
+
+func openStore(t *testing.T, dir string) *store.DB {
+	t.Helper()
+	db, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// byID sorts jobs by ID.
+func byID(jobs []Job) []Job {
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs
+}
+
+func jobIDs(jobs []Job) []string {
+	var ids []string
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+func TestAddErrors(t *testing.T) {
+	s := New(openStore(t, t.TempDir()).Namespace("scheduler"), nil)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name string
+		job  Job
+	}{
+		{"no chat", Job{Text: "hi", Cron: "@daily"}},
+		{"no text", Job{Chat: "c", Cron: "@daily"}},
+		{"no time", Job{Chat: "c", Text: "hi"}},
+		{"cron and time", Job{Chat: "c", Text: "hi", Cron: "@daily", At: future}},
+		{"bad cron", Job{Chat: "c", Text: "hi", Cron: "* *"}},
+		{"never", Job{Chat: "c", Text: "hi", Cron: "0 0 30 2 *"}},
+		{"past", Job{Chat: "c", Text: "hi", At: time.Now().Add(-time.Minute)}},
+	}
+	for _, tt := range tests {
+		if _, err := s.Add(tt.job); err == nil {
+			t.Errorf("%v: got no error", tt.name)
+		}
+	}
+	if jobs := s.Jobs(); len(jobs) != 0 {
+		t.Errorf("jobs: got %v, want none", jobs)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	db := openStore(t, dir)
+	s := New(db.Namespace("scheduler"), nil)
+
+	soon := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, j := range []Job{
+		{Chat: "c", Text: "once", At: soon},
+		{Chat: "c", Text: "daily", Cron: "@daily"},
+		{ID: "cfg1", Chat: "c", Text: "static", Cron: "@hourly", Static: true},
+	} {
+		if _, err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove("2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("2"); err != ErrNotFound {
+		t.Errorf("Remove of a removed job: got %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Remove("cfg1"); err != ErrStatic {
+		t.Errorf("Remove of a static job: got %v, want %v", err, ErrStatic)
+	}
+	if _, err := s.Add(Job{Chat: "c", Text: "weekly", Cron: "@weekly"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the jobs added at runtime survive a restart, and the IDs are
+	// not reused
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = New(openStore(t, dir).Namespace("scheduler"), nil)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	jobs := byID(s.Jobs())
+	if ids := jobIDs(jobs); len(ids) != 2 || ids[0] != "1" || ids[1] != "3" {
+		t.Fatalf("jobs after restart: got %v, want [1 3]", ids)
+	}
+	if j := jobs[0]; j.Text != "once" || !j.Next().Equal(soon) {
+		t.Errorf("one-shot job: got %v (next %v), want next %v", j, j.Next(), soon)
+	}
+	if j := jobs[1]; j.Text != "weekly" || j.Next().Weekday() != time.Sunday {
+		t.Errorf("weekly job: got %v (next %v)", j, j.Next())
+	}
+}
+
+func TestDue(t *testing.T) {
+	dir := t.TempDir()
+	db := openStore(t, dir)
+	s := New(db.Namespace("scheduler"), nil)
+
+	now := time.Now()
+	once, err := s.Add(Job{Chat: "c", Text: "once", At: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron, err := s.Add(Job{Chat: "c", Text: "hourly", Cron: "@hourly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jobs := s.due(now); len(jobs) != 0 {
+		t.Errorf("due now: got %v, want none", jobs)
+	}
+	later := cron.Next()
+	if once.Next().After(later) {
+		later = once.Next()
+	}
+	if ids := jobIDs(s.due(later)); len(ids) != 2 {
+		t.Errorf("due later: got %v, want both jobs", ids)
+	}
+
+	// The one-shot job is removed, also from the store, and the
+	// recurring one is rescheduled
+	jobs := s.Jobs()
+	if ids := jobIDs(jobs); len(ids) != 1 || ids[0] != cron.ID {
+		t.Fatalf("jobs: got %v, want [%v]", ids, cron.ID)
+	}
+	if !jobs[0].Next().After(later) {
+		t.Errorf("next run: got %v, want after %v", jobs[0].Next(), later)
+	}
+	s = New(db.Namespace("scheduler"), nil)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := jobIDs(s.Jobs()); len(ids) != 1 || ids[0] != cron.ID {
+		t.Errorf("jobs after restart: got %v, want [%v]", ids, cron.ID)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New(openStore(t, t.TempDir()).Namespace("scheduler"), nil)
+	ran := make(chan string, 1)
+	s.run = func(chat, text string) {
+		ran <- chat + " " + text
+	}
+	if _, err := s.Add(Job{Chat: "c", Text: "hi", At: time.Now().Add(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+	select {
+	case got := <-ran:
+		if got != "c hi" {
+			t.Errorf("got %q, want %q", got, "c hi")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job did not run")
+	}
+}
@@ -2,6 +2,11 @@
 -- Use of this source code is governed by a BSD-style
 -- license that can be found in the LICENSE file.
 
+-- protocol_version is the version of the format of the lines printed by
+-- this script. It must match the version expected by tgbot, so it must be
+-- increased with every incompatible change.
+protocol_version = 1
+
 started = 0
 
 -- We must avoid \n, \r and any other character that could break the parsing
@@ -21,15 +26,75 @@ function sanitize_id(str)
 	return string.gsub(filter_chrs(str), " +", "_")
 end
 
-function get_title(from, to)
+-- get_chat returns the peer where the message was sent. In private chats
+-- it is the sender, so private chats can be told apart from groups and
+-- channels because their ID starts with "user#", or "encr_chat#" in
+-- secret chats.
+function get_chat(from, to)
 	if to.type == "user" then
-		return from.print_name
-	elseif to.type == "chat" then
-		return to.print_name
-	elseif to.type == "encr_chat" then
-		return from.print_name
+		return from
 	else
-		return ""
+		return to
+	end
+end
+
+-- peer_id returns a stable identifier for the peer that can be used as
+-- the peer argument of telegram-cli commands (e.g. chat#id1234)
+function peer_id(peer)
+	return peer.type.."#id"..tostring(peer.peer_id or peer.id)
+end
+
+-- peer_str returns the ID and the name of the peer as printed in the
+-- [MSG] and [EVT] lines. Peers without name are printed as "-", so the
+-- fields of the lines are never empty.
+function peer_str(peer)
+	local name = sanitize_id(peer.print_name or "")
+	if name == "" or name == "_" then
+		name = "-"
+	end
+	return peer_id(peer).." "..name
+end
+
+-- print_event prints a non-text event with the format
+-- "[EVT] kind chat_id chat from_id from args"
+function print_event(kind, chat, from, args)
+	local s = "[EVT] "..kind.." "..peer_str(chat).." "..peer_str(from)
+	if args and args ~= "" then
+		s = s.." "..args
+	end
+	print(s)
+end
+
+-- Service message actions reported as events
+actions = {
+	chat_add_user = "join",
+	chat_add_user_link = "join",
+	chat_del_user = "leave",
+}
+
+-- Last title reported for every chat. Renames are reported both as
+-- service messages and as chat updates, so they are only printed once.
+titles = {}
+
+-- print_rename prints the rename event of chat unless its title has
+-- already been reported.
+function print_rename(chat, from, title)
+	local id = peer_id(chat)
+	if titles[id] == title then
+		return
+	end
+	titles[id] = title
+	print_event("rename", chat, from, filter_chrs(title))
+end
+
+function on_service_msg(msg, chat)
+	local a = msg.action
+	local kind = actions[a.type]
+	if kind then
+		local user = a.user or msg.from
+		print_event(kind, chat, msg.from, peer_str(user))
+	elseif a.type == "chat_rename" or a.type == "chat_change_title" then
+		print_rename(chat, msg.from, a.title or "")
 	end
 end
 
@@ -40,22 +105,71 @@ function on_msg_receive(msg)
 	if msg.out then
 		return
 	end
+	local chat = get_chat(msg.from, msg.to)
+	if msg.action then
+		on_service_msg(msg, chat)
+		return
+	end
+	if msg.media then
+		print_event("media", chat, msg.from,
+			msg.media.type.." "..filter_chrs(msg.media.caption or ""))
+		return
+	end
+	if not msg.text then
+		return
+	end
 	print("[MSG] "..
-		sanitize_id(get_title(msg.from, msg.to)).." "..
-		sanitize_id(msg.from.print_name).." "..
+		tostring(msg.id).." "..
+		tostring(msg.reply_id or "-").." "..
+		peer_str(chat).." "..
+		peer_str(msg.from).." "..
 		filter_chrs(msg.text))
 end
 
-function on_binlog_replay_end()
+-- set_started notifies the bot once binlog_replay_end and
+-- get_difference_end have been received
+function set_started()
 	started = started + 1
+	if started == 2 then
+		print("[STARTED]")
+	end
+end
+
+function on_binlog_replay_end()
+	set_started()
 end
 
 function on_get_difference_end()
-	started = started + 1
+	set_started()
+end
+
+function on_user_update(user, what)
+	if started < 2 then
+		return
+	end
+	for _, w in pairs(what) do
+		if w == "name" then
+			print_event("user_rename", user, user, "")
+			return
+		end
+	end
+end
+
+-- on_chat_update reports the renames of chats made without a service
+-- message (e.g. seen when getting the difference). The chat is also the
+-- sender, since the update does not say who made it.
+function on_chat_update(chat, what)
+	if started < 2 then
+		return
+	end
+	for _, w in pairs(what) do
+		if w == "title" then
+			print_rename(chat, chat, chat.title or chat.print_name or "")
+			return
+		end
+	end
 end
 
 -- Fix error "*** lua: attempt to call a nil value"
 function on_our_id(id) end
-function on_user_update(user, what) end
-function on_chat_update(chat, what) end
 function on_secret_chat_update(schat, what) end
@@ -0,0 +1,268 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package store implements the persistent key-value store shared by the
+// bot commands. Data is organized in namespaces (one per command) that
+// contain a global bucket and one bucket per chat. Values are encoded as
+// JSON.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileName is the name of the database file inside the data directory.
+const fileName = "tgbot.db"
+
+// Names of the nested buckets inside a namespace.
+var (
+	globalBucket = []byte("global")
+	chatsBucket  = []byte("chats")
+)
+
+// A DB is a handle to the database stored in the data directory.
+type DB struct {
+	bdb *bolt.DB
+}
+
+// Open opens the database stored in dir, creating both the directory and
+// the database if they do not exist.
+func Open(dir string) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	bdb, err := bolt.Open(filepath.Join(dir, fileName), 0600,
+		&bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{bdb: bdb}, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return db.bdb.Close()
+}
+
+// Namespace returns the namespace with the given name. Commands are
+// expected to use their own namespace.
+func (db *DB) Namespace(name string) Namespace {
+	return Namespace{db: db, name: name}
+}
+
+// RenameChat moves the data stored for chat oldName to chat newName in
+// every namespace. Namespaces that already have data for newName are
+// left untouched.
+func (db *DB) RenameChat(oldName, newName string) error {
+	return db.bdb.Update(func(btx *bolt.Tx) error {
+		return btx.ForEach(func(ns []byte, nsb *bolt.Bucket) error {
+			chats := nsb.Bucket(chatsBucket)
+			if chats == nil {
+				return nil
+			}
+			src := chats.Bucket([]byte(oldName))
+			if src == nil || chats.Bucket([]byte(newName)) != nil {
+				return nil
+			}
+			dst, err := chats.CreateBucket([]byte(newName))
+			if err != nil {
+				return err
+			}
+			err = src.ForEach(func(k, v []byte) error {
+				if v == nil { // nested bucket
+					return nil
+				}
+				return dst.Put(k, v)
+			})
+			if err != nil {
+				return err
+			}
+			return chats.DeleteBucket([]byte(oldName))
+		})
+	})
+}
+
+// A Namespace groups the buckets used by a command.
+type Namespace struct {
+	db   *DB
+	name string
+}
+
+// Global returns the bucket used to store data that is not related to
+// any chat.
+func (ns Namespace) Global() Bucket {
+	return Bucket{db: ns.db, path: [][]byte{[]byte(ns.name), globalBucket}}
+}
+
+// Chat returns the bucket used to store the data of the given chat.
+func (ns Namespace) Chat(chat string) Bucket {
+	return Bucket{db: ns.db, path: [][]byte{[]byte(ns.name), chatsBucket, []byte(chat)}}
+}
+
+// Chats returns the chats that have a bucket in this namespace.
+func (ns Namespace) Chats() ([]string, error) {
+	var chats []string
+	err := ns.db.bdb.View(func(btx *bolt.Tx) error {
+		b := lookup(btx, [][]byte{[]byte(ns.name), chatsBucket})
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil { // nested bucket
+				chats = append(chats, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(chats)
+	return chats, nil
+}
+
+// A Bucket is a collection of key/value pairs.
+type Bucket struct {
+	db   *DB
+	path [][]byte
+}
+
+// Get decodes the value stored under key into v. It returns false if
+// the key does not exist.
+func (b Bucket) Get(key string, v interface{}) (found bool, err error) {
+	err = b.View(func(tx *Tx) error {
+		found, err = tx.Get(key, v)
+		return err
+	})
+	return found, err
+}
+
+// Put stores v under key.
+func (b Bucket) Put(key string, v interface{}) error {
+	return b.Update(func(tx *Tx) error {
+		return tx.Put(key, v)
+	})
+}
+
+// Delete removes key from the bucket. Deleting a key that does not exist
+// is not an error.
+func (b Bucket) Delete(key string) error {
+	return b.Update(func(tx *Tx) error {
+		return tx.Delete(key)
+	})
+}
+
+// Keys returns the sorted list of keys in the bucket.
+func (b Bucket) Keys() (keys []string, err error) {
+	err = b.View(func(tx *Tx) error {
+		keys, err = tx.Keys()
+		return err
+	})
+	return keys, err
+}
+
+// View executes fn within a read-only transaction.
+func (b Bucket) View(fn func(tx *Tx) error) error {
+	return b.db.bdb.View(func(btx *bolt.Tx) error {
+		return fn(&Tx{b: lookup(btx, b.path)})
+	})
+}
+
+// Update executes fn within a read-write transaction. If fn returns an
+// error, the transaction is rolled back.
+func (b Bucket) Update(fn func(tx *Tx) error) error {
+	return b.db.bdb.Update(func(btx *bolt.Tx) error {
+		bb, err := btx.CreateBucketIfNotExists(b.path[0])
+		if err != nil {
+			return err
+		}
+		for _, name := range b.path[1:] {
+			bb, err = bb.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(&Tx{b: bb})
+	})
+}
+
+// A Tx gives access to a bucket within a transaction.
+type Tx struct {
+	// b is nil in read-only transactions over buckets that have not
+	// been created yet.
+	b *bolt.Bucket
+}
+
+// Get decodes the value stored under key into v. It returns false if
+// the key does not exist.
+func (tx *Tx) Get(key string, v interface{}) (found bool, err error) {
+	if tx.b == nil {
+		return false, nil
+	}
+	data := tx.b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ErrReadOnly is returned when writing in a read-only transaction.
+var ErrReadOnly = errors.New("store: read-only transaction")
+
+// Put stores v under key.
+func (tx *Tx) Put(key string, v interface{}) error {
+	if tx.b == nil || !tx.b.Writable() {
+		return ErrReadOnly
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.b.Put([]byte(key), data)
+}
+
+// Delete removes key from the bucket.
+func (tx *Tx) Delete(key string) error {
+	if tx.b == nil {
+		return nil
+	}
+	return tx.b.Delete([]byte(key))
+}
+
+// Keys returns the sorted list of keys in the bucket.
+func (tx *Tx) Keys() ([]string, error) {
+	var keys []string
+	if tx.b == nil {
+		return keys, nil
+	}
+	err := tx.b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// lookup returns the bucket at path or nil if it does not exist.
+func lookup(btx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	b := btx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
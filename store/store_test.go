@@ -0,0 +1,242 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func openTest(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBucket(t *testing.T) {
+	db := openTest(t, t.TempDir())
+	ns := db.Namespace("quotes")
+
+	tests := []struct {
+		bucket Bucket
+		key    string
+		value  []string
+	}{
+		{ns.Global(), "a", []string{"global"}},
+		{ns.Chat("chat#id1"), "a", []string{"chat 1", "x"}},
+		{ns.Chat("chat#id2"), "a", nil},
+		{db.Namespace("other").Chat("chat#id1"), "a", []string{"other"}},
+	}
+	for _, tt := range tests {
+		if err := tt.bucket.Put(tt.key, tt.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		var got []string
+		found, err := tt.bucket.Get(tt.key, &got)
+		if err != nil || !found {
+			t.Errorf("Get(%v): found %v, err %v", tt.bucket.path, found, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.value) {
+			t.Errorf("Get(%v): got %q, want %q", tt.bucket.path, got, tt.value)
+		}
+	}
+
+	chats, err := ns.Chats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(chats) != "[chat#id1 chat#id2]" {
+		t.Errorf("Chats: got %v", chats)
+	}
+
+	b := ns.Chat("chat#id1")
+	if err := b.Put("b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := b.Keys(); err != nil || fmt.Sprint(keys) != "[a b]" {
+		t.Errorf("Keys: got %v, %v", keys, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Delete("a"); err != nil {
+			t.Errorf("Delete %v: %v", i, err)
+		}
+	}
+	var v []string
+	if found, err := b.Get("a", &v); found || err != nil {
+		t.Errorf("Get after Delete: found %v, err %v", found, err)
+	}
+	if keys, err := b.Keys(); err != nil || fmt.Sprint(keys) != "[b]" {
+		t.Errorf("Keys after Delete: got %v, %v", keys, err)
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	db := openTest(t, t.TempDir())
+	b := db.Namespace("none").Chat("chat#id1")
+
+	var v int
+	if found, err := b.Get("a", &v); found || err != nil {
+		t.Errorf("Get: found %v, err %v", found, err)
+	}
+	if keys, err := b.Keys(); len(keys) != 0 || err != nil {
+		t.Errorf("Keys: got %v, %v", keys, err)
+	}
+	if chats, err := db.Namespace("none").Chats(); len(chats) != 0 || err != nil {
+		t.Errorf("Chats: got %v, %v", chats, err)
+	}
+
+	// Views do not create the bucket, so nothing can be written
+	err := b.View(func(tx *Tx) error {
+		return tx.Put("a", 1)
+	})
+	if err != ErrReadOnly {
+		t.Errorf("Put in View: got %v, want %v", err, ErrReadOnly)
+	}
+	if err := b.Delete("a"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+
+	// Nor once it exists
+	err = b.View(func(tx *Tx) error {
+		return tx.Put("a", 1)
+	})
+	if err != ErrReadOnly {
+		t.Errorf("Put in View of an existing bucket: got %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	db := openTest(t, t.TempDir())
+	b := db.Namespace("ns").Global()
+	if err := b.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	errFail := fmt.Errorf("fail")
+	err := b.Update(func(tx *Tx) error {
+		if err := tx.Put("a", 2); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if err != errFail {
+		t.Fatalf("Update: got %v, want %v", err, errFail)
+	}
+	var v int
+	if _, err := b.Get("a", &v); err != nil || v != 1 {
+		t.Errorf("after rollback: got %v, %v, want 1", v, err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Namespace("ns").Chat("chat#id1").Put("a", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var v string
+	found, err := openTest(t, dir).Namespace("ns").Chat("chat#id1").Get("a", &v)
+	if err != nil || !found || v != "x" {
+		t.Errorf("after reopening: got %q, %v, %v", v, found, err)
+	}
+}
+
+func TestRenameChat(t *testing.T) {
+	type value struct {
+		ns, chat, key, value string
+	}
+	tests := []struct {
+		name   string
+		before []value
+		after  []value // values expected after renaming Chat to chat#id1
+		gone   []value // values expected not to be found
+	}{
+		{
+			name: "moved",
+			before: []value{
+				{"quotes", "Chat", "a", "1"},
+				{"quotes", "Chat", "b", "2"},
+				{"breakfast", "Chat", "a", "3"},
+			},
+			after: []value{
+				{"quotes", "chat#id1", "a", "1"},
+				{"quotes", "chat#id1", "b", "2"},
+				{"breakfast", "chat#id1", "a", "3"},
+			},
+			gone: []value{
+				{"quotes", "Chat", "a", ""},
+				{"breakfast", "Chat", "a", ""},
+			},
+		},
+		{
+			name: "existing data kept",
+			before: []value{
+				{"quotes", "Chat", "a", "old"},
+				{"quotes", "chat#id1", "a", "new"},
+				{"breakfast", "Chat", "a", "moved"},
+			},
+			after: []value{
+				{"quotes", "chat#id1", "a", "new"},
+				{"quotes", "Chat", "a", "old"},
+				{"breakfast", "chat#id1", "a", "moved"},
+			},
+		},
+		{
+			name: "other chats untouched",
+			before: []value{
+				{"quotes", "Other", "a", "1"},
+			},
+			after: []value{
+				{"quotes", "Other", "a", "1"},
+			},
+			gone: []value{
+				{"quotes", "chat#id1", "a", ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		db := openTest(t, t.TempDir())
+		for _, v := range tt.before {
+			if err := db.Namespace(v.ns).Chat(v.chat).Put(v.key, v.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Namespaces without chats are skipped
+		if err := db.Namespace("global").Global().Put("a", "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.RenameChat("Chat", "chat#id1"); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		for _, v := range tt.after {
+			var got string
+			found, err := db.Namespace(v.ns).Chat(v.chat).Get(v.key, &got)
+			if err != nil || !found || got != v.value {
+				t.Errorf("%v: %v/%v/%v: got %q, %v, %v, want %q",
+					tt.name, v.ns, v.chat, v.key, got, found, err, v.value)
+			}
+		}
+		for _, v := range tt.gone {
+			var got string
+			if found, _ := db.Namespace(v.ns).Chat(v.chat).Get(v.key, &got); found {
+				t.Errorf("%v: %v/%v/%v: found %q", tt.name, v.ns, v.chat, v.key, got)
+			}
+		}
+	}
+}
@@ -5,7 +5,6 @@
 package bing
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -48,12 +47,17 @@ type Client struct {
 	Limit int
 }
 
-// NewClient returns a new Client. The parameter key allows to specify
-// the API key.
+// NewClient returns a new Client that uses http.DefaultClient. The
+// parameter key allows to specify the API key.
 func NewClient(key string) Client {
+	return NewClientHTTP(key, http.DefaultClient)
+}
+
+// NewClientHTTP returns a new Client that uses hc to send the requests.
+// The parameter key allows to specify the API key.
+func NewClientHTTP(key string, hc *http.Client) Client {
 	c := Client{}
-	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-	c.client = &http.Client{Transport: tr}
+	c.client = hc
 	c.key = key
 	c.Limit = 1
 	return c
@@ -5,32 +5,77 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const alnum = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+// Limits of the downloads.
+var (
+	// MaxDownloadSize is the size of the largest file that can be
+	// downloaded.
+	MaxDownloadSize int64 = 20 << 20
+	// MaxRedirects is the number of redirects followed by Download.
+	MaxRedirects = 5
+)
+
+// Errors returned by Download.
+var (
+	ErrTooLarge = errors.New("download: file too large")
+	ErrNotMedia = errors.New("download: not a media file")
+)
+
+// mediaExts are the extensions of the supported media types. Other media
+// types use the extension of the URL or the first one known by the mime
+// package.
+var mediaExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/wave": ".wav",
+	"audio/wav":  ".wav",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// Download downloads the given URL to the directory dir in a file with a random
-// name and the extension ext and returns the path of the created file.
-// If ext is empty string the file will be created with the same extension of
-// the original file at the given url.
+// Download downloads the given URL with the client c to the directory dir in a
+// file with a random name and returns the path of the created file.
+// Only images, audio and video are accepted, which is checked by sniffing
+// the content of the file. If ext is the empty string, the extension is
+// taken from the type of the content or, if it is unknown, the URL.
+// Files bigger than MaxDownloadSize are rejected and at most MaxRedirects
+// redirects are followed. On error, no file is left behind.
 // If dir is the empty string, download uses the default directory for temporary
 // files (see os.TempDir).
-func Download(dir, ext, targetURL string) (filePath string, err error) {
-	res, err := http.Get(targetURL)
+func Download(c *http.Client, dir, ext, targetURL string) (filePath string, err error) {
+	dc := *c
+	dc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > MaxRedirects {
+			return fmt.Errorf("download: stopped after %v redirects", MaxRedirects)
+		}
+		return nil
+	}
+
+	res, err := dc.Get(targetURL)
 	if err != nil {
 		return "", err
 	}
@@ -39,30 +84,87 @@ func Download(dir, ext, targetURL string) (filePath string, err error) {
 	if res.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("HTTP error: %v (%v)", res.Status, res.StatusCode)
 	}
+	if res.ContentLength > MaxDownloadSize {
+		return "", ErrTooLarge
+	}
+
+	// Sniff the content type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(res.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	ctype, ok := mediaType(head, res.Header.Get("Content-Type"))
+	if !ok {
+		return "", ErrNotMedia
+	}
 
 	if ext == "" {
-		// Parse URL to get its extension
-		u, err := url.Parse(targetURL)
-		if err != nil {
-			return "", err
-		}
-		ext = path.Ext(u.Path)
+		ext = mediaExt(ctype, res.Request.URL)
 	}
 
 	f, err := TempFile(dir, "", ext)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	defer f.Close()
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			filePath = ""
+		}
+	}()
 
-	_, err = io.Copy(f, res.Body)
+	body := io.MultiReader(bytes.NewReader(head), res.Body)
+	written, err := io.Copy(f, io.LimitReader(body, MaxDownloadSize+1))
 	if err != nil {
 		return "", err
 	}
-
+	if written > MaxDownloadSize {
+		return "", ErrTooLarge
+	}
 	return f.Name(), nil
 }
 
+// mediaType returns the media type of a file that starts with head and
+// has been served as declared, and whether it is an image, audio or
+// video. The declared type is only used if the content cannot be
+// identified.
+func mediaType(head []byte, declared string) (string, bool) {
+	ctype := http.DetectContentType(head)
+	if ctype == "application/octet-stream" && declared != "" {
+		ctype = declared
+	}
+	ctype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return "", false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(ctype, prefix) {
+			return ctype, true
+		}
+	}
+	return ctype, false
+}
+
+// mediaExt returns the extension of the files of type ctype downloaded
+// from u.
+func mediaExt(ctype string, u *url.URL) string {
+	if ext, ok := mediaExts[ctype]; ok {
+		return ext
+	}
+	if ext := path.Ext(u.Path); ext != "" {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(ctype); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
 // TempFile creates a new temporary file in the directory dir with a name
 // beginning with prefix and ending with suffix, opens the file for reading and
 // writing, and returns the resulting *os.File.
@@ -79,10 +181,5 @@ func TempFile(dir, prefix, suffix string) (*os.File, error) {
 	rnd := strconv.Itoa(rand.Int())
 	name := filepath.Join(dir, prefix+rnd+suffix)
 
-	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-	if os.IsExist(err) {
-		return nil, err
-	}
-
-	return f, nil
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 }
@@ -0,0 +1,213 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01")
+
+// downloadTest runs Download against a server that handles every request
+// with h and returns the path of the downloaded file, the error and the
+// files left in the download directory.
+func downloadTest(t *testing.T, h http.HandlerFunc, urlPath string) (string, error, []os.FileInfo) {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	dir := t.TempDir()
+
+	path, err := Download(ts.Client(), dir, "", ts.URL+urlPath)
+	files, rerr := ioutil.ReadDir(dir)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return path, err, files
+}
+
+func setMaxDownloadSize(t *testing.T, n int64) {
+	old := MaxDownloadSize
+	MaxDownloadSize = n
+	t.Cleanup(func() { MaxDownloadSize = old })
+}
+
+func TestDownload(t *testing.T) {
+	path, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testPNG)
+	}, "/pic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(path) != ".png" {
+		t.Errorf("extension of %v: got %q, want .png", path, filepath.Ext(path))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testPNG) {
+		t.Errorf("content: got %q, want %q", data, testPNG)
+	}
+	if len(files) != 1 {
+		t.Errorf("files: got %v, want 1", len(files))
+	}
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	setMaxDownloadSize(t, 100)
+
+	// Chunked, without Content-Length
+	_, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testPNG)
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 200))
+	}, "/pic")
+	if err != ErrTooLarge {
+		t.Errorf("error: got %v, want %v", err, ErrTooLarge)
+	}
+	if len(files) != 0 {
+		t.Errorf("files: got %v, want 0", len(files))
+	}
+
+	// Declared by Content-Length
+	_, err, _ = downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "200")
+		w.Write(append(testPNG, make([]byte, 200-len(testPNG))...))
+	}, "/pic")
+	if err != ErrTooLarge {
+		t.Errorf("error: got %v, want %v", err, ErrTooLarge)
+	}
+}
+
+// hijack writes the raw HTTP response resp to the connection of w and
+// closes it.
+func hijack(t *testing.T, w http.ResponseWriter, resp string) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	buf.WriteString(resp)
+	buf.Flush()
+}
+
+func TestDownloadLyingContentLength(t *testing.T) {
+	setMaxDownloadSize(t, 100)
+
+	// The body is bigger than declared, only the declared part is read
+	_, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		hijack(t, w, "HTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n"+
+			string(testPNG)+strings.Repeat("x", 500))
+	}, "/pic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Size() != 50 {
+		t.Errorf("files: got %v, want one of 50 bytes", files)
+	}
+
+	// The body is smaller than declared
+	_, err, files = downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		hijack(t, w, "HTTP/1.1 200 OK\r\nContent-Length: 90\r\n\r\n"+string(testPNG))
+	}, "/pic")
+	if err == nil {
+		t.Error("got nil error with a truncated body")
+	}
+	if len(files) != 0 {
+		t.Errorf("files: got %v, want 0", len(files))
+	}
+}
+
+func TestDownloadRedirectLoop(t *testing.T) {
+	n := 0
+	_, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		n++
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}, "/loop")
+	if err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Errorf("error: got %v, want redirect limit error", err)
+	}
+	if n != MaxRedirects+1 {
+		t.Errorf("requests: got %v, want %v", n, MaxRedirects+1)
+	}
+	if len(files) != 0 {
+		t.Errorf("files: got %v, want 0", len(files))
+	}
+}
+
+func TestDownloadNotMedia(t *testing.T) {
+	_, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		// A lying Content-Type must not matter
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>Not found</body></html>"))
+	}, "/pic.png")
+	if err != ErrNotMedia {
+		t.Errorf("error: got %v, want %v", err, ErrNotMedia)
+	}
+	if len(files) != 0 {
+		t.Errorf("files: got %v, want 0", len(files))
+	}
+}
+
+func TestDownloadExtension(t *testing.T) {
+	// The type of the content wins over the extension of the URL
+	path, err, _ := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testPNG)
+	}, "/pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(path) != ".png" {
+		t.Errorf("extension of %v: got %q, want .png", path, filepath.Ext(path))
+	}
+}
+
+func TestDownloadTempFileError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testPNG)
+	}))
+	defer ts.Close()
+
+	dir := filepath.Join(t.TempDir(), "missing")
+	_, err := Download(ts.Client(), dir, "", ts.URL)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("error: got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestDownloadBodyError(t *testing.T) {
+	// The connection is closed in the middle of a chunked body
+	_, err, files := downloadTest(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		bw := bufio.NewWriter(buf)
+		bw.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+		bw.WriteString("400\r\n")
+		bw.Write(append(testPNG, make([]byte, 0x400-len(testPNG))...))
+		bw.WriteString("\r\n400\r\nxxxx")
+		bw.Flush()
+	}, "/pic")
+	if err == nil {
+		t.Error("got nil error with a broken body")
+	}
+	if len(files) != 0 {
+		t.Errorf("files: got %v, want 0", len(files))
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/tgbot/utils/httpcache"
+)
+
+// Defaults of the HTTP clients.
+const (
+	DefaultHTTPTimeout = 30 * time.Second
+	DefaultUserAgent   = "tgbot"
+	DefaultRetries     = 2
+)
+
+// firstRetryDelay is the delay before the first retry. It doubles after
+// every retry.
+var firstRetryDelay = 500 * time.Millisecond
+
+// HTTPConfig configures the HTTP clients used to access a service. Zero
+// fields take the value of the defaults set with SetHTTPDefaults.
+type HTTPConfig struct {
+	// CACert is a PEM file with the certificates of the CAs trusted in
+	// addition to the system ones.
+	CACert string
+	// ClientCert and ClientKey are the PEM files of the certificate
+	// presented to the server.
+	ClientCert string
+	ClientKey  string
+	// Insecure disables the verification of the server certificate. It
+	// is a pointer so a service can set it to false when it is enabled
+	// in the defaults.
+	Insecure *bool
+
+	// Proxy is the URL of an HTTP, HTTPS or SOCKS5 proxy (e.g.
+	// "socks5://127.0.0.1:1080"). By default, the proxy is taken from
+	// the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+	Proxy string
+
+	UserAgent string
+	// Timeout is the time limit of every request, including reading the
+	// body (e.g. "30s").
+	Timeout string
+	// Retries is the number of times failed idempotent requests are
+	// retried, with exponential backoff. Negative disables them.
+	Retries int
+
+	// CacheTTL is the time the responses to GET requests are cached
+	// (e.g. "5m"). After it, they are revalidated with the server, but
+	// for CacheStale more they are still served while they are
+	// revalidated in the background. Unlike the rest of fields, they are
+	// not taken from the defaults, since the responses of some services
+	// must not be cached. CacheDir is the directory where the responses
+	// are stored, in addition to memory.
+	CacheTTL   string
+	CacheStale string
+	CacheDir   string
+}
+
+// WrapTransport, if not nil, wraps the transport of every client returned
+// by NewClient. It allows to record or stub the HTTP services used by the
+// commands.
+var WrapTransport func(http.RoundTripper) http.RoundTripper
+
+var (
+	httpMu       sync.Mutex
+	httpDefaults HTTPConfig
+	transports   = make(map[transportKey]*http.Transport)
+	caches       = make(map[string]*httpcache.Cache) // dir -> cache
+)
+
+// SetHTTPDefaults sets the configuration used by the clients for the
+// fields that are not set in their own configuration.
+func SetHTTPDefaults(cfg HTTPConfig) error {
+	if _, err := cfg.timeout(); err != nil {
+		return err
+	}
+	cfg.CacheTTL, cfg.CacheStale = "", ""
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	httpDefaults = cfg
+	return nil
+}
+
+// merge returns cfg with the zero fields taken from def.
+func (cfg HTTPConfig) merge(def HTTPConfig) HTTPConfig {
+	if cfg.CACert == "" {
+		cfg.CACert = def.CACert
+	}
+	if cfg.ClientCert == "" && cfg.ClientKey == "" {
+		cfg.ClientCert, cfg.ClientKey = def.ClientCert, def.ClientKey
+	}
+	if cfg.Insecure == nil {
+		cfg.Insecure = def.Insecure
+	}
+	if cfg.Proxy == "" {
+		cfg.Proxy = def.Proxy
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = def.UserAgent
+	}
+	if cfg.Timeout == "" {
+		cfg.Timeout = def.Timeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = def.Retries
+	}
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = def.CacheDir
+	}
+	return cfg
+}
+
+func (cfg HTTPConfig) timeout() (time.Duration, error) {
+	if cfg.Timeout == "" {
+		return DefaultHTTPTimeout, nil
+	}
+	d, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid HTTP timeout: %v", err)
+	}
+	return d, nil
+}
+
+// NewClient returns the http.Client that must be used by the commands to
+// access a service configured by cfg. Clients with the same configuration
+// share their connections.
+func NewClient(cfg HTTPConfig) (*http.Client, error) {
+	httpMu.Lock()
+	cfg = cfg.merge(httpDefaults)
+	httpMu.Unlock()
+
+	timeout, err := cfg.timeout()
+	if err != nil {
+		return nil, err
+	}
+	tr, err := transport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var rt http.RoundTripper = tr
+	if WrapTransport != nil {
+		rt = WrapTransport(rt)
+	}
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	retries := cfg.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	rt = &retryTransport{rt: rt, userAgent: ua, retries: retries}
+
+	// Recorded sessions must not depend on the state of the cache
+	if cfg.CacheTTL != "" && WrapTransport == nil {
+		ttl, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CacheTTL: %v", err)
+		}
+		var stale time.Duration
+		if cfg.CacheStale != "" {
+			if stale, err = time.ParseDuration(cfg.CacheStale); err != nil {
+				return nil, fmt.Errorf("invalid CacheStale: %v", err)
+			}
+		}
+		c, err := cache(cfg.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		rt = c.Transport(rt, ttl, stale)
+	}
+	return &http.Client{Transport: rt, Timeout: timeout}, nil
+}
+
+// cache returns the cache stored in dir, creating it the first time.
+func cache(dir string) (*httpcache.Cache, error) {
+	httpMu.Lock()
+	defer httpMu.Unlock()
+
+	if c, ok := caches[dir]; ok {
+		return c, nil
+	}
+	c, err := httpcache.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	caches[dir] = c
+	return c, nil
+}
+
+// transportKey holds the fields of HTTPConfig that affect the transport.
+type transportKey struct {
+	caCert, clientCert, clientKey string
+	insecure                      bool
+	proxy                         string
+}
+
+// transport returns the transport of the clients configured by cfg,
+// creating it the first time.
+func transport(cfg HTTPConfig) (*http.Transport, error) {
+	insecure := cfg.Insecure != nil && *cfg.Insecure
+	key := transportKey{
+		caCert:     cfg.CACert,
+		clientCert: cfg.ClientCert,
+		clientKey:  cfg.ClientKey,
+		insecure:   insecure,
+		proxy:      cfg.Proxy,
+	}
+
+	httpMu.Lock()
+	defer httpMu.Unlock()
+
+	if tr, ok := transports[key]; ok {
+		return tr, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP proxy: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid HTTP proxy: unsupported scheme %q", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+	}
+	transports[key] = tr
+	return tr, nil
+}
+
+// retryTransport sets the User-Agent of the requests and retries the
+// idempotent ones that fail because of network errors or temporary server
+// errors.
+type retryTransport struct {
+	rt        http.RoundTripper
+	userAgent string
+	retries   int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// RoundTrippers must not modify the request
+		r := new(http.Request)
+		*r = *req
+		r.Header = req.Header.Clone()
+		r.Header.Set("User-Agent", t.userAgent)
+		req = r
+	}
+
+	delay := firstRetryDelay
+	for i := 0; ; i++ {
+		res, err := t.rt.RoundTrip(req)
+		if i >= t.retries || !isIdempotent(req) || !isTemporary(res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// isIdempotent returns true if req can be sent again.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isTemporary returns true if the request failed because of a network
+// error or the server is temporarily unavailable.
+func isTemporary(res *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setHTTPDefaults sets the HTTP defaults for the duration of the test.
+func setHTTPDefaults(t *testing.T, cfg HTTPConfig) {
+	t.Helper()
+	httpMu.Lock()
+	old := httpDefaults
+	httpMu.Unlock()
+	if err := SetHTTPDefaults(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetHTTPDefaults(old) })
+}
+
+func newTestClient(t *testing.T, cfg HTTPConfig) *http.Client {
+	t.Helper()
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func getBody(client *http.Client, url string) (string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %v", res.StatusCode)
+	}
+	return string(body), nil
+}
+
+// flakyServer fails with 503 the first fails requests and records the
+// requests received.
+type flakyServer struct {
+	*httptest.Server
+	fails int
+
+	mu       sync.Mutex
+	requests []string // method, User-Agent and body
+}
+
+func newFlakyServer(t *testing.T, fails int) *flakyServer {
+	s := &flakyServer{fails: fails}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, fmt.Sprintf("%v %v %s", r.Method, r.UserAgent(), body))
+		n := len(s.requests)
+		s.mu.Unlock()
+		if n <= s.fails {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *flakyServer) got() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func TestRetries(t *testing.T) {
+	old := firstRetryDelay
+	firstRetryDelay = time.Millisecond
+	defer func() { firstRetryDelay = old }()
+	setHTTPDefaults(t, HTTPConfig{})
+
+	tests := []struct {
+		name    string
+		cfg     HTTPConfig
+		fails   int
+		method  string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "retried GET",
+			fails:  2,
+			method: "GET",
+			want:   []string{"GET tgbot ", "GET tgbot ", "GET tgbot "},
+		},
+		{
+			name:    "too many failures",
+			fails:   3,
+			method:  "GET",
+			want:    []string{"GET tgbot ", "GET tgbot ", "GET tgbot "},
+			wantErr: true,
+		},
+		{
+			name:   "PUT body sent again",
+			fails:  1,
+			method: "PUT",
+			body:   "data",
+			want:   []string{"PUT tgbot data", "PUT tgbot data"},
+		},
+		{
+			name:    "POST not retried",
+			fails:   1,
+			method:  "POST",
+			body:    "data",
+			want:    []string{"POST tgbot data"},
+			wantErr: true,
+		},
+		{
+			name:    "retries disabled",
+			cfg:     HTTPConfig{Retries: -1, UserAgent: "test"},
+			fails:   1,
+			method:  "GET",
+			want:    []string{"GET test "},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		s := newFlakyServer(t, tt.fails)
+		client := newTestClient(t, tt.cfg)
+		req, err := http.NewRequest(tt.method, s.URL, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		res.Body.Close()
+		if failed := res.StatusCode != http.StatusOK; failed != tt.wantErr {
+			t.Errorf("%v: got status %v", tt.name, res.StatusCode)
+		}
+		if got := s.got(); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%v: requests: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	setHTTPDefaults(t, HTTPConfig{})
+
+	var mu sync.Mutex
+	var urls []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		urls = append(urls, r.URL.String())
+		mu.Unlock()
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	client := newTestClient(t, HTTPConfig{Proxy: proxy.URL})
+	body, err := getBody(client, "http://service.invalid/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "proxied" {
+		t.Errorf("got %q, want %q", body, "proxied")
+	}
+	mu.Lock()
+	if fmt.Sprint(urls) != "[http://service.invalid/path]" {
+		t.Errorf("proxy requests: got %v", urls)
+	}
+	mu.Unlock()
+
+	// The proxy is taken from the defaults
+	setHTTPDefaults(t, HTTPConfig{Proxy: proxy.URL})
+	if body, err := getBody(newTestClient(t, HTTPConfig{}), "http://other.invalid/"); err != nil || body != "proxied" {
+		t.Errorf("default proxy: got %q, %v", body, err)
+	}
+
+	for _, p := range []string{"ftp://127.0.0.1:21", "://bad"} {
+		if _, err := NewClient(HTTPConfig{Proxy: p}); err == nil {
+			t.Errorf("proxy %q: got no error", p)
+		}
+	}
+}
+
+func TestCACert(t *testing.T) {
+	setHTTPDefaults(t, HTTPConfig{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getBody(newTestClient(t, HTTPConfig{}), ts.URL); err == nil {
+		t.Error("unknown CA: got no error")
+	}
+	if _, err := getBody(newTestClient(t, HTTPConfig{CACert: caCert}), ts.URL); err != nil {
+		t.Errorf("CACert: %v", err)
+	}
+
+	// The CA can be trusted by default
+	setHTTPDefaults(t, HTTPConfig{CACert: caCert})
+	if _, err := getBody(newTestClient(t, HTTPConfig{}), ts.URL); err != nil {
+		t.Errorf("default CACert: %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(bad, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{bad, filepath.Join(dir, "missing.pem")} {
+		if _, err := NewClient(HTTPConfig{CACert: f}); err == nil {
+			t.Errorf("CACert %v: got no error", f)
+		}
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		def, cfg *bool
+		wantErr  bool
+	}{
+		{"unset", nil, nil, true},
+		{"service", nil, &yes, false},
+		{"default", &yes, nil, false},
+		{"disabled by the service", &yes, &no, true},
+		{"disabled by default", &no, nil, true},
+	}
+	for _, tt := range tests {
+		setHTTPDefaults(t, HTTPConfig{Insecure: tt.def})
+		_, err := getBody(newTestClient(t, HTTPConfig{Insecure: tt.cfg}), ts.URL)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+	}
+}
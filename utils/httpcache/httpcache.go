@@ -0,0 +1,491 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httpcache caches the responses of HTTP services. Responses are
+// kept in memory and, optionally, on disk. Fresh responses are served
+// from the cache. Stale ones are revalidated with the server using their
+// ETag and Last-Modified headers, but they are still served while they
+// are revalidated in the background, so commands keep working for a while
+// when a service is down.
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the cache.
+const (
+	// MaxBodySize is the size of the largest body that is cached.
+	MaxBodySize = 10 << 20
+	// MaxMemSize is the size of the bodies kept in memory.
+	MaxMemSize = 64 << 20
+	// RevalidateTimeout is the time limit of the revalidations made in
+	// the background.
+	RevalidateTimeout = time.Minute
+)
+
+// Limits of the cache dir. The responses that have not been used for
+// MaxDiskAge are removed, and then the least recently used ones until
+// the size of the dir is MaxDiskSize.
+var (
+	MaxDiskSize int64 = 256 << 20
+	MaxDiskAge        = 7 * 24 * time.Hour
+)
+
+// evictInterval is the time between the eviction passes over the cache
+// dir when it is within its size.
+const evictInterval = time.Hour
+
+// tmpPrefix prefixes the entries being written to the cache dir.
+const tmpPrefix = ".tmp-"
+
+// An entry is a cached response.
+type entry struct {
+	Key    string
+	URL    string
+	Status string
+	Code   int
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+// response returns a new response to req with the content of e.
+func (e *entry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.Code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// A Cache stores the responses of the services.
+type Cache struct {
+	dir string
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // key -> *entry
+	lru      *list.List
+	size     int
+	updating map[string]bool
+
+	// Estimated size of the cache dir and state of the eviction
+	diskSize  int64
+	evicting  bool
+	lastEvict time.Time
+}
+
+// New returns an empty cache. If dir is not empty, the responses are also
+// stored in dir, so they are kept across restarts.
+func New(dir string) (*Cache, error) {
+	c := &Cache{
+		dir:      dir,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		updating: make(map[string]bool),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		c.evict()
+	}
+	return c, nil
+}
+
+// Transport returns a RoundTripper that caches the responses to the GET
+// requests sent with rt. Responses are fresh for ttl, and are served
+// while they are revalidated for stale more. Other requests invalidate
+// the responses of their URL.
+func (c *Cache) Transport(rt http.RoundTripper, ttl, stale time.Duration) http.RoundTripper {
+	return &transport{c: c, rt: rt, ttl: ttl, stale: stale}
+}
+
+type transport struct {
+	c          *Cache
+	rt         http.RoundTripper
+	ttl, stale time.Duration
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "" {
+		res, err := t.rt.RoundTrip(req)
+		if err == nil && res.StatusCode < 400 {
+			t.c.invalidate(req.URL.String())
+		}
+		return res, err
+	}
+	if req.Header.Get("Range") != "" || strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		return t.rt.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	e := t.c.get(key)
+	if e != nil {
+		age := time.Since(e.Stored)
+		switch {
+		case age < t.ttl:
+			return e.response(req), nil
+		case age < t.ttl+t.stale:
+			go t.revalidate(req, e)
+			return e.response(req), nil
+		}
+	}
+	return t.fetch(req, key, e)
+}
+
+// fetch sends req, conditional if there is a cached entry e, and caches
+// the response.
+func (t *transport) fetch(req *http.Request, key string, e *entry) (*http.Response, error) {
+	if e != nil {
+		req = req.Clone(req.Context())
+		if etag := e.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	res, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && e != nil {
+		res.Body.Close()
+		updated := *e
+		updated.Stored = time.Now()
+		updated.Header = e.Header.Clone()
+		for k, v := range res.Header {
+			updated.Header[k] = v
+		}
+		t.c.put(&updated)
+		return updated.response(req), nil
+	}
+	if !cacheable(res) {
+		return res, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxBodySize+1))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if len(body) > MaxBodySize {
+		// Too big, pass the rest of the body through
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+	res.Body.Close()
+
+	e = &entry{
+		Key:    key,
+		URL:    req.URL.String(),
+		Status: res.Status,
+		Code:   res.StatusCode,
+		Header: res.Header,
+		Body:   body,
+		Stored: time.Now(),
+	}
+	t.c.put(e)
+	return e.response(req), nil
+}
+
+// revalidate updates the stale entry e in the background. Failures keep
+// the stale entry.
+func (t *transport) revalidate(req *http.Request, e *entry) {
+	if !t.c.startUpdate(e.Key) {
+		return
+	}
+	defer t.c.endUpdate(e.Key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RevalidateTimeout)
+	defer cancel()
+	req = req.Clone(ctx)
+	res, err := t.fetch(req, e.Key, e)
+	if err != nil {
+		log.Printf("httpcache: cannot revalidate %v: %v\n", e.URL, err)
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+// cacheable returns true if res can be stored.
+func cacheable(res *http.Response) bool {
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	cc := res.Header.Get("Cache-Control")
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+// cacheKey returns the key of the response to req. The credentials are
+// part of the key, so users of a service do not see the responses sent
+// to others. The hash of the URL is the prefix of the key, so all the
+// responses of a URL can be found.
+func cacheKey(req *http.Request) string {
+	return hash(req.URL.String()) + "-" + hash(req.Header.Get("Authorization"))
+}
+
+func hash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:12])
+}
+
+func (c *Cache) get(key string) *entry {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*entry)
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return nil
+	}
+	e, err := c.load(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("httpcache:", err)
+		}
+		return nil
+	}
+	// The modification time of the files is their last use
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, key), now, now)
+	c.add(e)
+	return e
+}
+
+func (c *Cache) put(e *entry) {
+	c.add(e)
+	if c.dir == "" {
+		return
+	}
+	if err := c.store(e); err != nil {
+		log.Println("httpcache:", err)
+	}
+}
+
+// add adds e to the memory, removing the least recently used entries if
+// needed.
+func (c *Cache) add(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(e.Key)
+	c.entries[e.Key] = c.lru.PushFront(e)
+	c.size += len(e.Body)
+	for c.size > MaxMemSize && c.lru.Len() > 1 {
+		old := c.lru.Back().Value.(*entry)
+		c.removeLocked(old.Key)
+	}
+}
+
+func (c *Cache) removeLocked(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.size -= len(el.Value.(*entry).Body)
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// invalidate removes the responses of url.
+func (c *Cache) invalidate(url string) {
+	prefix := hash(url) + "-"
+
+	c.mu.Lock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.removeLocked(key)
+		}
+	}
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(c.dir, prefix+"*"))
+	if err != nil {
+		log.Println("httpcache:", err)
+		return
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			log.Println("httpcache:", err)
+		}
+	}
+}
+
+// startUpdate returns false if the entry key is already being updated.
+func (c *Cache) startUpdate(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.updating[key] {
+		return false
+	}
+	c.updating[key] = true
+	return true
+}
+
+func (c *Cache) endUpdate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.updating, key)
+}
+
+func (c *Cache) load(key string) (*entry, error) {
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var e entry
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// store writes e to the cache dir. The entry is written to a temporary
+// file first, so partial entries are never read.
+func (c *Cache) store(e *entry) error {
+	f, err := ioutil.TempFile(c.dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, e.Key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	c.diskSize += fi.Size()
+	start := !c.evicting && (c.diskSize > MaxDiskSize || time.Since(c.lastEvict) > evictInterval)
+	c.evicting = c.evicting || start
+	c.mu.Unlock()
+	if start {
+		go c.evict()
+	}
+	return nil
+}
+
+// evict removes from the cache dir the entries that have not been used
+// for MaxDiskAge and then the least recently used ones, until it is
+// within MaxDiskSize. Files that are not entries are left alone, except
+// the temporary files left by failed stores.
+func (c *Cache) evict() {
+	defer func() {
+		c.mu.Lock()
+		c.evicting = false
+		c.lastEvict = time.Now()
+		c.mu.Unlock()
+	}()
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Println("httpcache:", err)
+		return
+	}
+	remove := func(name string) bool {
+		err := os.Remove(filepath.Join(c.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("httpcache:", err)
+			return false
+		}
+		return true
+	}
+
+	var (
+		entries []os.FileInfo
+		size    int64
+	)
+	for _, fi := range files {
+		age := time.Since(fi.ModTime())
+		switch {
+		case !fi.Mode().IsRegular():
+		case strings.HasPrefix(fi.Name(), tmpPrefix):
+			if age > RevalidateTimeout {
+				remove(fi.Name())
+			}
+		case !isKey(fi.Name()):
+		case age > MaxDiskAge:
+			remove(fi.Name())
+		default:
+			entries = append(entries, fi)
+			size += fi.Size()
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, fi := range entries {
+		if size <= MaxDiskSize {
+			break
+		}
+		if remove(fi.Name()) {
+			size -= fi.Size()
+		}
+	}
+
+	c.mu.Lock()
+	c.diskSize = size
+	c.mu.Unlock()
+}
+
+// isKey returns true if name is a key returned by cacheKey.
+func isKey(name string) bool {
+	const n = 24 // hex digits of hash
+	if len(name) != 2*n+1 || name[n] != '-' {
+		return false
+	}
+	_, err1 := hex.DecodeString(name[:n])
+	_, err2 := hex.DecodeString(name[n+1:])
+	return err1 == nil && err2 == nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves the version of its content, which is increased by
+// bump, with an ETag. Conditional requests for the current version get
+// 304.
+type testServer struct {
+	*httptest.Server
+	version  int32
+	requests int32
+	notMod   int32
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		if r.Method != "GET" {
+			return
+		}
+		etag := fmt.Sprintf(`"v%v"`, atomic.LoadInt32(&s.version))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&s.notMod, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "%v %v", r.URL.Path, atomic.LoadInt32(&s.version))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) bump() {
+	atomic.AddInt32(&s.version, 1)
+}
+
+func (s *testServer) count() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+// newTestClient returns a client that caches in c.
+func newTestClient(c *Cache, ttl, stale time.Duration) *http.Client {
+	return &http.Client{Transport: c.Transport(http.DefaultTransport, ttl, stale)}
+}
+
+// waitIdle waits until c is not revalidating nor evicting entries in the
+// background.
+func waitIdle(t *testing.T, c *Cache) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		c.mu.Lock()
+		idle := len(c.updating) == 0 && !c.evicting
+		c.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for the cache")
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func newCache(t *testing.T, dir string) *Cache {
+	t.Helper()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTTL(t *testing.T) {
+	s := newTestServer(t)
+	client := newTestClient(newCache(t, ""), 100*time.Millisecond, 0)
+
+	if got := get(t, client, s.URL+"/a"); got != "/a 0" {
+		t.Fatalf("got %q, want %q", got, "/a 0")
+	}
+	s.bump()
+	if got := get(t, client, s.URL+"/a"); got != "/a 0" {
+		t.Errorf("fresh: got %q, want the cached response", got)
+	}
+	if n := s.count(); n != 1 {
+		t.Errorf("requests: got %v, want 1", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got := get(t, client, s.URL+"/a"); got != "/a 1" {
+		t.Errorf("expired: got %q, want %q", got, "/a 1")
+	}
+	if n := s.count(); n != 2 {
+		t.Errorf("requests: got %v, want 2", n)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	s := newTestServer(t)
+	c := newCache(t, "")
+	client := newTestClient(c, 50*time.Millisecond, time.Hour)
+
+	get(t, client, s.URL+"/a")
+	s.bump()
+	time.Sleep(100 * time.Millisecond)
+
+	// The stale response is served and revalidated in the background
+	if got := get(t, client, s.URL+"/a"); got != "/a 0" {
+		t.Errorf("stale: got %q, want %q", got, "/a 0")
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.count() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitIdle(t, c)
+	if got := get(t, client, s.URL+"/a"); got != "/a 1" {
+		t.Errorf("revalidated: got %q, want %q", got, "/a 1")
+	}
+	if n := s.count(); n != 2 {
+		t.Errorf("requests: got %v, want 2", n)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	s := newTestServer(t)
+	client := newTestClient(newCache(t, ""), 50*time.Millisecond, 0)
+
+	get(t, client, s.URL+"/a")
+	time.Sleep(100 * time.Millisecond)
+
+	// The cached body is served with the 304 and it is fresh again
+	if got := get(t, client, s.URL+"/a"); got != "/a 0" {
+		t.Errorf("not modified: got %q, want %q", got, "/a 0")
+	}
+	if n := atomic.LoadInt32(&s.notMod); n != 1 {
+		t.Errorf("304 responses: got %v, want 1", n)
+	}
+	get(t, client, s.URL+"/a")
+	if n := s.count(); n != 2 {
+		t.Errorf("requests: got %v, want 2", n)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	client := newTestClient(newCache(t, dir), time.Hour, 0)
+
+	get(t, client, s.URL+"/a")
+	get(t, client, s.URL+"/b")
+	s.bump()
+	res, err := client.Post(s.URL+"/a", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got := get(t, client, s.URL+"/a"); got != "/a 1" {
+		t.Errorf("invalidated: got %q, want %q", got, "/a 1")
+	}
+	if got := get(t, client, s.URL+"/b"); got != "/b 0" {
+		t.Errorf("other URL: got %q, want %q", got, "/b 0")
+	}
+
+	// The invalidation also applies to the entries on disk
+	s.bump()
+	res, err = client.Post(s.URL+"/b", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	client = newTestClient(newCache(t, dir), time.Hour, 0)
+	if got := get(t, client, s.URL+"/a"); got != "/a 1" {
+		t.Errorf("from disk: got %q, want %q", got, "/a 1")
+	}
+	if got := get(t, client, s.URL+"/b"); got != "/b 2" {
+		t.Errorf("invalidated on disk: got %q, want %q", got, "/b 2")
+	}
+}
+
+// cacheFiles returns the sorted names of the entries in dir.
+func cacheFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestEvictAge(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	client := newTestClient(newCache(t, dir), time.Hour, 0)
+	get(t, client, s.URL+"/a")
+	get(t, client, s.URL+"/b")
+
+	old := time.Now().Add(-MaxDiskAge - time.Hour)
+	keyA := hash(s.URL+"/a") + "-" + hash("")
+	if err := os.Chtimes(filepath.Join(dir, keyA), old, old); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, tmpPrefix+"123")
+	foreign := filepath.Join(dir, "notes.txt")
+	for _, f := range []string{tmp, foreign} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newCache(t, dir)
+	keyB := hash(s.URL+"/b") + "-" + hash("")
+	want := []string{keyB, "notes.txt"}
+	sort.Strings(want)
+	if got := cacheFiles(t, dir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+}
+
+func TestEvictSize(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	client := newTestClient(newCache(t, dir), time.Hour, 0)
+
+	var keys []string
+	for i, p := range []string{"/a", "/b", "/c"} {
+		get(t, client, s.URL+p)
+		key := hash(s.URL+p) + "-" + hash("")
+		mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	fi, err := os.Stat(filepath.Join(dir, keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Using /a makes /b the least recently used entry
+	get(t, newTestClient(newCache(t, dir), time.Hour, 0), s.URL+"/a")
+
+	old := MaxDiskSize
+	MaxDiskSize = 2 * fi.Size()
+	defer func() { MaxDiskSize = old }()
+
+	newCache(t, dir)
+	want := []string{keys[0], keys[2]}
+	sort.Strings(want)
+	if got := cacheFiles(t, dir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+}
+
+func TestEvictOnStore(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	c := newCache(t, dir)
+	client := newTestClient(c, time.Hour, 0)
+
+	old := MaxDiskSize
+	MaxDiskSize = 1
+	defer func() { MaxDiskSize = old }()
+
+	get(t, client, s.URL+"/a")
+	waitIdle(t, c)
+	if files := cacheFiles(t, dir); len(files) != 0 {
+		t.Errorf("files: got %v, want none", files)
+	}
+
+	// The entry is still in memory
+	if got := get(t, client, s.URL+"/a"); got != "/a 0" {
+		t.Errorf("got %q, want %q", got, "/a 0")
+	}
+}
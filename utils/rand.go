@@ -0,0 +1,33 @@
+// Copyright 2015 The tgbot Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Random generator used by the commands. Unlike the global generator of
+// math/rand, it can be seeded to reproduce recorded sessions.
+var (
+	rndMu sync.Mutex
+	rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Seed initializes the random generator used by the commands to a
+// deterministic state.
+func Seed(seed int64) {
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	rnd.Seed(seed)
+}
+
+// Intn returns a random number in [0,n). It panics if n <= 0.
+func Intn(n int) int {
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	return rnd.Intn(n)
+}